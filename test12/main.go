@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"os"
 	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/mattn/go-tty"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -16,6 +23,9 @@ const (
 	height = 20
 )
 
+// 中断したゲームの保存先
+const saveFile = "tetris_save.json"
+
 var shapes = [][][]int{
 	// I
 	{
@@ -80,14 +90,20 @@ func getRandomShape() [][]int {
 	return shapes[rand.Intn(len(shapes))]
 }
 
-func (g *Game) rotateShape() {
-	newShape := make([][]int, len(g.Shape[0]))
+// rotated 形状を時計回りに90度回転させたもの
+func rotated(shape [][]int) [][]int {
+	newShape := make([][]int, len(shape[0]))
 	for i := range newShape {
-		newShape[i] = make([]int, len(g.Shape))
+		newShape[i] = make([]int, len(shape))
 		for j := range newShape[i] {
-			newShape[i][j] = g.Shape[len(g.Shape)-j-1][i]
+			newShape[i][j] = shape[len(shape)-j-1][i]
 		}
 	}
+	return newShape
+}
+
+func (g *Game) rotateShape() {
+	newShape := rotated(g.Shape)
 
 	if !g.isCollision(newShape, g.PosX, g.PosY) {
 		g.Shape = newShape
@@ -195,21 +211,28 @@ func (g *Game) draw() {
 	fmt.Printf("\033[%d;%dH", height+1, 0)
 }
 
-func (g *Game) run() {
+func (g *Game) run(ctx context.Context) error {
+	t, err := tty.Open()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	errc := make(chan error, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
 	go func() {
-		tty, err := tty.Open()
-		if err != nil {
-			log.Fatal(err)
+		defer wg.Done()
+		if err := g.readInput(ctx, t); err != nil {
+			errc <- err
 		}
-		defer tty.Close()
+	}()
 
-		for {
-			r, err := tty.ReadRune()
-			if err != nil {
-				log.Fatal(err)
-			}
-			g.Input <- r
-		}
+	// 終了時は入力の読み取りを止めてからターミナルを元に戻す
+	defer func() {
+		cancel()
+		wg.Wait()
+		t.Close()
 	}()
 
 	ticker := time.NewTicker(500 * time.Millisecond)
@@ -217,6 +240,10 @@ func (g *Game) run() {
 
 	for !g.GameOver {
 		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errc:
+			return err
 		case <-ticker.C:
 			g.dropShape()
 		case r := <-g.Input:
@@ -233,11 +260,168 @@ func (g *Game) run() {
 		}
 		g.draw()
 	}
-	fmt.Println("Game Over!")
+	return nil
+}
+
+// readInput ttyからキー入力を読み取ってInputへ送る。ctxがキャンセルされると終了する
+func (g *Game) readInput(ctx context.Context, t *tty.TTY) error {
+	for {
+		ok, err := waitInput(ctx, t)
+		if err != nil || !ok {
+			return err
+		}
+		r, err := t.ReadRune()
+		if err != nil {
+			return err
+		}
+		select {
+		case g.Input <- r:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// waitInput 入力が届くかctxがキャンセルされるまで待つ
+func waitInput(ctx context.Context, t *tty.TTY) (bool, error) {
+	fds := []unix.PollFd{{Fd: int32(t.Input().Fd()), Events: unix.POLLIN}}
+	for {
+		if ctx.Err() != nil {
+			return false, nil
+		}
+		if t.Buffered() {
+			return true, nil
+		}
+		n, err := unix.Poll(fds, 100)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if n > 0 {
+			return true, nil
+		}
+	}
+}
+
+// savedGame 中断したゲームの保存形式
+type savedGame struct {
+	Field [][]int `json:"field"`
+	Shape [][]int `json:"shape"`
+	PosX  int     `json:"pos_x"`
+	PosY  int     `json:"pos_y"`
+}
+
+// saveState ゲームの状態をファイルに保存する
+func (g *Game) saveState(path string) error {
+	data, err := json.Marshal(savedGame{
+		Field: g.Field,
+		Shape: g.Shape,
+		PosX:  g.PosX,
+		PosY:  g.PosY,
+	})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// loadState 保存されたゲームを読み込む
+// 壊れたファイルや書き換えられたファイルは状態を変えずにエラーを返す
+func (g *Game) loadState(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var saved savedGame
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	if err := saved.validate(); err != nil {
+		return fmt.Errorf("%s: broken save data: %v", path, err)
+	}
+	g.Field = saved.Field
+	g.Shape = saved.Shape
+	g.PosX = saved.PosX
+	g.PosY = saved.PosY
+	return os.Remove(path)
+}
+
+// validate 保存されたフィールドの大きさ、テトリミノの形状と位置がそのまま遊べるものか確認する
+func (s savedGame) validate() error {
+	if len(s.Field) != height {
+		return fmt.Errorf("field has %d rows, want %d", len(s.Field), height)
+	}
+	for y, row := range s.Field {
+		if len(row) != width {
+			return fmt.Errorf("row %d has %d cells, want %d", y, len(row), width)
+		}
+	}
+	if shapeIndex(s.Shape) < 0 {
+		return errors.New("unknown shape")
+	}
+	field := &Game{Field: s.Field}
+	if s.PosY < 0 || field.isCollision(s.Shape, s.PosX, s.PosY) {
+		return fmt.Errorf("shape position (%d, %d) is outside the field", s.PosX, s.PosY)
+	}
+	return nil
+}
+
+// shapeIndex 形状がshapesのどのテトリミノをいくつ回転させたものかを調べ、テトリミノの番号を返す（なければ-1）
+func shapeIndex(shape [][]int) int {
+	for i, s := range shapes {
+		for r := 0; r < 4; r++ {
+			if equalShape(s, shape) {
+				return i
+			}
+			s = rotated(s)
+		}
+	}
+	return -1
+}
+
+// equalShape 2つの形状が同じか
+func equalShape(a, b [][]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for y := range a {
+		if len(a[y]) != len(b[y]) {
+			return false
+		}
+		for x := range a[y] {
+			if a[y][x] != b[y][x] {
+				return false
+			}
+		}
+	}
+	return true
 }
 
 func main() {
 	rand.Seed(time.Now().UnixNano())
+
+	// SIGINT/SIGTERMを受け取ったらゲームループを止める
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	game := NewGame()
-	game.run()
+	if err := game.loadState(saveFile); err != nil && !os.IsNotExist(err) {
+		log.Println("failed to load saved game:", err)
+	}
+
+	err := game.run(ctx)
+	if ctx.Err() != nil {
+		// シグナルで中断された場合は状態を保存して次回再開できるようにする
+		if err := game.saveState(saveFile); err != nil {
+			log.Fatal("failed to save game: ", err)
+		}
+		fmt.Printf("\nゲームを%sに保存しました。\n", saveFile)
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Game Over!")
 }
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// ボットが1キー入力するまでの間隔
+const botInterval = 80 * time.Millisecond
+
+// Weights 盤面を評価するときの各指標の重み
+type Weights struct {
+	Height    float64 // 各列の高さの合計
+	Lines     float64 // 消去したライン数
+	Holes     float64 // ブロックの下にある空きマスの数
+	Bumpiness float64 // 隣り合う列の高さの差の合計
+}
+
+// Strategy 盤面の評価方法と先読みの有無
+type Strategy struct {
+	Name      string
+	Weights   Weights
+	Lookahead bool // 次のピースまで含めて置き場所を探す
+}
+
+var defaultWeights = Weights{
+	Height:    -0.510066,
+	Lines:     0.760666,
+	Holes:     -0.35663,
+	Bumpiness: -0.184483,
+}
+
+// 選択できる戦略
+var strategies = []Strategy{
+	{Name: "lookahead", Weights: defaultWeights, Lookahead: true},
+	{Name: "greedy", Weights: defaultWeights},
+}
+
+// findStrategy 名前から戦略を探す
+func findStrategy(name string) (Strategy, error) {
+	for _, s := range strategies {
+		if s.Name == name {
+			return s, nil
+		}
+	}
+	return Strategy{}, fmt.Errorf("unknown strategy: %s", name)
+}
+
+// placement ピースの置き場所と、置いた後の盤面
+type placement struct {
+	Rotation int
+	PosX     int
+	Field    [][]int
+	Lines    int
+}
+
+// Bot 通常のキー入力と同じ経路でゲームを操作する自動プレイヤー
+type Bot struct {
+	Strategy Strategy
+
+	keys    []rune
+	pieces  int
+	planned bool
+}
+
+// nextKey 次に入力するキーを返す。新しいピースが出るたびに置き場所を探し直す
+func (b *Bot) nextKey(g *Game) rune {
+	if b.planned && g.Pieces != b.pieces {
+		b.planned = false
+	}
+	if !b.planned {
+		b.keys = b.plan(g)
+		b.pieces = g.Pieces
+		b.planned = true
+	}
+	if len(b.keys) > 0 {
+		k := b.keys[0]
+		b.keys = b.keys[1:]
+		return k
+	}
+	// 置き場所に着いたらピースが固定されるまで落とす
+	return 's'
+}
+
+// plan 最も評価の高い置き場所までのキー入力を求める
+func (b *Bot) plan(g *Game) []rune {
+	best := math.Inf(-1)
+	var target *placement
+	for _, p := range placements(g, g.Field, g.Piece, g.Rotation, g.PosX, g.PosY) {
+		score := b.Strategy.Weights.evaluate(p.Field, p.Lines)
+		if b.Strategy.Lookahead {
+			score = math.Inf(-1)
+			next := spawnState(g, g.NextPiece)
+			for _, q := range placements(g, p.Field, g.NextPiece, 0, next.PosX, next.PosY) {
+				score = math.Max(score, b.Strategy.Weights.evaluate(q.Field, p.Lines+q.Lines))
+			}
+		}
+		if target == nil || score > best {
+			best = score
+			target = &p
+		}
+	}
+	if target == nil {
+		return nil
+	}
+
+	var keys []rune
+	for r := g.Rotation; r != target.Rotation; r = (r + 1) % len(g.Piece.Rotations) {
+		keys = append(keys, 'w')
+	}
+	for x := g.PosX; x < target.PosX; x++ {
+		keys = append(keys, 'd')
+	}
+	for x := g.PosX; x > target.PosX; x-- {
+		keys = append(keys, 'a')
+	}
+	return keys
+}
+
+// spawnState ピースが出現した直後の状態を作る
+func spawnState(g *Game, piece Piece) *Game {
+	return &Game{
+		Width:  g.Width,
+		Height: g.Height,
+		Piece:  piece,
+		Shape:  piece.Rotations[0],
+		PosX:   (g.Width - len(piece.Rotations[0][0])) / 2,
+	}
+}
+
+// placements 指定した位置から回転、左右移動の順に操作して到達できる置き場所をすべて列挙する
+func placements(g *Game, field [][]int, piece Piece, rotation, posX, posY int) []placement {
+	start := &Game{Width: g.Width, Height: g.Height, Field: field}
+	if start.isCollision(piece.Rotations[rotation], posX, posY) {
+		return nil
+	}
+
+	var result []placement
+	for r := 0; r < len(piece.Rotations); r++ {
+		for x := -len(piece.Rotations[r][0]); x < g.Width; x++ {
+			sim := &Game{
+				Width:    g.Width,
+				Height:   g.Height,
+				Field:    copyField(field),
+				Piece:    piece,
+				Rotation: rotation,
+				Shape:    piece.Rotations[rotation],
+				PosX:     posX,
+				PosY:     posY,
+			}
+			for sim.Rotation != r {
+				before := sim.Rotation
+				sim.rotateShape()
+				if sim.Rotation == before {
+					break
+				}
+			}
+			for sim.PosX != x {
+				before := sim.PosX
+				if sim.PosX < x {
+					sim.moveShape(1)
+				} else {
+					sim.moveShape(-1)
+				}
+				if sim.PosX == before {
+					break
+				}
+			}
+			if sim.Rotation != r || sim.PosX != x {
+				continue
+			}
+			for !sim.isCollision(sim.Shape, sim.PosX, sim.PosY+1) {
+				sim.PosY++
+			}
+			sim.mergeShape()
+			lines := sim.clearLines()
+			result = append(result, placement{Rotation: r, PosX: x, Field: sim.Field, Lines: lines})
+		}
+	}
+	return result
+}
+
+// copyField フィールドを複製する
+func copyField(field [][]int) [][]int {
+	c := make([][]int, len(field))
+	for y, row := range field {
+		c[y] = append([]int(nil), row...)
+	}
+	return c
+}
+
+// evaluate 盤面の良さを重み付きの合計で求める
+func (w Weights) evaluate(field [][]int, lines int) float64 {
+	height := len(field)
+	heights := make([]int, len(field[0]))
+	holes := 0
+	for x := range heights {
+		for y := 0; y < height; y++ {
+			if field[y][x] != 0 {
+				if heights[x] == 0 {
+					heights[x] = height - y
+				}
+			} else if heights[x] != 0 {
+				holes++
+			}
+		}
+	}
+
+	aggregate, bumpiness := 0, 0
+	for x, h := range heights {
+		aggregate += h
+		if x > 0 {
+			bumpiness += abs(h - heights[x-1])
+		}
+	}
+
+	return w.Height*float64(aggregate) +
+		w.Lines*float64(lines) +
+		w.Holes*float64(holes) +
+		w.Bumpiness*float64(bumpiness)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// botTicks ボットの操作タイミングを知らせるチャネル。ボットがいなければnilを返す
+func (g *Game) botTicks() <-chan time.Time {
+	if g.bot == nil {
+		return nil
+	}
+	return g.botTicker.C
+}
+
+// botStep デモモードでボットに1キー操作させる。ゲームオーバーになったら新しいゲームを始める
+func (g *Game) botStep() {
+	if g.Paused {
+		return
+	}
+	if g.GameOver {
+		if !g.Versus {
+			g.reset()
+			g.ticker.Reset(g.interval())
+		}
+		return
+	}
+	g.handleInput(g.bot.nextKey(g))
+}
+
+// BenchResult ベンチマークの1シード分の結果
+type BenchResult struct {
+	Seed    int64
+	Lines   int
+	Score   int
+	Pieces  int
+	Elapsed time.Duration // ゲーム内の経過時間（シミュレーションした時間）
+	Took    time.Duration
+}
+
+// benchmark 画面を使わずに固定のシードでボットを遊ばせ、消去したライン数を測る
+func benchmark(cfg Config, strategy Strategy, seeds []int64, maxPieces int) []BenchResult {
+	var results []BenchResult
+	for _, seed := range seeds {
+		cfg.Seed = seed
+		g := NewGame(cfg)
+		g.bot = &Bot{Strategy: strategy}
+		start := time.Now()
+		// 時計は実際の時間ではなく、ボットが1手ごとにbotIntervalだけ進めたものとして進める（ウルトラの制限時間で終わるように）
+		now := g.lastUpdate
+		for !g.GameOver && g.Pieces < maxPieces {
+			now = now.Add(botInterval)
+			g.updateClock(now)
+			g.handleInput(g.bot.nextKey(g))
+			g.checkGoal()
+		}
+		g.ticker.Stop()
+		results = append(results, BenchResult{
+			Seed:    seed,
+			Lines:   g.Lines,
+			Score:   g.Score,
+			Pieces:  g.Pieces,
+			Elapsed: g.Elapsed,
+			Took:    time.Since(start),
+		})
+	}
+	return results
+}
+
+// printBenchmark ベンチマークの結果を表示する
+func printBenchmark(strategy Strategy, results []BenchResult) {
+	fmt.Printf("strategy: %s\n", strategy.Name)
+	total := 0
+	for _, r := range results {
+		fmt.Printf("seed %d: lines %d  score %d  pieces %d  game time %s  (%s)\n",
+			r.Seed, r.Lines, r.Score, r.Pieces, formatDuration(r.Elapsed), r.Took.Round(time.Millisecond))
+		total += r.Lines
+	}
+	if len(results) > 0 {
+		fmt.Printf("average lines: %.1f\n", float64(total)/float64(len(results)))
+	}
+}
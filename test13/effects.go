@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// 演出の時間
+const (
+	frameInterval    = 50 * time.Millisecond  // 演出中の再描画の間隔
+	flashDuration    = 300 * time.Millisecond // 消去した行を点滅させる時間
+	collapseDuration = 150 * time.Millisecond // 消去した行を空白にしてから詰めるまでの時間
+	blinkInterval    = 75 * time.Millisecond  // 点滅の切り替え間隔
+	bannerDuration   = time.Second            // レベルアップなどの表示時間
+)
+
+// Effect 一定時間だけ表示する演出。ゲームの状態は変えず、描画だけに使う
+type Effect struct {
+	Start    time.Time
+	Duration time.Duration
+
+	// 行の消去演出で使う、消去前のフィールドと消去した行
+	Before [][]int
+	Rows   map[int]bool
+
+	// バナー演出で表示する文字列
+	Text string
+}
+
+// active 指定した時刻に表示中かどうか
+func (e Effect) active(now time.Time) bool {
+	return now.Sub(e.Start) < e.Duration
+}
+
+// addEffect 演出を追加する。終わった演出はここで取り除く
+// 画面に描画していない（ベンチマークなど）ときは何もしない
+func (g *Game) addEffect(e Effect) {
+	if g.frameTicker == nil {
+		return
+	}
+	g.pruneEffects(e.Start)
+	g.effects = append(g.effects, e)
+}
+
+// pruneEffects 表示が終わった演出を取り除く
+func (g *Game) pruneEffects(now time.Time) {
+	effects := g.effects[:0]
+	for _, e := range g.effects {
+		if e.active(now) {
+			effects = append(effects, e)
+		}
+	}
+	g.effects = effects
+}
+
+// addClearEffect 揃った行を点滅させてから詰める演出を追加する
+func (g *Game) addClearEffect(before [][]int) {
+	rows := map[int]bool{}
+	for y, row := range before {
+		full := true
+		for _, cell := range row {
+			if cell == 0 {
+				full = false
+				break
+			}
+		}
+		if full {
+			rows[y] = true
+		}
+	}
+	if len(rows) == 0 {
+		return
+	}
+	g.addEffect(Effect{
+		Start:    time.Now(),
+		Duration: flashDuration + collapseDuration,
+		Before:   before,
+		Rows:     rows,
+	})
+}
+
+// addBanner フィールドの中央に文字列を表示する演出を追加する
+func (g *Game) addBanner(text string) {
+	g.addEffect(Effect{
+		Start:    time.Now(),
+		Duration: bannerDuration,
+		Text:     text,
+	})
+}
+
+// frameTicks 演出中だけ再描画のタイミングを知らせるチャネル。演出がなければnilを返す
+func (g *Game) frameTicks() <-chan time.Time {
+	if len(g.effects) == 0 || g.frameTicker == nil {
+		return nil
+	}
+	return g.frameTicker.C
+}
+
+// fieldView 演出を反映した表示用のフィールドと、点灯させる行を返す
+func (g *Game) fieldView(now time.Time) ([][]int, map[int]bool) {
+	for i := len(g.effects) - 1; i >= 0; i-- {
+		e := g.effects[i]
+		if e.Before == nil || !e.active(now) {
+			continue
+		}
+		elapsed := now.Sub(e.Start)
+		if elapsed < flashDuration {
+			// 点滅：消去した行を一定間隔で点けたり消したりする
+			if (elapsed/blinkInterval)%2 == 0 {
+				return e.Before, e.Rows
+			}
+			return e.Before, nil
+		}
+		// 詰める直前：消去した行を空白にする
+		field := make([][]int, len(e.Before))
+		for y, row := range e.Before {
+			if e.Rows[y] {
+				field[y] = make([]int, len(row))
+			} else {
+				field[y] = row
+			}
+		}
+		return field, nil
+	}
+	return g.Field, nil
+}
+
+// drawBanners 表示中のバナーをフィールドの中央に重ねて表示する
+func (g *Game) drawBanners(now time.Time) {
+	line := g.Height / 2
+	for _, e := range g.effects {
+		if e.Text == "" || !e.active(now) {
+			continue
+		}
+		text := e.Text
+		if len(text) > g.Width {
+			text = text[:g.Width]
+		}
+		col := (g.Width-len(text))/2 + 1
+		fmt.Printf("\033[%d;%dH%s", line, col, text)
+		line++
+	}
+}
@@ -1,97 +1,179 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"math/rand"
 	"os"
 	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/mattn/go-tty"
+	"golang.org/x/sys/unix"
 )
 
+// フィールドの大きさの既定値
 const (
-	width  = 10
-	height = 20
+	defaultWidth  = 10
+	defaultHeight = 20
 )
 
-var shapes = [][][]int{
-	// I
-	{
-		{1, 1, 1, 1},
-	},
-	// O
-	{
-		{1, 1},
-		{1, 1},
-	},
-	// T
-	{
-		{0, 1, 0},
-		{1, 1, 1},
-	},
-	// L
-	{
-		{1, 0, 0},
-		{1, 1, 1},
-	},
-	// J
-	{
-		{0, 0, 1},
-		{1, 1, 1},
-	},
-	// Z
-	{
-		{1, 1, 0},
-		{0, 1, 1},
-	},
-	// S
-	{
-		{0, 1, 1},
-		{1, 1, 0},
-	},
+// 落下の間隔
+const tickInterval = 500 * time.Millisecond
+
+// 中断したゲームの保存先
+const saveFile = "tetris_save.json"
+
+// ターミナルのフォーカス通知を表す特殊キー
+const (
+	keyFocusIn  rune = -1
+	keyFocusOut rune = -2
+)
+
+// メニューの項目
+const (
+	menuResume  = "Resume"
+	menuRestart = "Restart"
+	menuNewGame = "New Game"
+	menuQuit    = "Quit"
+)
+
+// Config ゲームの設定
+type Config struct {
+	Width    int
+	Height   int
+	PieceSet []Piece
+	Mode     GameMode
+	Seed     int64 // ピースの出現順を決める乱数のシード（0なら現在時刻）
+}
+
+// validate フィールドの大きさとピースの組み合わせが遊べるものか確認する
+func (c Config) validate() error {
+	if c.Width < 4 || c.Height < 4 {
+		return fmt.Errorf("field must be at least 4x4: %dx%d", c.Width, c.Height)
+	}
+	for _, p := range c.PieceSet {
+		for _, shape := range p.Rotations {
+			if len(shape[0]) > c.Width || len(shape) > c.Height {
+				return fmt.Errorf("piece %q does not fit in a %dx%d field", p.Name, c.Width, c.Height)
+			}
+		}
+	}
+	return nil
 }
 
 type Game struct {
+	Width     int
+	Height    int
+	PieceSet  []Piece
 	Field     [][]int
-	Shape     [][]int
-	NextShape [][]int
+	Piece     Piece
+	Rotation  int
+	Shape     [][]int // 現在の回転状態のPieceの形状
+	NextPiece Piece
 	PosX      int
 	PosY      int
 	GameOver  bool
+	Cleared   bool // モードの目標を達成して終了した
+	Paused    bool
+	Quit      bool
+	MenuIndex int
+	Mode      GameMode
+	Lines     int
+	Score     int
+	Pieces    int
+	Elapsed   time.Duration
+	Message   string
 	Input     chan rune
+
+	Versus         bool // TCPで対戦中
+	PendingGarbage int  // 次にせり上がるお邪魔ブロックの行数
+
+	ticker     *time.Ticker
+	lastUpdate time.Time
+	peer       *Peer
+	rng        *rand.Rand
+	bot        *Bot
+	botTicker  *time.Ticker
+
+	effects     []Effect
+	frameTicker *time.Ticker
+
+	leaderboard    []LeaderboardEntry // ゲーム終了時に読み込んだリーダーボード（描画のたびに読まない）
+	leaderboardErr error
 }
 
-func NewGame() *Game {
-	field := make([][]int, height)
-	for i := range field {
-		field[i] = make([]int, width)
+func NewGame(cfg Config) *Game {
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
 	}
-	return &Game{
-		Field:     field,
-		Shape:     getRandomShape(),
-		NextShape: getRandomShape(),
-		PosX:      width/2 - 1,
-		PosY:      0,
-		Input:     make(chan rune),
+	g := &Game{
+		Width:    cfg.Width,
+		Height:   cfg.Height,
+		PieceSet: cfg.PieceSet,
+		Mode:     cfg.Mode,
+		Input:    make(chan rune),
+		ticker:   time.NewTicker(tickInterval),
+		rng:      rand.New(rand.NewSource(seed)),
+	}
+	g.reset()
+	return g
+}
+
+// reset フィールドとテトリミノを初期状態に戻す
+func (g *Game) reset() {
+	field := make([][]int, g.Height)
+	for i := range field {
+		field[i] = make([]int, g.Width)
 	}
+	g.Field = field
+	g.NextPiece = g.randomPiece()
+	g.spawnPiece()
+	g.GameOver = false
+	g.Cleared = false
+	g.Paused = false
+	g.MenuIndex = 0
+	g.Lines = 0
+	g.Score = 0
+	g.Pieces = 0
+	g.Elapsed = 0
+	g.Message = ""
+	g.effects = nil
+	g.leaderboard = nil
+	g.leaderboardErr = nil
+	g.lastUpdate = time.Now()
+}
+
+// randomPiece ピースセットからランダムに1つ選ぶ
+func (g *Game) randomPiece() Piece {
+	return g.PieceSet[g.rng.Intn(len(g.PieceSet))]
 }
 
-func getRandomShape() [][]int {
-	return shapes[rand.Intn(len(shapes))]
+// spawnPiece 次のピースをフィールドの上部中央に出現させる
+func (g *Game) spawnPiece() {
+	g.Piece = g.NextPiece
+	g.NextPiece = g.randomPiece()
+	g.Rotation = 0
+	g.Shape = g.Piece.Rotations[0]
+	g.PosX = (g.Width - len(g.Shape[0])) / 2
+	g.PosY = 0
 }
 
 func (g *Game) rotateShape() {
-	newShape := make([][]int, len(g.Shape[0]))
-	for i := range newShape {
-		newShape[i] = make([]int, len(g.Shape))
-		for j := range newShape[i] {
-			newShape[i][j] = g.Shape[len(g.Shape)-j-1][i]
-		}
-	}
+	rotation := (g.Rotation + 1) % len(g.Piece.Rotations)
+	newShape := g.Piece.Rotations[rotation]
 
 	if !g.isCollision(newShape, g.PosX, g.PosY) {
+		g.Rotation = rotation
 		g.Shape = newShape
 	}
 }
@@ -104,7 +186,7 @@ func (g *Game) isCollision(shape [][]int, offsetX, offsetY int) bool {
 			}
 			newX := offsetX + x
 			newY := offsetY + y
-			if newX < 0 || newX >= width || newY >= height || (newY >= 0 && g.Field[newY][newX] != 0) {
+			if newX < 0 || newX >= g.Width || newY >= g.Height || (newY >= 0 && g.Field[newY][newX] != 0) {
 				return true
 			}
 		}
@@ -122,13 +204,14 @@ func (g *Game) mergeShape() {
 	}
 }
 
-func (g *Game) clearLines() {
-	newField := make([][]int, height)
-	newRow := height - 1
+// clearLines 揃った行を消去し、消去した行数を返す
+func (g *Game) clearLines() int {
+	newField := make([][]int, g.Height)
+	newRow := g.Height - 1
 
-	for y := height - 1; y >= 0; y-- {
+	for y := g.Height - 1; y >= 0; y-- {
 		fullLine := true
-		for x := 0; x < width; x++ {
+		for x := 0; x < g.Width; x++ {
 			if g.Field[y][x] == 0 {
 				fullLine = false
 				break
@@ -141,10 +224,11 @@ func (g *Game) clearLines() {
 	}
 
 	for i := 0; i <= newRow; i++ {
-		newField[i] = make([]int, width)
+		newField[i] = make([]int, g.Width)
 	}
 
 	g.Field = newField
+	return newRow + 1
 }
 
 func (g *Game) dropShape() {
@@ -152,13 +236,19 @@ func (g *Game) dropShape() {
 	if g.isCollision(g.Shape, g.PosX, g.PosY) {
 		g.PosY--
 		g.mergeShape()
-		g.clearLines()
-		g.Shape = g.NextShape
-		g.NextShape = getRandomShape()
-		g.PosX = width/2 - 1
-		g.PosY = 0
+		g.Pieces++
+		before := copyField(g.Field)
+		lines := g.clearLines()
+		if lines > 0 {
+			g.addClearEffect(before)
+		}
+		g.addLines(lines)
+		g.spawnPiece()
+		if g.Versus {
+			g.exchangeGarbage(lines)
+		}
 		if g.isCollision(g.Shape, g.PosX, g.PosY) {
-			g.GameOver = true
+			g.endGame()
 		}
 	}
 }
@@ -175,13 +265,125 @@ func clearScreen() {
 	cmd.Run()
 }
 
+// menuItems 現在の状態で選択できるメニュー項目を返す
+func (g *Game) menuItems() []string {
+	if g.Versus {
+		return []string{menuQuit}
+	}
+	if g.GameOver {
+		return []string{menuNewGame, menuQuit}
+	}
+	return []string{menuResume, menuRestart, menuQuit}
+}
+
+// pause ゲームを一時停止し、落下のタイマーを止める
+func (g *Game) pause() {
+	if g.Paused || g.GameOver {
+		return
+	}
+	g.Paused = true
+	g.MenuIndex = 0
+	g.ticker.Stop()
+}
+
+// resume 一時停止を解除し、落下のタイマーを再開する
+func (g *Game) resume() {
+	g.Paused = false
+	g.ticker.Reset(g.interval())
+}
+
+// selectMenu 選択中のメニュー項目を実行する
+func (g *Game) selectMenu() {
+	switch g.menuItems()[g.MenuIndex] {
+	case menuResume:
+		g.resume()
+	case menuRestart, menuNewGame:
+		g.reset()
+		g.ticker.Reset(g.interval())
+	case menuQuit:
+		g.Quit = true
+	}
+}
+
+// handleMenuInput メニュー表示中のキー入力を処理する
+func (g *Game) handleMenuInput(r rune) {
+	items := g.menuItems()
+	switch r {
+	case 'w':
+		g.MenuIndex = (g.MenuIndex + len(items) - 1) % len(items)
+	case 's':
+		g.MenuIndex = (g.MenuIndex + 1) % len(items)
+	case '\r', '\n', ' ':
+		g.selectMenu()
+	case 'p':
+		if g.Paused {
+			g.resume()
+		}
+	case 'q':
+		g.Quit = true
+	}
+}
+
+// handleInput プレイ中のキー入力を処理する
+func (g *Game) handleInput(r rune) {
+	if g.Paused || g.GameOver {
+		g.handleMenuInput(r)
+		return
+	}
+	switch r {
+	case 'w':
+		g.rotateShape()
+	case 'a':
+		g.moveShape(-1)
+	case 'd':
+		g.moveShape(1)
+	case 's':
+		g.dropShape()
+	case 'p', keyFocusOut:
+		// 対戦中は一時停止できない
+		if !g.Versus {
+			g.pause()
+		}
+	}
+}
+
+// drawMenu メニューを表示する
+func (g *Game) drawMenu(title string) {
+	fmt.Printf("\033[%d;%dH%s\n", g.Height+1, 0, title)
+	for i, item := range g.menuItems() {
+		if i == g.MenuIndex {
+			fmt.Printf(" > %s\n", item)
+		} else {
+			fmt.Printf("   %s\n", item)
+		}
+	}
+}
+
 func (g *Game) draw() {
 	clearScreen()
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			if g.Field[y][x] != 0 {
+
+	// 一時停止中はフィールドを隠してメニューだけを表示
+	if g.Paused {
+		for y := 0; y < g.Height; y++ {
+			for x := 0; x < g.Width; x++ {
+				fmt.Print(" ")
+			}
+			fmt.Println()
+		}
+		g.drawMenu("Paused")
+		return
+	}
+
+	now := time.Now()
+	field, lit := g.fieldView(now)
+	for y := 0; y < g.Height; y++ {
+		for x := 0; x < g.Width; x++ {
+			switch {
+			case lit[y]:
+				fmt.Print("=")
+			case field[y][x] != 0:
 				fmt.Print("#")
-			} else {
+			default:
 				fmt.Print(".")
 			}
 		}
@@ -195,66 +397,440 @@ func (g *Game) draw() {
 			}
 		}
 	}
+	g.drawBanners(now)
+	g.drawPanel()
+
+	if g.GameOver {
+		title := "Game Over!"
+		switch {
+		case g.Versus && g.Cleared:
+			title = "You Win!"
+		case g.Versus:
+			title = "You Lose!"
+		case g.Cleared:
+			title = "Complete!"
+		}
+		g.drawMenu(title)
+		if g.Message != "" {
+			fmt.Println(g.Message)
+		}
+		g.drawLeaderboard()
+		return
+	}
+
+	fmt.Printf("\033[%d;%dH", g.Height+1, 0)
+}
+
+// drawPanel フィールドの右側に次のテトリミノと成績を表示する
+func (g *Game) drawPanel() {
+	col := g.Width + 3
+	line := 1
+	printAt := func(format string, args ...interface{}) {
+		fmt.Printf("\033[%d;%dH", line, col)
+		fmt.Printf(format, args...)
+		line++
+	}
+
 	// 次のテトリミノを表示
-	fmt.Println("\nNext:")
-	for _, row := range g.NextShape { // yの代わりに空配列で代用
-		fmt.Print(" ")
+	printAt("Next:")
+	for _, row := range g.NextPiece.Rotations[0] {
+		s := " "
 		for _, cell := range row {
 			if cell != 0 {
-				fmt.Print("#")
+				s += "#"
 			} else {
-				fmt.Print(" ")
+				s += " "
 			}
 		}
-		fmt.Println()
+		printAt("%s", s)
 	}
+	line++
 
-	fmt.Printf("\033[%d;%dH", height+1, 0)
+	printAt("Mode:  %s", g.Mode.Name)
+	printAt("Level: %d", g.level())
+	if g.Mode.Lines > 0 {
+		printAt("Lines: %d/%d", g.Lines, g.Mode.Lines)
+	} else {
+		printAt("Lines: %d", g.Lines)
+	}
+	printAt("Score: %d", g.Score)
+	if g.Mode.TimeLimit > 0 {
+		printAt("Left:  %s", formatDuration(g.Mode.TimeLimit-g.Elapsed))
+	} else {
+		printAt("Time:  %s", formatDuration(g.Elapsed))
+	}
+	printAt("PPS:   %.2f", g.pps())
+
+	// 受け取る予定のお邪魔ブロックのメーター
+	if g.Versus {
+		line++
+		printAt("Garbage: %s", strings.Repeat("#", g.PendingGarbage))
+	}
 }
 
-func (g *Game) run() {
+func (g *Game) run(ctx context.Context) error {
+	t, err := tty.Open()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	errc := make(chan error, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
 	go func() {
-		tty, err := tty.Open()
-		if err != nil {
-			log.Fatal(err)
+		defer wg.Done()
+		if err := g.readInput(ctx, t); err != nil {
+			errc <- err
 		}
-		defer tty.Close()
+	}()
 
-		for {
-			r, err := tty.ReadRune()
-			if err != nil {
-				log.Fatal(err)
-			}
-			g.Input <- r
-		}
+	// フォーカスの変化をエスケープシーケンスで通知させる
+	fmt.Print("\033[?1004h")
+
+	// 終了時は入力の読み取りを止めてからターミナルを元に戻す
+	defer func() {
+		cancel()
+		wg.Wait()
+		fmt.Print("\033[?1004l")
+		t.Close()
 	}()
 
-	ticker := time.NewTicker(500 * time.Millisecond)
-	defer ticker.Stop()
+	defer g.ticker.Stop()
+	if g.Paused {
+		g.ticker.Stop()
+	} else {
+		g.ticker.Reset(g.interval())
+	}
+	g.lastUpdate = time.Now()
+	if g.bot != nil {
+		g.botTicker = time.NewTicker(botInterval)
+		defer g.botTicker.Stop()
+	}
+	g.frameTicker = time.NewTicker(frameInterval)
+	defer g.frameTicker.Stop()
+	g.draw()
 
-	for !g.GameOver {
+	for !g.Quit {
 		select {
-		case <-ticker.C:
-			g.dropShape()
-		case r := <-g.Input:
-			switch r {
-			case 'w':
-				g.rotateShape()
-			case 'a':
-				g.moveShape(-1)
-			case 'd':
-				g.moveShape(1)
-			case 's':
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errc:
+			return err
+		case <-g.ticker.C:
+			g.updateClock(time.Now())
+			if !g.Paused && !g.GameOver {
 				g.dropShape()
 			}
+		case r := <-g.Input:
+			g.updateClock(time.Now())
+			g.handleInput(r)
+		case m, ok := <-g.peerMessages():
+			g.updateClock(time.Now())
+			g.handlePeerMessage(m, ok)
+		case <-g.botTicks():
+			g.updateClock(time.Now())
+			g.botStep()
+		case now := <-g.frameTicks():
+			// 演出の再描画だけを行い、入力の処理は待たせない
+			g.updateClock(now)
+			g.pruneEffects(now)
+		}
+		g.checkGoal()
+		if !g.Quit {
+			g.draw()
+		}
+	}
+	return nil
+}
+
+// readInput ttyからキー入力を読み取ってInputへ送る。ctxがキャンセルされると終了する
+func (g *Game) readInput(ctx context.Context, t *tty.TTY) error {
+	for {
+		ok, err := waitInput(ctx, t)
+		if err != nil || !ok {
+			return err
+		}
+		r, err := t.ReadRune()
+		if err != nil {
+			return err
+		}
+		if r == '\033' {
+			r = readEscape(t)
+		}
+		select {
+		case g.Input <- r:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// waitInput 入力が届くかctxがキャンセルされるまで待つ
+func waitInput(ctx context.Context, t *tty.TTY) (bool, error) {
+	fds := []unix.PollFd{{Fd: int32(t.Input().Fd()), Events: unix.POLLIN}}
+	for {
+		if ctx.Err() != nil {
+			return false, nil
+		}
+		if t.Buffered() {
+			return true, nil
+		}
+		n, err := unix.Poll(fds, 100)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if n > 0 {
+			return true, nil
 		}
-		g.draw()
 	}
-	fmt.Println("Game Over!")
+}
+
+// readEscape ESCに続くシーケンスを読み取り、フォーカス通知なら特殊キーに変換する
+// ESCだけが押された場合は続きを待たずに（ブロックしてctxのキャンセルを妨げないように）ESCを返す
+func readEscape(t *tty.TTY) rune {
+	fds := []unix.PollFd{{Fd: int32(t.Input().Fd()), Events: unix.POLLIN}}
+	if !t.Buffered() {
+		if n, err := unix.Poll(fds, 30); err != nil || n == 0 {
+			return '\033'
+		}
+	}
+	r, err := t.ReadRune()
+	if err != nil || r != '[' {
+		return r
+	}
+	r, err = t.ReadRune()
+	if err != nil {
+		return r
+	}
+	switch r {
+	case 'I':
+		return keyFocusIn
+	case 'O':
+		return keyFocusOut
+	}
+	return r
+}
+
+// savedGame 中断したゲームの保存形式
+type savedGame struct {
+	Field     [][]int       `json:"field"`
+	Piece     Piece         `json:"piece"`
+	Rotation  int           `json:"rotation"`
+	NextPiece Piece         `json:"next_piece"`
+	PosX      int           `json:"pos_x"`
+	PosY      int           `json:"pos_y"`
+	Mode      string        `json:"mode"`
+	Lines     int           `json:"lines"`
+	Score     int           `json:"score"`
+	Pieces    int           `json:"pieces"`
+	Elapsed   time.Duration `json:"elapsed"`
+}
+
+// saveState ゲームの状態をファイルに保存する
+func (g *Game) saveState(path string) error {
+	data, err := json.Marshal(savedGame{
+		Field:     g.Field,
+		Piece:     g.Piece,
+		Rotation:  g.Rotation,
+		NextPiece: g.NextPiece,
+		PosX:      g.PosX,
+		PosY:      g.PosY,
+		Mode:      g.Mode.Name,
+		Lines:     g.Lines,
+		Score:     g.Score,
+		Pieces:    g.Pieces,
+		Elapsed:   g.Elapsed,
+	})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// loadState 保存されたゲームを読み込み、一時停止した状態で再開できるようにする
+// keepModeなら（-modeを指定して起動した場合）保存されたモードではなく今のモードで続ける
+// 壊れたファイルや書き換えられたファイルは状態を変えずにエラーを返す
+func (g *Game) loadState(path string, keepMode bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var saved savedGame
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	mode := g.Mode
+	if !keepMode {
+		if mode, err = findMode(saved.Mode); err != nil {
+			return err
+		}
+	}
+	if err := saved.validate(); err != nil {
+		return fmt.Errorf("%s: broken save data: %v", path, err)
+	}
+	g.Field = saved.Field
+	g.Height = len(saved.Field)
+	g.Width = len(saved.Field[0])
+	g.Piece = saved.Piece
+	g.Rotation = saved.Rotation
+	g.Shape = saved.Piece.Rotations[saved.Rotation]
+	g.NextPiece = saved.NextPiece
+	g.PosX = saved.PosX
+	g.PosY = saved.PosY
+	g.Mode = mode
+	g.Lines = saved.Lines
+	g.Score = saved.Score
+	g.Pieces = saved.Pieces
+	g.Elapsed = saved.Elapsed
+	g.Paused = true
+	return os.Remove(path)
+}
+
+// validate 保存されたフィールドの大きさ、ピースの形状と回転、位置がそのまま遊べるものか確認する
+func (s savedGame) validate() error {
+	height := len(s.Field)
+	if height < 4 || len(s.Field[0]) < 4 {
+		return errors.New("field is smaller than 4x4")
+	}
+	width := len(s.Field[0])
+	for y, row := range s.Field {
+		if len(row) != width {
+			return fmt.Errorf("row %d has %d cells, want %d", y, len(row), width)
+		}
+	}
+	for _, p := range []Piece{s.Piece, s.NextPiece} {
+		if len(p.Rotations) == 0 {
+			return fmt.Errorf("piece %q has no rotations", p.Name)
+		}
+		for _, shape := range p.Rotations {
+			if !validShape(shape, width, height) {
+				return fmt.Errorf("piece %q has an invalid shape", p.Name)
+			}
+		}
+	}
+	if s.Rotation < 0 || s.Rotation >= len(s.Piece.Rotations) {
+		return fmt.Errorf("rotation %d out of range", s.Rotation)
+	}
+	field := &Game{Width: width, Height: height, Field: s.Field}
+	if s.PosY < 0 || field.isCollision(s.Piece.Rotations[s.Rotation], s.PosX, s.PosY) {
+		return fmt.Errorf("piece position (%d, %d) is outside the field", s.PosX, s.PosY)
+	}
+	return nil
+}
+
+// validShape 形状が空でない長方形で、width×heightのフィールドに収まるか
+func validShape(shape [][]int, width, height int) bool {
+	if len(shape) == 0 || len(shape) > height || len(shape[0]) == 0 || len(shape[0]) > width {
+		return false
+	}
+	for _, row := range shape {
+		if len(row) != len(shape[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// modeFlagSet -modeが明示的に指定されたか
+func modeFlagSet() bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "mode" {
+			set = true
+		}
+	})
+	return set
 }
 
 func main() {
-	rand.Seed(time.Now().UnixNano())
-	game := NewGame()
-	game.run()
+	modeName := flag.String("mode", "endless", "game mode (endless, sprint, ultra, marathon)")
+	fieldWidth := flag.Int("width", defaultWidth, "field width")
+	fieldHeight := flag.Int("height", defaultHeight, "field height")
+	pieceSet := flag.String("pieces", "standard", "piece set (standard, tiny, pentomino) or path to a JSON piece set")
+	listenAddr := flag.String("listen", "", "wait for a versus opponent on this address (e.g. :7000)")
+	connectAddr := flag.String("connect", "", "connect to a versus opponent at this address (e.g. localhost:7000)")
+	demo := flag.Bool("ai", false, "let the AI play (demo mode)")
+	strategyName := flag.String("strategy", "lookahead", "AI strategy (lookahead, greedy)")
+	benchSeeds := flag.Int("bench", 0, "run a headless AI benchmark over seeds 1..N and exit")
+	benchPieces := flag.Int("bench-pieces", 1000, "maximum pieces per benchmark game")
+	flag.Parse()
+
+	mode, err := findMode(*modeName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pieces, err := loadPieceSet(*pieceSet)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg := Config{
+		Width:    *fieldWidth,
+		Height:   *fieldHeight,
+		PieceSet: pieces,
+		Mode:     mode,
+	}
+	if err := cfg.validate(); err != nil {
+		log.Fatal(err)
+	}
+	strategy, err := findStrategy(*strategyName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *benchSeeds > 0 {
+		seeds := make([]int64, *benchSeeds)
+		for i := range seeds {
+			seeds[i] = int64(i + 1)
+		}
+		printBenchmark(strategy, benchmark(cfg, strategy, seeds, *benchPieces))
+		return
+	}
+
+	// SIGINT/SIGTERMを受け取ったらゲームループを止める
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	game := NewGame(cfg)
+	switch {
+	case *listenAddr != "":
+		fmt.Printf("Waiting for an opponent on %s...\n", *listenAddr)
+		game.peer, err = listenPeer(*listenAddr)
+	case *connectAddr != "":
+		game.peer, err = dialPeer(*connectAddr)
+	case *demo:
+	default:
+		if err := game.loadState(saveFile, modeFlagSet()); err != nil && !os.IsNotExist(err) {
+			log.Println("failed to load saved game:", err)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if game.peer != nil {
+		game.Versus = true
+		defer game.peer.Close()
+	}
+	if *demo {
+		game.bot = &Bot{Strategy: strategy}
+	}
+
+	err = game.run(ctx)
+	if ctx.Err() != nil {
+		// シグナルで中断された場合は状態を保存して次回再開できるようにする
+		if game.GameOver || game.Versus || game.bot != nil {
+			return
+		}
+		if err := game.saveState(saveFile); err != nil {
+			log.Fatal("failed to save game: ", err)
+		}
+		fmt.Printf("\nゲームを%sに保存しました。\n", saveFile)
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// リーダーボードの保存先
+const leaderboardFile = "tetris_leaderboard.json"
+
+// リーダーボードに表示する件数
+const leaderboardSize = 5
+
+// 消去したライン数ごとの得点（レベル倍率をかける前）
+var lineScores = []int{0, 100, 300, 500, 800}
+
+// GameMode ゲームモードの勝利条件と制限時間
+type GameMode struct {
+	Name      string
+	Lines     int           // 目標ライン数（0なら無制限）
+	TimeLimit time.Duration // 制限時間（0なら無制限）
+	ByTime    bool          // trueならクリアタイム、falseならスコアで順位をつける
+}
+
+// 選択できるゲームモード
+var modes = []GameMode{
+	{Name: "endless"},
+	{Name: "sprint", Lines: 40, ByTime: true},
+	{Name: "ultra", TimeLimit: 2 * time.Minute},
+	{Name: "marathon", Lines: 150},
+}
+
+// findMode 名前からゲームモードを探す
+func findMode(name string) (GameMode, error) {
+	for _, m := range modes {
+		if m.Name == name {
+			return m, nil
+		}
+	}
+	return GameMode{}, fmt.Errorf("unknown mode: %s", name)
+}
+
+// ranked リーダーボードに記録するモードかどうか
+func (m GameMode) ranked() bool {
+	return m.Lines > 0 || m.TimeLimit > 0
+}
+
+// LeaderboardEntry リーダーボードの1件分の記録
+type LeaderboardEntry struct {
+	Mode     string        `json:"mode"`
+	Date     time.Time     `json:"date"`
+	Score    int           `json:"score"`
+	Lines    int           `json:"lines"`
+	Pieces   int           `json:"pieces"`
+	Duration time.Duration `json:"duration"`
+	PPS      float64       `json:"pps"` // 1秒あたりに置いたピース数
+}
+
+// loadLeaderboard リーダーボードをファイルから読み込む
+func loadLeaderboard(path string) ([]LeaderboardEntry, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []LeaderboardEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// saveLeaderboard リーダーボードをファイルに保存する
+func saveLeaderboard(path string, entries []LeaderboardEntry) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// topEntries 指定したモードの上位の記録を返す
+func topEntries(entries []LeaderboardEntry, mode GameMode, n int) []LeaderboardEntry {
+	var result []LeaderboardEntry
+	for _, e := range entries {
+		if e.Mode == mode.Name {
+			result = append(result, e)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if mode.ByTime {
+			return result[i].Duration < result[j].Duration
+		}
+		return result[i].Score > result[j].Score
+	})
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+// level 消去したライン数から現在のレベルを求める
+func (g *Game) level() int {
+	return g.Lines/10 + 1
+}
+
+// interval レベルに応じた落下の間隔
+func (g *Game) interval() time.Duration {
+	d := tickInterval - time.Duration(g.level()-1)*40*time.Millisecond
+	if d < 100*time.Millisecond {
+		d = 100 * time.Millisecond
+	}
+	return d
+}
+
+// pps 1秒あたりに置いたピース数
+func (g *Game) pps() float64 {
+	if g.Elapsed <= 0 {
+		return 0
+	}
+	return float64(g.Pieces) / g.Elapsed.Seconds()
+}
+
+// addLines 消去したライン数をスコアに反映する
+func (g *Game) addLines(n int) {
+	if n <= 0 {
+		return
+	}
+	if n >= len(lineScores) {
+		n = len(lineScores) - 1
+	}
+	level := g.level()
+	g.Score += lineScores[n] * level
+	g.Lines += n
+	g.ticker.Reset(g.interval())
+
+	if n == len(lineScores)-1 {
+		g.addBanner("TETRIS!")
+	}
+	if g.level() > level {
+		g.addBanner(fmt.Sprintf("LEVEL %d", g.level()))
+	}
+}
+
+// updateClock 経過時間を進める。一時停止中やゲーム終了後は進めない
+func (g *Game) updateClock(now time.Time) {
+	if !g.Paused && !g.GameOver {
+		g.Elapsed += now.Sub(g.lastUpdate)
+	}
+	g.lastUpdate = now
+}
+
+// checkGoal モードの勝利条件や制限時間を満たしたらゲームを終了する
+func (g *Game) checkGoal() {
+	if g.GameOver {
+		return
+	}
+	if g.Mode.Lines > 0 && g.Lines >= g.Mode.Lines {
+		g.Cleared = true
+	}
+	if g.Mode.TimeLimit > 0 && g.Elapsed >= g.Mode.TimeLimit {
+		g.Elapsed = g.Mode.TimeLimit
+		g.Cleared = true
+	}
+	if g.Cleared {
+		g.endGame()
+	}
+}
+
+// endGame ゲームを終了し、対象のモードなら結果をリーダーボードに記録する
+func (g *Game) endGame() {
+	if g.GameOver {
+		return
+	}
+	g.GameOver = true
+	g.MenuIndex = 0
+	g.ticker.Stop()
+
+	// 対戦中は負けたことを相手に知らせ、リーダーボードには記録しない
+	if g.Versus {
+		if g.peer != nil && !g.Cleared {
+			g.peer.Send(VersusMessage{Type: msgLose})
+		}
+		return
+	}
+
+	// ボットの結果やスプリントで40ラインを消しきれなかった結果は記録しない
+	if g.bot == nil && g.Mode.ranked() && (!g.Mode.ByTime || g.Cleared) {
+		if err := g.recordResult(leaderboardFile); err != nil {
+			g.Message = fmt.Sprintf("failed to save leaderboard: %v", err)
+		}
+	}
+	// ゲームオーバーの画面に表示するリーダーボードはここで一度だけ読み込む
+	g.leaderboard, g.leaderboardErr = loadLeaderboard(leaderboardFile)
+}
+
+// recordResult 今回の結果をリーダーボードに追加する
+func (g *Game) recordResult(path string) error {
+	entries, err := loadLeaderboard(path)
+	if err != nil {
+		return err
+	}
+	entries = append(entries, LeaderboardEntry{
+		Mode:     g.Mode.Name,
+		Date:     time.Now(),
+		Score:    g.Score,
+		Lines:    g.Lines,
+		Pieces:   g.Pieces,
+		Duration: g.Elapsed,
+		PPS:      g.pps(),
+	})
+	return saveLeaderboard(path, entries)
+}
+
+// formatDuration 経過時間を「分:秒.1/100秒」形式にする
+func formatDuration(d time.Duration) string {
+	cs := d.Milliseconds() / 10
+	return fmt.Sprintf("%d:%02d.%02d", cs/6000, cs/100%60, cs%100)
+}
+
+// drawLeaderboard ゲーム終了時に読み込んだ現在のモードのリーダーボードを表示する
+func (g *Game) drawLeaderboard() {
+	if g.leaderboardErr != nil {
+		fmt.Println("failed to load leaderboard:", g.leaderboardErr)
+		return
+	}
+	top := topEntries(g.leaderboard, g.Mode, leaderboardSize)
+	if len(top) == 0 {
+		return
+	}
+	fmt.Printf("\nLeaderboard (%s)\n", g.Mode.Name)
+	for i, e := range top {
+		fmt.Printf("%d. %s  score %d  lines %d  time %s  %.2f pps\n",
+			i+1, e.Date.Format("2006-01-02"), e.Score, e.Lines, formatDuration(e.Duration), e.PPS)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Piece ピースの名前と回転ごとの形状
+type Piece struct {
+	Name      string    `json:"name"`
+	Rotations [][][]int `json:"rotations"`
+}
+
+// pieceSetFile ピースセットのJSONファイルの形式
+type pieceSetFile struct {
+	Name   string  `json:"name"`
+	Pieces []Piece `json:"pieces"`
+}
+
+// 標準の7種類のテトリミノ
+var standardShapes = map[string][][]int{
+	"I": {
+		{1, 1, 1, 1},
+	},
+	"O": {
+		{1, 1},
+		{1, 1},
+	},
+	"T": {
+		{0, 1, 0},
+		{1, 1, 1},
+	},
+	"L": {
+		{1, 0, 0},
+		{1, 1, 1},
+	},
+	"J": {
+		{0, 0, 1},
+		{1, 1, 1},
+	},
+	"Z": {
+		{1, 1, 0},
+		{0, 1, 1},
+	},
+	"S": {
+		{0, 1, 1},
+		{1, 1, 0},
+	},
+}
+
+// 子ども向けの小さなピース
+var tinyShapes = map[string][][]int{
+	"I2": {
+		{1, 1},
+	},
+	"I3": {
+		{1, 1, 1},
+	},
+	"L3": {
+		{1, 0},
+		{1, 1},
+	},
+	"O": {
+		{1, 1},
+		{1, 1},
+	},
+}
+
+// 12種類のペントミノ
+var pentominoShapes = map[string][][]int{
+	"F": {
+		{0, 1, 1},
+		{1, 1, 0},
+		{0, 1, 0},
+	},
+	"I": {
+		{1, 1, 1, 1, 1},
+	},
+	"L": {
+		{1, 0, 0, 0},
+		{1, 1, 1, 1},
+	},
+	"N": {
+		{1, 1, 0, 0},
+		{0, 1, 1, 1},
+	},
+	"P": {
+		{1, 1},
+		{1, 1},
+		{1, 0},
+	},
+	"T": {
+		{1, 1, 1},
+		{0, 1, 0},
+		{0, 1, 0},
+	},
+	"U": {
+		{1, 0, 1},
+		{1, 1, 1},
+	},
+	"V": {
+		{1, 0, 0},
+		{1, 0, 0},
+		{1, 1, 1},
+	},
+	"W": {
+		{1, 0, 0},
+		{1, 1, 0},
+		{0, 1, 1},
+	},
+	"X": {
+		{0, 1, 0},
+		{1, 1, 1},
+		{0, 1, 0},
+	},
+	"Y": {
+		{0, 1, 0, 0},
+		{1, 1, 1, 1},
+	},
+	"Z": {
+		{1, 1, 0},
+		{0, 1, 0},
+		{0, 1, 1},
+	},
+}
+
+// 組み込みのピースセット（表示順を固定するため名前の順序も持つ）
+var builtinPieceSets = map[string]struct {
+	order  []string
+	shapes map[string][][]int
+}{
+	"standard":  {[]string{"I", "O", "T", "L", "J", "Z", "S"}, standardShapes},
+	"tiny":      {[]string{"I2", "I3", "L3", "O"}, tinyShapes},
+	"pentomino": {[]string{"F", "I", "L", "N", "P", "T", "U", "V", "W", "X", "Y", "Z"}, pentominoShapes},
+}
+
+// rotateCW 形状を時計回りに90度回転する
+func rotateCW(shape [][]int) [][]int {
+	rotated := make([][]int, len(shape[0]))
+	for i := range rotated {
+		rotated[i] = make([]int, len(shape))
+		for j := range rotated[i] {
+			rotated[i][j] = shape[len(shape)-j-1][i]
+		}
+	}
+	return rotated
+}
+
+// sameShape 2つの形状が同じかどうか
+func sameShape(a, b [][]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for y := range a {
+		if len(a[y]) != len(b[y]) {
+			return false
+		}
+		for x := range a[y] {
+			if a[y][x] != b[y][x] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// newPiece 基本形状から重複のない回転データを生成してピースを作る
+func newPiece(name string, shape [][]int) Piece {
+	p := Piece{Name: name, Rotations: [][][]int{shape}}
+	for r := rotateCW(shape); !sameShape(r, shape); r = rotateCW(r) {
+		p.Rotations = append(p.Rotations, r)
+	}
+	return p
+}
+
+// validate 回転データが空でなく、各形状が長方形になっているか確認する
+func (p Piece) validate() error {
+	if len(p.Rotations) == 0 {
+		return fmt.Errorf("piece %q has no shape", p.Name)
+	}
+	for _, shape := range p.Rotations {
+		if len(shape) == 0 || len(shape[0]) == 0 {
+			return fmt.Errorf("piece %q has an empty rotation", p.Name)
+		}
+		for _, row := range shape {
+			if len(row) != len(shape[0]) {
+				return fmt.Errorf("piece %q has a non-rectangular rotation", p.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// loadPieceSet 組み込みセットの名前、またはJSONファイルのパスからピースセットを読み込む
+// JSONで回転データが1つしか指定されていないピースは、回転データを自動で生成する
+func loadPieceSet(nameOrPath string) ([]Piece, error) {
+	if set, ok := builtinPieceSets[nameOrPath]; ok {
+		pieces := make([]Piece, 0, len(set.order))
+		for _, name := range set.order {
+			pieces = append(pieces, newPiece(name, set.shapes[name]))
+		}
+		return pieces, nil
+	}
+
+	data, err := os.ReadFile(nameOrPath)
+	if err != nil {
+		return nil, err
+	}
+	var file pieceSetFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	if len(file.Pieces) == 0 {
+		return nil, fmt.Errorf("%s: no pieces", nameOrPath)
+	}
+	for i, p := range file.Pieces {
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", nameOrPath, err)
+		}
+		if len(p.Rotations) == 1 {
+			file.Pieces[i] = newPiece(p.Name, p.Rotations[0])
+		}
+	}
+	return file.Pieces, nil
+}
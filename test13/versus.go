@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+)
+
+// 対戦相手とやり取りするメッセージの種類
+const (
+	msgGarbage = "garbage" // お邪魔ブロックを送る
+	msgLose    = "lose"    // ゲームオーバーになった
+)
+
+// 消去したライン数ごとに相手へ送るお邪魔ブロックの行数
+var garbageTable = []int{0, 0, 1, 2, 4}
+
+// VersusMessage 対戦相手とやり取りするメッセージ
+type VersusMessage struct {
+	Type  string `json:"type"`
+	Lines int    `json:"lines,omitempty"`
+}
+
+// Peer TCPでつながった対戦相手
+type Peer struct {
+	Messages chan VersusMessage // 相手から届いたメッセージ。切断されるとcloseされる
+
+	conn      net.Conn
+	enc       *json.Encoder
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// listenPeer 指定したアドレスで対戦相手の接続を1つだけ待ち受ける
+func listenPeer(addr string) (*Peer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newPeer(conn), nil
+}
+
+// dialPeer 待ち受けている対戦相手に接続する
+func dialPeer(addr string) (*Peer, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return newPeer(conn), nil
+}
+
+func newPeer(conn net.Conn) *Peer {
+	p := &Peer{
+		Messages: make(chan VersusMessage),
+		conn:     conn,
+		enc:      json.NewEncoder(conn),
+		done:     make(chan struct{}),
+	}
+	go p.readLoop()
+	return p
+}
+
+// readLoop 相手からのメッセージを読み取ってMessagesへ送る
+func (p *Peer) readLoop() {
+	defer close(p.Messages)
+	dec := json.NewDecoder(p.conn)
+	for {
+		var m VersusMessage
+		if err := dec.Decode(&m); err != nil {
+			return
+		}
+		select {
+		case p.Messages <- m:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// Send 相手にメッセージを送る
+func (p *Peer) Send(m VersusMessage) error {
+	return p.enc.Encode(m)
+}
+
+// Close 接続を閉じる
+func (p *Peer) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.done)
+		err = p.conn.Close()
+	})
+	return err
+}
+
+// peerMessages 対戦相手からのメッセージを受け取るチャネル。対戦していなければnilを返す
+func (g *Game) peerMessages() <-chan VersusMessage {
+	if g.peer == nil {
+		return nil
+	}
+	return g.peer.Messages
+}
+
+// handlePeerMessage 対戦相手から届いたメッセージを処理する
+func (g *Game) handlePeerMessage(m VersusMessage, ok bool) {
+	if !ok {
+		// 切断された場合は一人用として続ける（一時停止やゲームオーバー後の新しいゲームもできるようにする）
+		g.peer.Close()
+		g.peer = nil
+		g.Versus = false
+		g.PendingGarbage = 0
+		g.MenuIndex = 0
+		g.Message = "opponent disconnected"
+		return
+	}
+	switch m.Type {
+	case msgGarbage:
+		g.PendingGarbage += m.Lines
+	case msgLose:
+		if !g.GameOver {
+			g.Cleared = true
+			g.endGame()
+		}
+	}
+}
+
+// exchangeGarbage ライン消去の結果に応じてお邪魔ブロックを相殺・送信し、
+// ラインを消さなかった場合は溜まっているお邪魔ブロックをせり上げる
+func (g *Game) exchangeGarbage(lines int) {
+	if lines == 0 {
+		if g.PendingGarbage > 0 {
+			g.insertGarbage(g.PendingGarbage, g.rng.Intn(g.Width))
+			g.PendingGarbage = 0
+		}
+		return
+	}
+
+	if lines >= len(garbageTable) {
+		lines = len(garbageTable) - 1
+	}
+	attack := garbageTable[lines]
+
+	// 受け取る予定のお邪魔ブロックから先に相殺する
+	if attack <= g.PendingGarbage {
+		g.PendingGarbage -= attack
+		return
+	}
+	attack -= g.PendingGarbage
+	g.PendingGarbage = 0
+	if g.peer != nil {
+		g.peer.Send(VersusMessage{Type: msgGarbage, Lines: attack})
+	}
+}
+
+// insertGarbage gap列だけ穴の空いたお邪魔ブロックの行をn行、下からせり上げる
+func (g *Game) insertGarbage(n, gap int) {
+	if n > g.Height {
+		n = g.Height
+	}
+
+	// 押し出される行にブロックがあればゲームオーバー
+	topOut := false
+	for y := 0; y < n; y++ {
+		for _, cell := range g.Field[y] {
+			if cell != 0 {
+				topOut = true
+			}
+		}
+	}
+
+	newField := make([][]int, 0, g.Height)
+	newField = append(newField, g.Field[n:]...)
+	for i := 0; i < n; i++ {
+		row := make([]int, g.Width)
+		for x := range row {
+			if x != gap {
+				row[x] = 1
+			}
+		}
+		newField = append(newField, row)
+	}
+	g.Field = newField
+
+	// 落下中のピースが埋まった場合は上へ逃がす
+	for g.PosY > 0 && g.isCollision(g.Shape, g.PosX, g.PosY) {
+		g.PosY--
+	}
+	if topOut || g.isCollision(g.Shape, g.PosX, g.PosY) {
+		g.endGame()
+	}
+}
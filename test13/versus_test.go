@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// newVersusGame connに対戦相手がつながった、画面を使わないゲームを作る
+func newVersusGame(t *testing.T, conn net.Conn) *Game {
+	t.Helper()
+	pieces, err := loadPieceSet("standard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mode, err := findMode("endless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewGame(Config{Width: 10, Height: 20, PieceSet: pieces, Mode: mode, Seed: 1})
+	g.peer = newPeer(conn)
+	g.Versus = true
+	t.Cleanup(func() {
+		g.ticker.Stop()
+		if g.peer != nil {
+			g.peer.Close()
+		}
+	})
+	return g
+}
+
+// receive 相手から届いたメッセージを1つ処理する
+func receive(t *testing.T, g *Game) VersusMessage {
+	t.Helper()
+	select {
+	case m, ok := <-g.peerMessages():
+		g.handlePeerMessage(m, ok)
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message from the opponent")
+	}
+	return VersusMessage{}
+}
+
+// setPiece 落下中のピースを名前で指定したピースにする
+func setPiece(t *testing.T, g *Game, name string, x int) {
+	t.Helper()
+	for _, p := range g.PieceSet {
+		if p.Name == name {
+			g.Piece = p
+			g.Rotation = 0
+			g.Shape = p.Rotations[0]
+			g.PosX = x
+			g.PosY = 0
+			return
+		}
+	}
+	t.Fatalf("piece %q not found", name)
+}
+
+// hardDrop ピースが置かれるまで落とす
+func hardDrop(g *Game) {
+	for pieces := g.Pieces; g.Pieces == pieces && !g.GameOver; {
+		g.dropShape()
+	}
+}
+
+func TestVersusGarbageOverPipe(t *testing.T) {
+	a, b := net.Pipe()
+	ga := newVersusGame(t, a)
+	gb := newVersusGame(t, b)
+
+	// Aは左端の2列だけ空けた2行をOで埋めて2ライン消す → Bに1行送る
+	for _, y := range []int{18, 19} {
+		for x := 2; x < ga.Width; x++ {
+			ga.Field[y][x] = 1
+		}
+	}
+	setPiece(t, ga, "O", 0)
+	hardDrop(ga)
+	if ga.Lines != 2 {
+		t.Fatalf("A cleared %d lines, want 2", ga.Lines)
+	}
+	if m := receive(t, gb); m.Type != msgGarbage || m.Lines != 1 {
+		t.Fatalf("B received %+v, want 1 garbage line", m)
+	}
+	if gb.PendingGarbage != 1 {
+		t.Fatalf("B pending garbage = %d, want 1", gb.PendingGarbage)
+	}
+
+	// Bはラインを消さずにピースを置くので、穴が1つのお邪魔ブロックが1行せり上がる
+	setPiece(t, gb, "O", 0)
+	hardDrop(gb)
+	if gb.PendingGarbage != 0 {
+		t.Fatalf("B pending garbage = %d after placing a piece, want 0", gb.PendingGarbage)
+	}
+	holes := 0
+	for _, cell := range gb.Field[gb.Height-1] {
+		if cell == 0 {
+			holes++
+		}
+	}
+	if holes != 1 {
+		t.Fatalf("garbage row has %d holes, want 1", holes)
+	}
+
+	// Bの4ライン消去 → Aに4行
+	gb.exchangeGarbage(4)
+	if m := receive(t, ga); m.Type != msgGarbage || m.Lines != 4 {
+		t.Fatalf("A received %+v, want 4 garbage lines", m)
+	}
+	if ga.PendingGarbage != 4 {
+		t.Fatalf("A pending garbage = %d, want 4", ga.PendingGarbage)
+	}
+
+	// Bが負けるとAの勝ち
+	gb.endGame()
+	if m := receive(t, ga); m.Type != msgLose {
+		t.Fatalf("A received %+v, want lose", m)
+	}
+	if !ga.GameOver || !ga.Cleared {
+		t.Fatal("A should have won")
+	}
+}
+
+func TestVersusDisconnectFallsBackToSinglePlayer(t *testing.T) {
+	a, b := net.Pipe()
+	ga := newVersusGame(t, a)
+	gb := newVersusGame(t, b)
+	ga.PendingGarbage = 3
+
+	gb.peer.Close()
+	select {
+	case m, ok := <-ga.peerMessages():
+		if ok {
+			t.Fatalf("unexpected message %+v", m)
+		}
+		ga.handlePeerMessage(m, ok)
+	case <-time.After(2 * time.Second):
+		t.Fatal("disconnect was not noticed")
+	}
+
+	if ga.Versus || ga.peer != nil || ga.PendingGarbage != 0 {
+		t.Fatalf("still in versus mode: versus=%v peer=%v pending=%d", ga.Versus, ga.peer, ga.PendingGarbage)
+	}
+	ga.handleInput('p')
+	if !ga.Paused {
+		t.Fatal("cannot pause after the opponent disconnected")
+	}
+	ga.endGame()
+	if items := ga.menuItems(); len(items) != 2 || items[0] != menuNewGame {
+		t.Fatalf("game over menu = %v, want New Game and Quit", items)
+	}
+}
@@ -1,10 +1,29 @@
 package main
 
 import (
+	"flag"
+	"log"
 	"net/http"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
 )
 
 func main() {
-	http.Handle("/", http.FileServer(http.Dir("./")))
-	http.ListenAndServe(":8080", nil)
+	addr := flag.String("addr", ":8080", "address to listen on")
+	dbPath := flag.String("db", "../test27/rss.db", "path to the rss.db created by test27")
+	flag.Parse()
+
+	// 取得はtest27が行うので、読み取り専用で開く
+	db, err := gorm.Open(sqlite.Open("file:"+*dbPath+"?mode=ro&_busy_timeout=5000"), &gorm.Config{})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server, err := NewServer(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, server))
 }
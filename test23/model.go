@@ -0,0 +1,59 @@
+package main
+
+import "time"
+
+// test27が作るrss.dbのテーブルのうち、表示に使う列だけを読む（このプログラムからは書き込まない）
+
+// RssFeed フィード
+type RssFeed struct {
+	ID          uint
+	Title       string
+	Description string
+	Link        string
+	URL         string
+	LastFetched time.Time
+}
+
+// RssItem フィードのアイテム
+type RssItem struct {
+	ID         uint
+	FeedID     uint
+	Title      string
+	Link       string
+	Content    string // 概要
+	Body       string // 本文
+	Content2   string // 保存したページ
+	Published  time.Time
+	Updated    time.Time
+	FirstSeen  time.Time
+	ClusterID  uint              // 他のフィードに載った同じ記事のまとまり（0ならなし）
+	Authors    []RssItemAuthor   `gorm:"foreignKey:ItemID"`
+	Categories []RssItemCategory `gorm:"foreignKey:ItemID"`
+}
+
+// RssItemAuthor アイテムの著者
+type RssItemAuthor struct {
+	ID     uint
+	ItemID uint
+	Name   string
+	Email  string
+}
+
+// RssItemCategory アイテムのカテゴリ
+type RssItemCategory struct {
+	ID     uint
+	ItemID uint
+	Name   string
+}
+
+// Date アイテムの日付（公開日時、更新日時、初めて取得した時間の順）
+func (item RssItem) Date() time.Time {
+	switch {
+	case !item.Published.IsZero():
+		return item.Published
+	case !item.Updated.IsZero():
+		return item.Updated
+	default:
+		return item.FirstSeen
+	}
+}
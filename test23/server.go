@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"gorm.io/gorm"
+)
+
+// itemsPerPage アイテム一覧の1ページに表示する件数
+const itemsPerPage = 50
+
+//go:embed templates static
+var assets embed.FS
+
+// Server rss.dbを読んでフィードとアイテムを表示するHTTPハンドラ
+type Server struct {
+	db          *gorm.DB
+	pages       map[string]*template.Template
+	mux         *http.ServeMux
+	hasStates   bool // 既読の状態のテーブル（item_states）があるか
+	hasClusters bool // 同じ記事をまとめる列（rss_items.cluster_id）があるか
+}
+
+// ClusterPeer 同じ記事を載せた他のフィードのアイテム
+type ClusterPeer struct {
+	ID        uint
+	Title     string
+	Link      string
+	FeedTitle string
+}
+
+// FeedSummary フィード一覧の1行
+type FeedSummary struct {
+	ID          uint
+	Title       string
+	URL         string
+	Link        string
+	LastFetched time.Time
+	Items       int
+	Unread      int
+}
+
+// Pager アイテム一覧のページ送り
+type Pager struct {
+	Page, Pages, Total int
+}
+
+// Prev 前のページ（なければ0）
+func (p Pager) Prev() int {
+	if p.Page > 1 {
+		return p.Page - 1
+	}
+	return 0
+}
+
+// Next 次のページ（なければ0）
+func (p Pager) Next() int {
+	if p.Page < p.Pages {
+		return p.Page + 1
+	}
+	return 0
+}
+
+// NewServer テンプレートを読み込んでルーティングを設定する
+func NewServer(db *gorm.DB) (*Server, error) {
+	s := &Server{
+		db:          db,
+		pages:       map[string]*template.Template{},
+		mux:         http.NewServeMux(),
+		hasStates:   db.Migrator().HasTable("item_states"),
+		hasClusters: db.Migrator().HasColumn(&RssItem{}, "ClusterID"),
+	}
+
+	funcs := template.FuncMap{"date": formatDate}
+	for _, name := range []string{"feeds.html", "items.html", "item.html"} {
+		t, err := template.New(name).Funcs(funcs).ParseFS(assets, "templates/layout.html", "templates/"+name)
+		if err != nil {
+			return nil, err
+		}
+		s.pages[name] = t
+	}
+	static, err := fs.Sub(assets, "static")
+	if err != nil {
+		return nil, err
+	}
+
+	s.mux.Handle("GET /static/", http.StripPrefix("/static/", http.FileServer(http.FS(static))))
+	s.mux.HandleFunc("GET /{$}", s.handleFeeds)
+	s.mux.HandleFunc("GET /items", s.handleItems)
+	s.mux.HandleFunc("GET /feeds/{id}", s.handleItems)
+	s.mux.HandleFunc("GET /items/{id}", s.handleItem)
+	s.mux.HandleFunc("GET /items/{id}/archive", s.handleArchive)
+	return s, nil
+}
+
+// ServeHTTP リクエストを各ページのハンドラに振り分ける
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// render テンプレートを実行して返す。途中で失敗しても中途半端なページを返さないよう、一度バッファに書く
+func (s *Server) render(w http.ResponseWriter, name string, data interface{}) {
+	var buf bytes.Buffer
+	if err := s.pages[name].ExecuteTemplate(&buf, "layout", data); err != nil {
+		log.Printf("render %s: %v", name, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// serverError エラーをログに出して500を返す
+func serverError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+	http.Error(w, "internal server error", http.StatusInternalServerError)
+}
+
+// pathID パスの{id}を読む。数字でなければ0
+func pathID(r *http.Request) uint {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return uint(id)
+}
+
+// handleFeeds フィードの一覧（アイテム数と未読数つき）
+func (s *Server) handleFeeds(w http.ResponseWriter, r *http.Request) {
+	unread := "0"
+	join := ""
+	if s.hasStates {
+		unread = "SUM(CASE WHEN i.id IS NOT NULL AND COALESCE(st.read, 0) = 0 THEN 1 ELSE 0 END)"
+		join = "LEFT JOIN item_states st ON st.item_id = i.id"
+	}
+	var feeds []FeedSummary
+	err := s.db.Raw(`SELECT f.id, f.title, f.url, f.link, f.last_fetched, COUNT(i.id) AS items, ` + unread + ` AS unread
+		FROM rss_feeds f
+		LEFT JOIN rss_items i ON i.feed_id = f.id ` + join + `
+		GROUP BY f.id
+		ORDER BY LOWER(f.title), f.id`).Scan(&feeds).Error
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	s.render(w, "feeds.html", map[string]interface{}{"Feeds": feeds})
+}
+
+// handleItems アイテムの一覧を公開日時の新しい順にページ送りで表示する。/feeds/{id}ならそのフィードのアイテムだけ
+func (s *Server) handleItems(w http.ResponseWriter, r *http.Request) {
+	var feed *RssFeed
+	q := s.db.Model(&RssItem{})
+	if r.PathValue("id") != "" {
+		var f RssFeed
+		res := s.db.Where("id = ?", pathID(r)).Limit(1).Find(&f)
+		if res.Error != nil {
+			serverError(w, r, res.Error)
+			return
+		}
+		if res.RowsAffected == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		feed = &f
+		q = q.Where("feed_id = ?", f.ID)
+	}
+
+	var total int64
+	if err := q.Count(&total).Error; err != nil {
+		serverError(w, r, err)
+		return
+	}
+	pager := Pager{Page: 1, Total: int(total), Pages: (int(total) + itemsPerPage - 1) / itemsPerPage}
+	if p, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && p > 1 {
+		pager.Page = p
+	}
+
+	// 一覧には本文と保存したページは要らないので読まない
+	var items []RssItem
+	err := q.Select("id", "feed_id", "title", "link", "published", "updated", "first_seen").
+		Order("published desc, first_seen desc, id desc").
+		Offset((pager.Page - 1) * itemsPerPage).Limit(itemsPerPage).Find(&items).Error
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	// すべてのアイテムを表示するときはフィード名も出す
+	feedTitles := map[uint]string{}
+	if feed == nil {
+		var feeds []RssFeed
+		if err := s.db.Select("id", "title").Find(&feeds).Error; err != nil {
+			serverError(w, r, err)
+			return
+		}
+		for _, f := range feeds {
+			feedTitles[f.ID] = f.Title
+		}
+	}
+
+	s.render(w, "items.html", map[string]interface{}{
+		"Feed":       feed,
+		"Items":      items,
+		"FeedTitles": feedTitles,
+		"Pager":      pager,
+		"Path":       r.URL.Path,
+	})
+}
+
+// findItem パスの{id}のアイテムを読む。見つからなければ404を返してnil
+func (s *Server) findItem(w http.ResponseWriter, r *http.Request, q *gorm.DB) *RssItem {
+	var item RssItem
+	res := q.Where("id = ?", pathID(r)).Limit(1).Find(&item)
+	if res.Error != nil {
+		serverError(w, r, res.Error)
+		return nil
+	}
+	if res.RowsAffected == 0 {
+		http.NotFound(w, r)
+		return nil
+	}
+	return &item
+}
+
+// handleItem アイテムのページ。保存したページはサンドボックスにしたiframeで表示する
+func (s *Server) handleItem(w http.ResponseWriter, r *http.Request) {
+	q := s.db.Preload("Authors").Preload("Categories")
+	if !s.hasClusters {
+		q = q.Omit("cluster_id")
+	}
+	item := s.findItem(w, r, q)
+	if item == nil {
+		return
+	}
+	var feed RssFeed
+	if err := s.db.Where("id = ?", item.FeedID).Limit(1).Find(&feed).Error; err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	var peers []ClusterPeer
+	if item.ClusterID != 0 {
+		err := s.db.Raw(`SELECT i.id, i.title, i.link, f.title AS feed_title
+			FROM rss_items i JOIN rss_feeds f ON f.id = i.feed_id
+			WHERE i.cluster_id = ? AND i.id <> ?
+			ORDER BY i.id`, item.ClusterID, item.ID).Scan(&peers).Error
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+
+	body := item.Body
+	if body == "" {
+		body = item.Content
+	}
+	s.render(w, "item.html", map[string]interface{}{
+		"Item":       item,
+		"Feed":       feed,
+		"Peers":      peers,
+		"Text":       htmlToText(body),
+		"HasArchive": item.Content2 != "",
+	})
+}
+
+// handleArchive 保存したページをそのまま返す
+// 他のサイトのHTMLなので、直接開かれてもスクリプトが動かないようCSPでサンドボックスにする
+func (s *Server) handleArchive(w http.ResponseWriter, r *http.Request) {
+	item := s.findItem(w, r, s.db.Select("id", "content2"))
+	if item == nil {
+		return
+	}
+	if item.Content2 == "" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(item.Content2))
+}
+
+var blankLines = regexp.MustCompile(`\n\s*\n\s*`)
+
+// htmlToText フィードの本文のHTMLを段落を残したプレーンテキストにする（フィードのHTMLはそのまま表示しない）
+func htmlToText(s string) string {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(s))
+	if err != nil {
+		return s
+	}
+	doc.Find("script, style, noscript, template, iframe").Remove()
+	doc.Find("br").ReplaceWithHtml("\n")
+	doc.Find("p, div, li, tr, blockquote, pre, h1, h2, h3, h4, h5, h6").AfterHtml("\n\n")
+	return strings.TrimSpace(blankLines.ReplaceAllString(doc.Text(), "\n\n"))
+}
+
+// formatDate 日時を表示用に整える。ゼロ値なら"-"
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
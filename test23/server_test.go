@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// archiveHTML テスト用の保存したページ
+const archiveHTML = `<html><body><script>alert(1)</script><p>archived page</p></body></html>`
+
+// testIDs シードしたフィードとアイテムのID
+type testIDs struct {
+	alpha, beta        uint // フィード
+	withArchive, plain uint // Betaのアイテム
+}
+
+// newTestServer 一時ディレクトリのrss.dbにフィードとアイテムを入れ、main と同じように読み取り専用で開いたサーバを返す
+// Alphaには61件（うち10件既読）、Betaには保存したページのあるアイテムとないアイテムが1件ずつある
+func newTestServer(t *testing.T) (*Server, testIDs) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rss.db")
+	config := &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)}
+	db, err := gorm.Open(sqlite.Open(path), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&RssFeed{}, &RssItem{}, &RssItemAuthor{}, &RssItemCategory{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("CREATE TABLE item_states (item_id integer PRIMARY KEY, read numeric)").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var ids testIDs
+	alpha := RssFeed{Title: "Alpha", URL: "https://alpha.example.com/feed.xml", LastFetched: time.Now()}
+	beta := RssFeed{Title: "Beta", URL: "https://beta.example.com/feed.xml", Link: "https://beta.example.com/"}
+	for _, f := range []*RssFeed{&alpha, &beta} {
+		if err := db.Create(f).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids.alpha, ids.beta = alpha.ID, beta.ID
+
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 1; i <= 61; i++ {
+		item := RssItem{FeedID: alpha.ID, Title: fmt.Sprintf("Alpha %02d", i), Link: fmt.Sprintf("https://alpha.example.com/%d", i),
+			Published: base.Add(time.Duration(i) * time.Hour)}
+		if i == 61 {
+			// 一番新しいアイテムはBetaに入れる
+			item.FeedID, item.Title = beta.ID, "Beta plain"
+		}
+		if err := db.Create(&item).Error; err != nil {
+			t.Fatal(err)
+		}
+		if i <= 10 {
+			if err := db.Exec("INSERT INTO item_states (item_id, read) VALUES (?, 1)", item.ID).Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+		if i == 61 {
+			ids.plain = item.ID
+		}
+	}
+	archived := RssItem{FeedID: beta.ID, Title: "Beta archived", Link: "https://beta.example.com/post",
+		Body: `<p>First paragraph</p><script>alert(1)</script><p>Second paragraph</p>`, Content2: archiveHTML,
+		FirstSeen:  base,
+		Authors:    []RssItemAuthor{{Name: "Alice"}},
+		Categories: []RssItemCategory{{Name: "golang"}}}
+	if err := db.Create(&archived).Error; err != nil {
+		t.Fatal(err)
+	}
+	ids.withArchive = archived.ID
+	if sqlDB, err := db.DB(); err == nil {
+		sqlDB.Close()
+	}
+
+	ro, err := gorm.Open(sqlite.Open("file:"+path+"?mode=ro&_busy_timeout=5000"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := ro.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	s, err := NewServer(ro)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, ids
+}
+
+// get サーバにGETリクエストを送ってレスポンスを返す
+func get(s *Server, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w
+}
+
+// itemLinks 一覧に並んだアイテムへのリンクの数
+func itemLinks(body string) int {
+	return strings.Count(body, `<li>
+    <a href="/items/`)
+}
+
+func TestFeedsPage(t *testing.T) {
+	s, ids := newTestServer(t)
+	w := get(s, "/")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, fmt.Sprintf(`<a href="/feeds/%d">Alpha</a>`, ids.alpha)) ||
+		!strings.Contains(body, fmt.Sprintf(`<a href="/feeds/%d">Beta</a>`, ids.beta)) {
+		t.Fatalf("feeds are not listed:\n%s", body)
+	}
+	// Alphaは60件中10件が既読、Betaは2件とも未読
+	for _, want := range []string{"<strong>50</strong>", `<td class="num">60</td>`, "<strong>2</strong>", `<td class="num">2</td>`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %s in:\n%s", want, body)
+		}
+	}
+	if strings.Index(body, "Alpha") > strings.Index(body, "Beta") {
+		t.Error("feeds are not sorted by title")
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type = %q", got)
+	}
+}
+
+func TestItemsPages(t *testing.T) {
+	s, _ := newTestServer(t)
+	for _, tc := range []struct {
+		path  string
+		items int
+		first string // 最初に表示されるアイテム
+	}{
+		{"/items", 50, "Beta plain"},
+		{"/items?page=1", 50, "Beta plain"},
+		{"/items?page=2", 12, "Alpha 11"},
+		{"/items?page=3", 0, ""},
+		{"/items?page=abc", 50, "Beta plain"},
+	} {
+		w := get(s, tc.path)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d", tc.path, w.Code)
+		}
+		body := w.Body.String()
+		if !strings.Contains(body, "62 件") {
+			t.Errorf("%s: total count is missing", tc.path)
+		}
+		if got := itemLinks(body); got != tc.items {
+			t.Errorf("%s: %d items, want %d", tc.path, got, tc.items)
+		}
+		if tc.first != "" {
+			i := strings.Index(body, `<a href="/items/`)
+			if i < 0 || !strings.HasPrefix(body[strings.Index(body[i:], ">")+i+1:], tc.first) {
+				t.Errorf("%s: first item is not %q", tc.path, tc.first)
+			}
+		}
+	}
+	// 公開日時のないアイテムは最後に並ぶ
+	if body := get(s, "/items?page=2").Body.String(); !strings.Contains(body, "Beta archived") {
+		t.Error("item without a publish date is not on the last page")
+	}
+}
+
+func TestFeedItems(t *testing.T) {
+	s, ids := newTestServer(t)
+	w := get(s, fmt.Sprintf("/feeds/%d?page=2", ids.alpha))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "<h1>Alpha</h1>") || !strings.Contains(body, "60 件") {
+		t.Fatalf("not the Alpha feed page:\n%s", body)
+	}
+	if got := itemLinks(body); got != 10 {
+		t.Errorf("page 2 has %d items, want 10", got)
+	}
+	if strings.Contains(body, "Beta") {
+		t.Error("items of another feed are listed")
+	}
+
+	for _, path := range []string{"/feeds/999", "/feeds/abc"} {
+		if w := get(s, path); w.Code != http.StatusNotFound {
+			t.Errorf("%s: status = %d, want 404", path, w.Code)
+		}
+	}
+}
+
+func TestItemPage(t *testing.T) {
+	s, ids := newTestServer(t)
+	w := get(s, fmt.Sprintf("/items/%d", ids.withArchive))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		"<h1>Beta archived</h1>",
+		fmt.Sprintf(`<a href="/feeds/%d">Beta</a>`, ids.beta),
+		"Alice",
+		"<span>golang</span>",
+		"First paragraph\n\nSecond paragraph",
+		fmt.Sprintf(`<iframe class="archive" src="/items/%d/archive" sandbox`, ids.withArchive),
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "alert(1)") {
+		t.Error("the feed's script is shown")
+	}
+
+	if body := get(s, fmt.Sprintf("/items/%d", ids.plain)).Body.String(); strings.Contains(body, "<iframe") {
+		t.Error("iframe is shown for an item without an archive")
+	}
+	if w := get(s, "/items/999"); w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", w.Code)
+	}
+}
+
+func TestArchiveIsSandboxed(t *testing.T) {
+	s, ids := newTestServer(t)
+	w := get(s, fmt.Sprintf("/items/%d/archive", ids.withArchive))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	if got := w.Header().Get("Content-Security-Policy"); got != "sandbox" {
+		t.Errorf("Content-Security-Policy = %q, want sandbox", got)
+	}
+	if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("X-Content-Type-Options = %q, want nosniff", got)
+	}
+	if w.Body.String() != archiveHTML {
+		t.Errorf("body = %q", w.Body.String())
+	}
+
+	for _, path := range []string{fmt.Sprintf("/items/%d/archive", ids.plain), "/items/999/archive"} {
+		if w := get(s, path); w.Code != http.StatusNotFound {
+			t.Errorf("%s: status = %d, want 404", path, w.Code)
+		}
+	}
+}
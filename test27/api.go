@@ -0,0 +1,703 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// APIの一覧で1回に返すアイテムの既定の件数と上限
+const (
+	defaultAPILimit = 50
+	maxAPILimit     = 200
+)
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// APIFeed APIで返す購読フィード
+type APIFeed struct {
+	ID             uint       `json:"id"`
+	URL            string     `json:"url"`
+	Title          string     `json:"title"`
+	Category       string     `json:"category"`
+	Enabled        bool       `json:"enabled"`
+	FetchInterval  string     `json:"fetch_interval,omitempty"`
+	FeedID         uint       `json:"feed_id,omitempty"` // 取得済みならrss_feedsのID（アイテムの絞り込みに使う）
+	LastFetched    *time.Time `json:"last_fetched,omitempty"`
+	Failures       int        `json:"failures"`
+	DisabledReason string     `json:"disabled_reason,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// APIItem APIで返すアイテム。本文（Body）は1件取得したときだけ返す
+type APIItem struct {
+	ID         uint           `json:"id"`
+	FeedID     uint           `json:"feed_id"`
+	GUID       string         `json:"guid,omitempty"`
+	Title      string         `json:"title"`
+	Link       string         `json:"link"`
+	Content    string         `json:"content,omitempty"`
+	Body       string         `json:"body,omitempty"`
+	Published  *time.Time     `json:"published,omitempty"`
+	Updated    *time.Time     `json:"updated,omitempty"`
+	FirstSeen  time.Time      `json:"first_seen"`
+	ImageURL   string         `json:"image_url,omitempty"`
+	Authors    []APIAuthor    `json:"authors"`
+	Categories []string       `json:"categories"`
+	Enclosures []APIEnclosure `json:"enclosures"`
+	Tags       []string       `json:"tags"`
+	Read       bool           `json:"read"`
+	Starred    bool           `json:"starred"`
+	Archived   bool           `json:"archived"`
+	HasArchive bool           `json:"has_archive"` // 保存したページがあるか（GET /api/archive?url=リンク で読める）
+}
+
+// APIAuthor アイテムの著者
+type APIAuthor struct {
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email,omitempty"`
+}
+
+// APIEnclosure アイテムの添付ファイル
+type APIEnclosure struct {
+	URL    string `json:"url"`
+	Length int64  `json:"length,omitempty"`
+	Type   string `json:"type,omitempty"`
+}
+
+// APIItemList アイテムの一覧。続きがあればnext_cursorをcursorに指定して次を取得する
+type APIItemList struct {
+	Items      []APIItem `json:"items"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// HTMLContent test25-2がhtml_contents.dbに保存したページ（URLごとに1件）
+type HTMLContent struct {
+	ID      uint   `gorm:"primaryKey"`
+	URL     string `gorm:"unique"`
+	Content string `gorm:"type:text"`
+}
+
+// APIServer 購読とアイテムを操作するJSON APIのハンドラ
+type APIServer struct {
+	db    *gorm.DB
+	pages *gorm.DB // HTMLContentを読むhtml_contents.db（なければnil）
+	mux   *http.ServeMux
+}
+
+// NewAPIServer ルーティングを設定したAPIのハンドラを作る
+// pagesはHTMLContentのテーブルがあるDB。nilなら保存したページはアイテムのContent2だけから探す
+func NewAPIServer(db, pages *gorm.DB) *APIServer {
+	s := &APIServer{db: db, pages: pages, mux: http.NewServeMux()}
+	s.mux.HandleFunc("GET /api/openapi.json", s.handleOpenAPI)
+	s.mux.HandleFunc("GET /api/feeds", s.handleListFeeds)
+	s.mux.HandleFunc("POST /api/feeds", s.handleAddFeed)
+	s.mux.HandleFunc("DELETE /api/feeds/{id}", s.handleRemoveFeed)
+	s.mux.HandleFunc("GET /api/items", s.handleListItems)
+	s.mux.HandleFunc("GET /api/items/{id}", s.handleGetItem)
+	s.mux.HandleFunc("PATCH /api/items/{id}", s.handlePatchItem)
+	s.mux.HandleFunc("GET /api/archive", s.handleArchive)
+	s.mux.HandleFunc("GET /api/output/{format}", s.handleOutput)
+	return s
+}
+
+// ServeHTTP リクエストを各エンドポイントのハンドラに振り分ける
+func (s *APIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// writeJSON 値をJSONにして返す
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("api: write response: %v", err)
+	}
+}
+
+// writeAPIError {"error": "..."} の形でエラーを返す
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// writeServerError 想定外のエラーをログに出して500を返す（詳細は返さない）
+func writeServerError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("api: %s %s: %v", r.Method, r.URL.Path, err)
+	writeAPIError(w, http.StatusInternalServerError, "internal server error")
+}
+
+// decodeJSON リクエストの本文をJSONとして読む。知らないフィールドがあればエラーにする
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid JSON body: %v", err)
+	}
+	return nil
+}
+
+// apiPathID パスの{id}を読む
+func apiPathID(r *http.Request) (uint, error) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil || id == 0 {
+		return 0, fmt.Errorf("invalid id: %s", r.PathValue("id"))
+	}
+	return uint(id), nil
+}
+
+// parseAPITime RFC 3339の日時かYYYY-MM-DD（ローカル時間の0時）を読む
+func parseAPITime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, time.Local)
+}
+
+// handleOpenAPI APIの仕様（OpenAPI 3.0）を返す
+func (s *APIServer) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(openAPIDocument)
+}
+
+// newAPIFeed 購読と取得済みのフィードからAPIで返す形にする
+func newAPIFeed(sub Subscription, feed *RssFeed) APIFeed {
+	f := APIFeed{
+		ID:             sub.ID,
+		URL:            sub.URL,
+		Title:          sub.Title,
+		Category:       sub.Category,
+		Enabled:        sub.Enabled,
+		Failures:       sub.Failures,
+		DisabledReason: sub.DisabledReason,
+		CreatedAt:      sub.CreatedAt,
+	}
+	if sub.FetchInterval > 0 {
+		f.FetchInterval = sub.FetchInterval.String()
+	}
+	if feed != nil {
+		f.FeedID = feed.ID
+		if f.Title == "" {
+			f.Title = feed.Title
+		}
+		if !feed.LastFetched.IsZero() {
+			lastFetched := feed.LastFetched
+			f.LastFetched = &lastFetched
+		}
+	}
+	return f
+}
+
+// handleListFeeds 購読の一覧
+func (s *APIServer) handleListFeeds(w http.ResponseWriter, r *http.Request) {
+	var subs []Subscription
+	if err := s.db.Order("category, url").Find(&subs).Error; err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	var feeds []RssFeed
+	if err := s.db.Select("id", "url", "title", "last_fetched").Find(&feeds).Error; err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	byURL := map[string]*RssFeed{}
+	for i := range feeds {
+		byURL[feeds[i].URL] = &feeds[i]
+	}
+
+	list := make([]APIFeed, len(subs))
+	for i, sub := range subs {
+		list[i] = newAPIFeed(sub, byURL[sub.URL])
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleAddFeed 購読を追加する。すでにあれば409
+func (s *APIServer) handleAddFeed(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		URL           string `json:"url"`
+		Title         string `json:"title"`
+		Category      string `json:"category"`
+		FetchInterval string `json:"fetch_interval"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	u, err := url.Parse(strings.TrimSpace(req.URL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		writeAPIError(w, http.StatusBadRequest, "url must be an absolute http or https URL")
+		return
+	}
+	sub := Subscription{URL: u.String(), Title: req.Title, Category: req.Category, Enabled: true}
+	if req.FetchInterval != "" {
+		sub.FetchInterval, err = time.ParseDuration(req.FetchInterval)
+		if err != nil || sub.FetchInterval < 0 {
+			writeAPIError(w, http.StatusBadRequest, "invalid fetch_interval: "+req.FetchInterval)
+			return
+		}
+	}
+
+	var count int64
+	if err := s.db.Model(&Subscription{}).Where("url = ?", sub.URL).Count(&count).Error; err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	if count > 0 {
+		writeAPIError(w, http.StatusConflict, "subscription already exists: "+sub.URL)
+		return
+	}
+	if err := s.db.Create(&sub).Error; err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newAPIFeed(sub, nil))
+}
+
+// handleRemoveFeed 購読を削除する。removeコマンドと同じく、取得済みのフィードとアイテムは残す
+func (s *APIServer) handleRemoveFeed(w http.ResponseWriter, r *http.Request) {
+	id, err := apiPathID(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	res := s.db.Delete(&Subscription{}, id)
+	if res.Error != nil {
+		writeServerError(w, r, res.Error)
+		return
+	}
+	if res.RowsAffected == 0 {
+		writeAPIError(w, http.StatusNotFound, "feed not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// newAPIItem アイテムをAPIで返す形にする
+func newAPIItem(item RssItem, hasArchive bool) APIItem {
+	a := APIItem{
+		ID:         item.ID,
+		FeedID:     item.FeedID,
+		GUID:       item.GUID,
+		Title:      item.Title,
+		Link:       item.Link,
+		Content:    item.Content,
+		Body:       item.Body,
+		FirstSeen:  item.FirstSeen,
+		ImageURL:   item.ImageURL,
+		Authors:    []APIAuthor{},
+		Categories: []string{},
+		Enclosures: []APIEnclosure{},
+		Tags:       []string{},
+		HasArchive: hasArchive,
+	}
+	if !item.Published.IsZero() {
+		a.Published = &item.Published
+	}
+	if !item.Updated.IsZero() {
+		a.Updated = &item.Updated
+	}
+	for _, p := range item.Authors {
+		a.Authors = append(a.Authors, APIAuthor{Name: p.Name, Email: p.Email})
+	}
+	for _, c := range item.Categories {
+		a.Categories = append(a.Categories, c.Name)
+	}
+	for _, e := range item.Enclosures {
+		a.Enclosures = append(a.Enclosures, APIEnclosure{URL: e.URL, Length: e.Length, Type: e.Type})
+	}
+	for _, t := range item.Tags {
+		a.Tags = append(a.Tags, t.Name)
+	}
+	if item.State != nil {
+		a.Read = item.State.Read
+		a.Starred = item.State.Starred
+		a.Archived = item.State.Archived
+	}
+	return a
+}
+
+// itemQuery 一覧と1件の取得で共通のクエリ（保存したページは大きいので読まない）
+func (s *APIServer) itemQuery() *gorm.DB {
+	return s.db.Omit("content2").
+		Preload("Authors").Preload("Categories").Preload("Enclosures").Preload("State").Preload("Tags")
+}
+
+// archivedItemIDs itemsのうち保存したページ（リンクのHTMLContentかContent2）があるアイテムのID
+func (s *APIServer) archivedItemIDs(items []RssItem) (map[uint]bool, error) {
+	m := map[uint]bool{}
+	if len(items) == 0 {
+		return m, nil
+	}
+	ids := make([]uint, len(items))
+	byLink := map[string][]uint{}
+	var links []string
+	for i, item := range items {
+		ids[i] = item.ID
+		if item.Link != "" {
+			byLink[item.Link] = append(byLink[item.Link], item.ID)
+			links = append(links, item.Link)
+		}
+	}
+
+	var archived []uint
+	if err := s.db.Model(&RssItem{}).Where("id IN ? AND content2 <> ''", ids).Pluck("id", &archived).Error; err != nil {
+		return nil, err
+	}
+	for _, id := range archived {
+		m[id] = true
+	}
+	if s.pages != nil && len(links) > 0 {
+		var saved []string
+		if err := s.pages.Model(&HTMLContent{}).Where("url IN ?", links).Pluck("url", &saved).Error; err != nil {
+			return nil, err
+		}
+		for _, u := range saved {
+			for _, id := range byLink[u] {
+				m[id] = true
+			}
+		}
+	}
+	return m, nil
+}
+
+// handleListItems アイテムの一覧を新しく取得した順（IDの降順）に返す
+// 絞り込み: feed_id, since, until（公開日時。なければ初めて取得した時間）, unread, starred
+// ページ送り: limit と、前の応答のnext_cursorを指定するcursor
+func (s *APIServer) handleListItems(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := s.itemQuery().Omit("content2", "body")
+
+	limit := defaultAPILimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAPILimit {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxAPILimit))
+			return
+		}
+		limit = n
+	}
+	if v := query.Get("cursor"); v != "" {
+		cursor, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+		q = q.Where("id < ?", cursor)
+	}
+	if v := query.Get("feed_id"); v != "" {
+		feedID, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid feed_id")
+			return
+		}
+		q = q.Where("feed_id = ?", feedID)
+	}
+
+	// 公開日時がなければ初めて取得した時間で絞り込む（タイムゾーンが混在するのでjuliandayで比べる）
+	date := "julianday(CASE WHEN published = ? THEN first_seen ELSE published END)"
+	for _, d := range []struct{ name, op string }{{"since", ">="}, {"until", "<"}} {
+		v := query.Get(d.name)
+		if v == "" {
+			continue
+		}
+		t, err := parseAPITime(v)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s (use RFC 3339 or YYYY-MM-DD): %s", d.name, v))
+			return
+		}
+		q = q.Where(date+" "+d.op+" julianday(?)", time.Time{}, t)
+	}
+
+	filter := ItemFilter{}
+	for _, b := range []struct {
+		name string
+		dst  *bool
+	}{{"unread", &filter.Unread}, {"starred", &filter.Starred}} {
+		v := query.Get(b.name)
+		if v == "" {
+			continue
+		}
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s: %s", b.name, v))
+			return
+		}
+		*b.dst = on
+	}
+	q = filter.apply(s.db, q, false)
+
+	// 1件多く読んで続きがあるかどうかを調べる
+	var items []RssItem
+	if err := q.Order("id desc").Limit(limit + 1).Find(&items).Error; err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	list := APIItemList{Items: []APIItem{}}
+	if len(items) > limit {
+		items = items[:limit]
+		list.NextCursor = strconv.FormatUint(uint64(items[limit-1].ID), 10)
+	}
+
+	archived, err := s.archivedItemIDs(items)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	for _, item := range items {
+		list.Items = append(list.Items, newAPIItem(item, archived[item.ID]))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// findAPIItem IDのアイテムを本文つきで読む。見つからなければnil
+func (s *APIServer) findAPIItem(id uint) (*APIItem, error) {
+	var item RssItem
+	res := s.itemQuery().Where("id = ?", id).Limit(1).Find(&item)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return nil, res.Error
+	}
+	archived, err := s.archivedItemIDs([]RssItem{item})
+	if err != nil {
+		return nil, err
+	}
+	a := newAPIItem(item, archived[id])
+	return &a, nil
+}
+
+// handleGetItem アイテムを1件、本文つきで返す
+func (s *APIServer) handleGetItem(w http.ResponseWriter, r *http.Request) {
+	id, err := apiPathID(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	item, err := s.findAPIItem(id)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	if item == nil {
+		writeAPIError(w, http.StatusNotFound, "item not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, item)
+}
+
+// handlePatchItem アイテムの既読・スターを変更して、変更後のアイテムを返す
+func (s *APIServer) handlePatchItem(w http.ResponseWriter, r *http.Request) {
+	id, err := apiPathID(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var req struct {
+		Read    *bool `json:"read"`
+		Starred *bool `json:"starred"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Read == nil && req.Starred == nil {
+		writeAPIError(w, http.StatusBadRequest, "specify read and/or starred")
+		return
+	}
+
+	var count int64
+	if err := s.db.Model(&RssItem{}).Where("id = ?", id).Count(&count).Error; err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	if count == 0 {
+		writeAPIError(w, http.StatusNotFound, "item not found")
+		return
+	}
+
+	items := s.db.Model(&RssItem{}).Select("id").Where("id = ?", id)
+	for _, c := range []struct {
+		column string
+		value  *bool
+	}{{"read", req.Read}, {"starred", req.Starred}} {
+		if c.value == nil {
+			continue
+		}
+		if _, err := setItemState(s.db, items, c.column, *c.value); err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+	}
+
+	item, err := s.findAPIItem(id)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, item)
+}
+
+// findArchive URLの保存したページを探す。HTMLContentになければ、そのURLをリンクに持つアイテムのContent2を返す
+// fetchはページをHTMLContentではなくアイテムのContent2に保存するので、両方を探す
+func (s *APIServer) findArchive(link string) (string, bool, error) {
+	if s.pages != nil {
+		var page HTMLContent
+		res := s.pages.Where("url = ?", link).Limit(1).Find(&page)
+		if res.Error != nil {
+			return "", false, res.Error
+		}
+		if res.RowsAffected > 0 && page.Content != "" {
+			return page.Content, true, nil
+		}
+	}
+	var item RssItem
+	res := s.db.Select("id", "content2").Where("link = ? AND content2 <> ''", link).Order("id desc").Limit(1).Find(&item)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return "", false, res.Error
+	}
+	return item.Content2, true, nil
+}
+
+// handleArchive URLの保存したページ（HTMLContent、なければアイテムのContent2）をHTMLのまま返す
+// 他のサイトのHTMLなので、ブラウザで開かれてもスクリプトが動かないようCSPでサンドボックスにする
+func (s *APIServer) handleArchive(w http.ResponseWriter, r *http.Request) {
+	link := r.URL.Query().Get("url")
+	if link == "" {
+		writeAPIError(w, http.StatusBadRequest, "url is required")
+		return
+	}
+	html, ok, err := s.findArchive(link)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "archived page not found")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write([]byte(html))
+}
+
+// handleOutput 複数のフィードのアイテムをまとめたフィードをRSS・Atom・JSON Feedで返す
+// 絞り込み: feed（元のフィードのURL、複数指定可）, keyword, tag, category, limit
+func (s *APIServer) handleOutput(w http.ResponseWriter, r *http.Request) {
+	f, ok := outputFormats[r.PathValue("format")]
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "unknown format (rss, atom or json)")
+		return
+	}
+	query := r.URL.Query()
+	opts := OutputOptions{
+		FeedURLs: query["feed"],
+		Keyword:  query.Get("keyword"),
+		Tag:      query.Get("tag"),
+		Category: query.Get("category"),
+		Limit:    defaultOutputLimit,
+		Title:    query.Get("title"),
+	}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxOutputLimit {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxOutputLimit))
+			return
+		}
+		opts.Limit = n
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	opts.SelfURL = scheme + "://" + r.Host + r.URL.RequestURI()
+
+	feed, err := buildOutputFeed(s.db, opts)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	var buf bytes.Buffer
+	if err := f.write(&buf, feed); err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", f.contentType)
+	w.Write(buf.Bytes())
+}
+
+// openPagesDB test25-2のhtml_contents.dbを読み取り専用で開く。ファイルかHTMLContentのテーブルがなければnil
+func openPagesDB(path string) (*gorm.DB, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	pages, err := gorm.Open(sqlite.Open("file:"+path+"?mode=ro&_busy_timeout=5000"), &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+	if !pages.Migrator().HasTable(&HTMLContent{}) {
+		return nil, nil
+	}
+	return pages, nil
+}
+
+// serveAPI JSON APIを起動する。SIGINT/SIGTERMで終了する
+// 使い方: api [-addr 127.0.0.1:8081] [-html-db ../test25-2/html_contents.db]
+func serveAPI(db *gorm.DB, args []string) error {
+	fs := flag.NewFlagSet("api", flag.ContinueOnError)
+	addr := fs.String("addr", "127.0.0.1:8081", "address to listen on")
+	htmlDB := fs.String("html-db", "../test25-2/html_contents.db", "html_contents.db with HTMLContent pages served by /api/archive (ignored if missing)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	pages, err := openPagesDB(*htmlDB)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", *htmlDB, err)
+	}
+	if pages != nil {
+		log.Printf("api: serving archived pages from %s", *htmlDB)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{Addr: *addr, Handler: NewAPIServer(db, pages)}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- server.ListenAndServe()
+	}()
+	log.Printf("api: listening on %s (spec: /api/openapi.json)", *addr)
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	log.Println("api: stopped")
+	return nil
+}
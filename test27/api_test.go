@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestAPI 5件のアイテム（post-1が最も古い）を取り込んだDBと、HTMLContentを1件入れたhtml_contents.dbでAPIを作る
+// post-2はContent2に、post-3はHTMLContentにページが保存されている
+func newTestAPI(t *testing.T) (*APIServer, *gorm.DB) {
+	t.Helper()
+	db := newTestDB(t)
+	// 日付だけの絞り込みはローカル時間なので、どのタイムゾーンでも同じ日になるよう正午にする
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	feed := &gofeed.Feed{Title: "Blog"}
+	for i := 1; i <= 5; i++ {
+		published := base.AddDate(0, 0, i)
+		feed.Items = append(feed.Items, &gofeed.Item{GUID: fmt.Sprintf("post-%d", i), Title: fmt.Sprintf("Post %d", i),
+			Link: fmt.Sprintf("https://example.com/%d", i), Description: "summary", Content: "<p>body</p>", PublishedParsed: &published})
+	}
+	if _, err := upsertFeedByURL(db, feed, "https://example.com/feed.xml", map[string]string{"post-2": "<p>content2</p>"}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "html_contents.db")
+	pages, err := gorm.Open(sqlite.Open(path), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pages.AutoMigrate(&HTMLContent{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pages.Create(&HTMLContent{URL: "https://example.com/3", Content: "<p>html content</p>"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := pages.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return NewAPIServer(db, pages), db
+}
+
+// apiRequest APIにリクエストを送り、JSONの応答をvに読む（vがnilなら読まない）
+func apiRequest(t *testing.T, s *APIServer, method, path, body string, v interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	if v != nil && w.Code < 300 {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: %v\n%s", method, path, err, w.Body.String())
+		}
+	}
+	return w
+}
+
+// itemTitles 一覧のアイテムのタイトル
+func itemTitles(list APIItemList) []string {
+	titles := []string{}
+	for _, item := range list.Items {
+		titles = append(titles, item.Title)
+	}
+	return titles
+}
+
+func TestAPIFeeds(t *testing.T) {
+	s, _ := newTestAPI(t)
+
+	var created APIFeed
+	w := apiRequest(t, s, "POST", "/api/feeds", `{"url": "https://example.com/feed.xml", "category": "tech", "fetch_interval": "1h"}`, &created)
+	if w.Code != http.StatusCreated || created.ID == 0 || created.FetchInterval != "1h0m0s" {
+		t.Fatalf("add: %d %+v", w.Code, created)
+	}
+	for _, tc := range []struct {
+		body string
+		code int
+	}{
+		{`{"url": "https://example.com/feed.xml"}`, http.StatusConflict},
+		{`{"url": "ftp://example.com/feed.xml"}`, http.StatusBadRequest},
+		{`{"url": "https://example.com/a", "fetch_interval": "soon"}`, http.StatusBadRequest},
+		{`{"url": "https://example.com/a", "unknown": 1}`, http.StatusBadRequest},
+	} {
+		if w := apiRequest(t, s, "POST", "/api/feeds", tc.body, nil); w.Code != tc.code {
+			t.Errorf("add %s: status = %d, want %d", tc.body, w.Code, tc.code)
+		}
+	}
+
+	// 取得済みのフィードならfeed_idとタイトルが付く
+	var feeds []APIFeed
+	apiRequest(t, s, "GET", "/api/feeds", "", &feeds)
+	if len(feeds) != 1 || feeds[0].FeedID == 0 || feeds[0].Title != "Blog" || feeds[0].Category != "tech" {
+		t.Fatalf("list: %+v", feeds)
+	}
+
+	path := fmt.Sprintf("/api/feeds/%d", created.ID)
+	if w := apiRequest(t, s, "DELETE", path, "", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("remove: status = %d", w.Code)
+	}
+	if w := apiRequest(t, s, "DELETE", path, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("remove twice: status = %d, want 404", w.Code)
+	}
+	if w := apiRequest(t, s, "DELETE", "/api/feeds/abc", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("remove abc: status = %d, want 400", w.Code)
+	}
+}
+
+func TestAPIItemsPagination(t *testing.T) {
+	s, _ := newTestAPI(t)
+
+	// 新しく取得した順に2件ずつたどる
+	var got []string
+	cursor := ""
+	for page := 0; page < 5; page++ {
+		var list APIItemList
+		if w := apiRequest(t, s, "GET", "/api/items?limit=2&cursor="+cursor, "", &list); w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+		}
+		got = append(got, itemTitles(list)...)
+		if list.NextCursor == "" {
+			break
+		}
+		cursor = list.NextCursor
+	}
+	if want := "Post 5,Post 4,Post 3,Post 2,Post 1"; strings.Join(got, ",") != want {
+		t.Fatalf("pages = %v, want %s", got, want)
+	}
+
+	var list APIItemList
+	apiRequest(t, s, "GET", "/api/items?since=2024-01-03&until=2024-01-05", "", &list)
+	if titles := strings.Join(itemTitles(list), ","); titles != "Post 3,Post 2" {
+		t.Errorf("since/until: %s, want Post 3,Post 2", titles)
+	}
+	apiRequest(t, s, "GET", "/api/items?since=2024-01-05T12:00:00Z", "", &list)
+	if titles := strings.Join(itemTitles(list), ","); titles != "Post 5,Post 4" {
+		t.Errorf("since RFC 3339: %s, want Post 5,Post 4", titles)
+	}
+	// 一覧には本文を入れない
+	for _, item := range list.Items {
+		if item.Body != "" {
+			t.Errorf("item %d has a body in the list", item.ID)
+		}
+	}
+
+	for _, q := range []string{"limit=0", "limit=1000", "cursor=x", "feed_id=x", "since=yesterday", "unread=maybe"} {
+		if w := apiRequest(t, s, "GET", "/api/items?"+q, "", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", q, w.Code)
+		}
+	}
+}
+
+func TestAPIItemGetAndPatch(t *testing.T) {
+	s, db := newTestAPI(t)
+	var item RssItem
+	if err := db.Where("item_key = ?", "post-2").First(&item).Error; err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/api/items/%d", item.ID)
+
+	var got APIItem
+	if w := apiRequest(t, s, "GET", path, "", &got); w.Code != http.StatusOK {
+		t.Fatalf("get: status = %d", w.Code)
+	}
+	if got.Title != "Post 2" || got.Body != "<p>body</p>" || !got.HasArchive || got.Read || got.Starred {
+		t.Fatalf("get: %+v", got)
+	}
+
+	if w := apiRequest(t, s, "PATCH", path, `{"read": true, "starred": true}`, &got); w.Code != http.StatusOK || !got.Read || !got.Starred {
+		t.Fatalf("patch: %d %+v", w.Code, got)
+	}
+	if w := apiRequest(t, s, "PATCH", path, `{"starred": false}`, &got); w.Code != http.StatusOK || !got.Read || got.Starred {
+		t.Fatalf("patch starred only: %d %+v", w.Code, got)
+	}
+	var list APIItemList
+	apiRequest(t, s, "GET", "/api/items?unread=true", "", &list)
+	if len(list.Items) != 4 {
+		t.Errorf("unread items = %d, want 4", len(list.Items))
+	}
+
+	for _, tc := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"GET", "/api/items/999", "", http.StatusNotFound},
+		{"GET", "/api/items/0", "", http.StatusBadRequest},
+		{"PATCH", "/api/items/999", `{"read": true}`, http.StatusNotFound},
+		{"PATCH", path, `{}`, http.StatusBadRequest},
+		{"PATCH", path, `{"read": "yes"}`, http.StatusBadRequest},
+	} {
+		if w := apiRequest(t, s, tc.method, tc.path, tc.body, nil); w.Code != tc.code {
+			t.Errorf("%s %s %s: status = %d, want %d", tc.method, tc.path, tc.body, w.Code, tc.code)
+		}
+	}
+}
+
+func TestAPIArchive(t *testing.T) {
+	s, _ := newTestAPI(t)
+	for _, tc := range []struct {
+		url, want string
+	}{
+		{"https://example.com/3", "<p>html content</p>"}, // HTMLContent
+		{"https://example.com/2", "<p>content2</p>"},     // fetchが保存したContent2
+	} {
+		w := apiRequest(t, s, "GET", "/api/archive?url="+tc.url, "", nil)
+		if w.Code != http.StatusOK || w.Body.String() != tc.want {
+			t.Errorf("%s: %d %q, want %q", tc.url, w.Code, w.Body.String(), tc.want)
+		}
+		if got := w.Header().Get("Content-Security-Policy"); got != "sandbox" {
+			t.Errorf("%s: Content-Security-Policy = %q, want sandbox", tc.url, got)
+		}
+		if got := w.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+			t.Errorf("%s: Content-Type = %q", tc.url, got)
+		}
+	}
+	if w := apiRequest(t, s, "GET", "/api/archive?url=https://example.com/1", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("not archived: status = %d, want 404", w.Code)
+	}
+	if w := apiRequest(t, s, "GET", "/api/archive", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("no url: status = %d, want 400", w.Code)
+	}
+
+	// has_archiveはHTMLContentとContent2のどちらにあっても立つ
+	var list APIItemList
+	apiRequest(t, s, "GET", "/api/items", "", &list)
+	for _, item := range list.Items {
+		want := item.Title == "Post 2" || item.Title == "Post 3"
+		if item.HasArchive != want {
+			t.Errorf("%s: has_archive = %v, want %v", item.Title, item.HasArchive, want)
+		}
+	}
+}
+
+func TestAPIOpenAPI(t *testing.T) {
+	s, _ := newTestAPI(t)
+	var doc struct {
+		OpenAPI string                 `json:"openapi"`
+		Paths   map[string]interface{} `json:"paths"`
+	}
+	if w := apiRequest(t, s, "GET", "/api/openapi.json", "", &doc); w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	for _, p := range []string{"/api/feeds", "/api/feeds/{id}", "/api/items", "/api/items/{id}", "/api/archive"} {
+		if doc.Paths[p] == nil {
+			t.Errorf("%s is not documented", p)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"gorm.io/gorm"
+)
+
+// 重複の検出の既定値
+const (
+	defaultClusterDistance = 6              // 同じ記事とみなすSimHashのハミング距離の上限（無関係な文章はおよそ32）
+	defaultClusterWindow   = 72 * time.Hour // この時間より離れたアイテムは比べない
+	minShingles            = 6              // これより語の少ないアイテムはSimHashで比べない（URLだけで比べる）
+)
+
+// StoryCluster 複数のフィードに載った同じ記事のまとまり
+type StoryCluster struct {
+	ID         uint `gorm:"primaryKey"`
+	LeadItemID uint // 最初に取り込んだアイテム（一覧ではこのタイトルを表示する）
+	Size       int  // まとめたアイテムの数
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// ClusterOptions 重複の検出の設定
+type ClusterOptions struct {
+	Distance int
+	Window   time.Duration
+}
+
+var defaultClusterOptions = ClusterOptions{Distance: defaultClusterDistance, Window: defaultClusterWindow}
+
+// trackingParams リンクを比べるときに取り除くクエリ（アクセス解析用）
+var trackingParams = map[string]bool{
+	"fbclid": true, "gclid": true, "mc_cid": true, "mc_eid": true, "cmpid": true,
+	"ref": true, "ref_src": true, "src": true, "smid": true, "ito": true, "at_medium": true, "at_campaign": true,
+}
+
+// normalizeURL 同じページを指すリンクが同じ文字列になるよう正規化する
+// スキーム・www・フラグメント・末尾のスラッシュ・トラッキング用のクエリを取り除き、クエリは名前の順に並べる
+func normalizeURL(link string) string {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		host += ":" + port
+	}
+
+	query := u.Query()
+	for name := range query {
+		if strings.HasPrefix(strings.ToLower(name), "utm_") || trackingParams[strings.ToLower(name)] {
+			query.Del(name)
+		}
+	}
+	s := host + strings.TrimSuffix(u.EscapedPath(), "/")
+	if len(query) > 0 {
+		s += "?" + query.Encode() // Encodeは名前の順に並べる
+	}
+	return s
+}
+
+// textTokens 文字列を小文字の語に分ける。空白で区切らない日本語などは1文字ずつにする
+func textTokens(s string) []string {
+	var tokens []string
+	var word []rune
+	flush := func() {
+		if len(word) > 0 {
+			tokens = append(tokens, string(word))
+			word = word[:0]
+		}
+	}
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r):
+			flush()
+			tokens = append(tokens, string(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word = append(word, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return tokens
+}
+
+// shingles 連続する2語ずつの組（シングル）にする
+func shingles(tokens []string) []string {
+	if len(tokens) < 2 {
+		return tokens
+	}
+	s := make([]string, 0, len(tokens)-1)
+	for i := 0; i+1 < len(tokens); i++ {
+		s = append(s, tokens[i]+" "+tokens[i+1])
+	}
+	return s
+}
+
+// simHash シングルから64ビットのSimHashを求める。似た文章ほどハミング距離が小さくなる
+// シングルが少なすぎて比べられないときは0を返す
+func simHash(features []string) uint64 {
+	if len(features) < minShingles {
+		return 0
+	}
+	var weights [64]int
+	for _, f := range features {
+		h := fnv.New64a()
+		h.Write([]byte(f))
+		v := h.Sum64()
+		for i := 0; i < 64; i++ {
+			if v&(1<<uint(i)) != 0 {
+				weights[i]++
+			} else {
+				weights[i]--
+			}
+		}
+	}
+	var hash uint64
+	for i, w := range weights {
+		if w > 0 {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+// itemSimHash アイテムのタイトルと本文（なければ概要）のSimHash
+func itemSimHash(item RssItem) int64 {
+	body := item.Body
+	if body == "" {
+		body = item.Content
+	}
+	// タイトルは短いが記事をよく表すので、本文より重く見る
+	tokens := textTokens(item.Title)
+	features := append(shingles(tokens), shingles(tokens)...)
+	features = append(features, shingles(textTokens(stripHTML(body)))...)
+	return int64(simHash(features))
+}
+
+// hammingDistance 2つのSimHashの異なるビットの数
+func hammingDistance(a, b int64) int {
+	return bits.OnesCount64(uint64(a) ^ uint64(b))
+}
+
+// clusterItem アイテムのリンクとSimHashを記録し、他のフィードに同じ記事があれば同じStoryClusterにまとめる
+// 正規化したリンクが同じなら同じ記事とし、なければ前後opts.Windowの間のアイテムとSimHashで比べる
+// 同じフィードのアイテムはリンクが同じでもまとめない
+func clusterItem(tx *gorm.DB, item *RssItem, opts ClusterOptions) error {
+	item.CanonicalURL = normalizeURL(item.Link)
+	item.SimHash = itemSimHash(*item)
+	err := tx.Model(&RssItem{}).Where("id = ?", item.ID).
+		Updates(map[string]interface{}{"canonical_url": item.CanonicalURL, "sim_hash": item.SimHash}).Error
+	if err != nil {
+		return err
+	}
+
+	var match *RssItem
+	if item.CanonicalURL != "" {
+		var same RssItem
+		res := tx.Select("id", "cluster_id").
+			Where("canonical_url = ? AND feed_id <> ? AND id <> ?", item.CanonicalURL, item.FeedID, item.ID).
+			Order("id").Limit(1).Find(&same)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected > 0 {
+			match = &same
+		}
+	}
+
+	if match == nil && item.SimHash != 0 {
+		// 公開日時がなければ初めて取得した時間で比べる（タイムゾーンが混在するのでjuliandayで比べる）
+		date := itemDate(*item)
+		var candidates []RssItem
+		err := tx.Select("id", "cluster_id", "sim_hash").
+			Where("feed_id <> ? AND sim_hash <> 0", item.FeedID).
+			Where("julianday(CASE WHEN published = ? THEN first_seen ELSE published END) BETWEEN julianday(?) AND julianday(?)",
+				time.Time{}, date.Add(-opts.Window), date.Add(opts.Window)).
+			Order("id").Find(&candidates).Error
+		if err != nil {
+			return err
+		}
+		best := opts.Distance + 1
+		for i, c := range candidates {
+			if d := hammingDistance(item.SimHash, c.SimHash); d < best {
+				best = d
+				match = &candidates[i]
+			}
+		}
+	}
+	if match == nil {
+		return nil
+	}
+
+	clusterID := match.ClusterID
+	if clusterID == 0 {
+		cluster := StoryCluster{LeadItemID: match.ID, Size: 1}
+		if err := tx.Create(&cluster).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&RssItem{}).Where("id = ?", match.ID).Update("cluster_id", cluster.ID).Error; err != nil {
+			return err
+		}
+		clusterID = cluster.ID
+	}
+	if err := tx.Model(&RssItem{}).Where("id = ?", item.ID).Update("cluster_id", clusterID).Error; err != nil {
+		return err
+	}
+	item.ClusterID = clusterID
+	return tx.Model(&StoryCluster{}).Where("id = ?", clusterID).Update("size", gorm.Expr("size + 1")).Error
+}
+
+// ClusterPeer 同じ記事をまとめたStoryClusterの他のアイテム（"also covered by"に表示する）
+type ClusterPeer struct {
+	ID        uint
+	Title     string
+	Link      string
+	FeedTitle string
+}
+
+// clusterPeers StoryClusterのうちitemID以外のアイテムを取り込んだ順に返す
+func clusterPeers(db *gorm.DB, clusterID, itemID uint) ([]ClusterPeer, error) {
+	var peers []ClusterPeer
+	err := db.Raw(`SELECT i.id, i.title, i.link, f.title AS feed_title
+		FROM rss_items i JOIN rss_feeds f ON f.id = i.feed_id
+		WHERE i.cluster_id = ? AND i.id <> ?
+		ORDER BY i.id`, clusterID, itemID).Scan(&peers).Error
+	return peers, err
+}
+
+// clusterCommand 重複の検出をまだしていないアイテム（-rebuildならすべて）をStoryClusterにまとめる
+// 使い方: cluster [-rebuild] [-distance 6] [-window 72h]
+func clusterCommand(db *gorm.DB, args []string) error {
+	opts := defaultClusterOptions
+	fs := flag.NewFlagSet("cluster", flag.ContinueOnError)
+	rebuild := fs.Bool("rebuild", false, "discard existing clusters and cluster all items again")
+	fs.IntVar(&opts.Distance, "distance", opts.Distance, "maximum SimHash Hamming distance for near-duplicates (0-64)")
+	fs.DurationVar(&opts.Window, "window", opts.Window, "only compare items published within this duration of each other")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		q := tx.Omit("content2").Order("id")
+		if *rebuild {
+			if err := tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&StoryCluster{}).Error; err != nil {
+				return err
+			}
+			err := tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Model(&RssItem{}).
+				Updates(map[string]interface{}{"cluster_id": 0, "canonical_url": "", "sim_hash": 0}).Error
+			if err != nil {
+				return err
+			}
+		} else {
+			// 以前のバージョンで取り込んだアイテム
+			q = q.Where("canonical_url = '' AND sim_hash = 0 AND cluster_id = 0")
+		}
+
+		var items []RssItem
+		if err := q.Find(&items).Error; err != nil {
+			return err
+		}
+		clustered := 0
+		for i := range items {
+			if err := clusterItem(tx, &items[i], opts); err != nil {
+				return err
+			}
+			if items[i].ClusterID != 0 {
+				clustered++
+			}
+		}
+		var clusters int64
+		if err := tx.Model(&StoryCluster{}).Count(&clusters).Error; err != nil {
+			return err
+		}
+		fmt.Printf("%d items checked, %d joined a story (%d stories)\n", len(items), clustered, clusters)
+		return nil
+	})
+}
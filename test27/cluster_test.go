@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func TestNormalizeURL(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"https://www.Example.com/posts/1/", "example.com/posts/1"},
+		{"http://example.com/posts/1#comments", "example.com/posts/1"},
+		{"https://example.com:443/posts/1", "example.com/posts/1"},
+		{"https://example.com:8080/posts/1", "example.com:8080/posts/1"},
+		{"https://example.com/posts/1?utm_source=rss&UTM_MEDIUM=feed&fbclid=x", "example.com/posts/1"},
+		{"https://example.com/search?q=go&page=2&ref=hn", "example.com/search?page=2&q=go"},
+		{"https://example.com/a%20b", "example.com/a%20b"},
+		{"  https://example.com/  ", "example.com"},
+		{"/posts/1", ""},
+		{"", ""},
+		{"://broken", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeURL(tt.in); got != tt.want {
+			t.Errorf("normalizeURL(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// 取り込みの例に使う記事の本文
+const (
+	storyText    = "The Go team announced a new release today with range over function iterators, improved telemetry and faster builds for large modules across all supported platforms."
+	storyEdited  = "The Go team announced a new release today with range over function iterators, improved telemetry and quicker builds for large modules across all supported platforms."
+	unrelatedTxt = "Local bakery wins regional award for sourdough bread after a decade of early mornings, patient fermentation and loyal customers lining up every weekend."
+)
+
+func TestSimHashDistance(t *testing.T) {
+	story := itemSimHash(RssItem{Title: "Go 1.23 is released", Content: storyText})
+	edited := itemSimHash(RssItem{Title: "Go 1.23 is released", Content: storyEdited})
+	unrelated := itemSimHash(RssItem{Title: "Bakery wins award", Content: unrelatedTxt})
+
+	if d := hammingDistance(story, edited); d > defaultClusterDistance {
+		t.Errorf("distance between near-duplicates = %d, want at most %d", d, defaultClusterDistance)
+	}
+	if d := hammingDistance(story, unrelated); d <= defaultClusterDistance {
+		t.Errorf("distance between unrelated stories = %d, want more than %d", d, defaultClusterDistance)
+	}
+	// 語が少なすぎれば比べない
+	if h := itemSimHash(RssItem{Title: "Go", Content: "short"}); h != 0 {
+		t.Errorf("SimHash of a short item = %d, want 0", h)
+	}
+}
+
+func TestClusterItems(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now()
+	item := func(guid, title, link, text string) *gofeed.Item {
+		return &gofeed.Item{GUID: guid, Title: title, Link: link, Description: text, PublishedParsed: &now}
+	}
+	// 同じフィードにリンクが同じアイテムが2つあってもまとめない
+	blog := &gofeed.Feed{Title: "Blog", Link: "https://blog.example.com/", Items: []*gofeed.Item{
+		item("a1", "Go 1.23 is released", "https://go.dev/blog/go1.23", storyText),
+		item("a2", "Go 1.23 is released (update)", "https://go.dev/blog/go1.23#update", "Short note"),
+		item("a3", "Bakery wins award", "https://bakery.example.com/award", unrelatedTxt),
+	}}
+	if _, err := upsertFeedByURL(db, blog, "https://blog.example.com/feed.xml", nil); err != nil {
+		t.Fatal(err)
+	}
+	clusterOf := func(key string) uint {
+		t.Helper()
+		var item RssItem
+		if err := db.Where("item_key = ?", key).First(&item).Error; err != nil {
+			t.Fatal(err)
+		}
+		return item.ClusterID
+	}
+	for _, key := range []string{"a1", "a2", "a3"} {
+		if id := clusterOf(key); id != 0 {
+			t.Errorf("%s joined cluster %d within its own feed", key, id)
+		}
+	}
+
+	// 他のフィードの同じ記事は、正規化したリンクかSimHashでまとめる
+	news := &gofeed.Feed{Title: "News", Link: "https://news.example.com/", Items: []*gofeed.Item{
+		item("b1", "Go 1.23 released", "https://www.go.dev/blog/go1.23/?utm_source=news", "Link only"),
+		item("b2", "Go 1.23 is released", "https://news.example.com/go-1-23", storyEdited),
+		item("b3", "Weather", "https://news.example.com/weather", "Sunny with a light breeze in the afternoon and clear skies through the night everywhere."),
+	}}
+	if _, err := upsertFeedByURL(db, news, "https://news.example.com/feed.xml", nil); err != nil {
+		t.Fatal(err)
+	}
+	story := clusterOf("a1")
+	if story == 0 {
+		t.Fatal("the story was not clustered across feeds")
+	}
+	if got := clusterOf("b1"); got != story {
+		t.Errorf("b1 (same link) cluster = %d, want %d", got, story)
+	}
+	if got := clusterOf("b2"); got != story {
+		t.Errorf("b2 (near-duplicate text) cluster = %d, want %d", got, story)
+	}
+	for _, key := range []string{"a2", "a3", "b3"} {
+		if got := clusterOf(key); got != 0 {
+			t.Errorf("%s joined cluster %d", key, got)
+		}
+	}
+
+	var cluster StoryCluster
+	if err := db.First(&cluster, story).Error; err != nil {
+		t.Fatal(err)
+	}
+	if cluster.Size != 3 || cluster.LeadItemID != itemIDByKey(t, db, "a1") {
+		t.Errorf("cluster = %+v, want 3 items led by a1", cluster)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/mmcdole/gofeed"
+)
+
+// フィードの検出の設定
+const (
+	discoverTimeout  = 15 * time.Second // 1リクエストのタイムアウト
+	maxDiscoverBytes = 5 << 20          // 読み込むページとフィードの大きさの上限
+)
+
+// feedLinkTypes <link rel="alternate">のうちフィードを表すtype
+var feedLinkTypes = []string{"application/rss+xml", "application/atom+xml", "application/feed+json"}
+
+// commonFeedPaths サイトのページにフィードへのリンクがなくても試すパス（WordPress・Hugo・Jekyll・Bloggerなど）
+var commonFeedPaths = []string{"/feed", "/rss", "/rss.xml", "/feed.xml", "/atom.xml", "/index.xml", "/feeds/posts/default"}
+
+// FeedCandidate 見つかったフィード
+type FeedCandidate struct {
+	URL   string
+	Title string
+	Type  string // rss 2.0, atom 1.0 など
+	Items int
+}
+
+// errNotFeed 取得した内容がフィードでない
+var errNotFeed = errors.New("not a feed")
+
+// fetchDiscover URLを取得して本文と（リダイレクトの後の）URLを返す
+func fetchDiscover(ctx context.Context, rawURL string) ([]byte, *url.URL, error) {
+	ctx, cancel := context.WithTimeout(ctx, discoverTimeout)
+	defer cancel()
+	resp, err := httpGet(ctx, rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, nil, &statusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDiscoverBytes))
+	if err != nil {
+		return nil, nil, err
+	}
+	return body, resp.Request.URL, nil
+}
+
+// parseCandidate 本文をフィードとして解析する。フィードでなければerrNotFeed
+func parseCandidate(body []byte, final *url.URL) (*FeedCandidate, error) {
+	feed, err := gofeed.NewParser().Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, errNotFeed
+	}
+	kind, version := getRSSTypeAndVersion(feed)
+	return &FeedCandidate{
+		URL:   final.String(),
+		Title: strings.TrimSpace(feed.Title),
+		Type:  strings.TrimSpace(kind + " " + version),
+		Items: len(feed.Items),
+	}, nil
+}
+
+// feedLinks HTMLの<link rel="alternate" type="application/rss+xml">などのフィードのURL（<base>を考慮した絶対URL）
+func feedLinks(body []byte, page *url.URL) ([]string, error) {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	base := page
+	if href, ok := doc.Find("base[href]").First().Attr("href"); ok {
+		if u, err := page.Parse(strings.TrimSpace(href)); err == nil {
+			base = u
+		}
+	}
+
+	var links []string
+	doc.Find("link[href]").Each(func(_ int, s *goquery.Selection) {
+		rel := strings.Fields(strings.ToLower(s.AttrOr("rel", "")))
+		typ := strings.ToLower(strings.TrimSpace(strings.Split(s.AttrOr("type", ""), ";")[0]))
+		if !containsString(rel, "alternate") || !containsString(feedLinkTypes, typ) {
+			return
+		}
+		if u, err := base.Parse(strings.TrimSpace(s.AttrOr("href", ""))); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			links = append(links, u.String())
+		}
+	})
+	return links, nil
+}
+
+// discoverFeeds URLのフィードを探す。URLがフィードならそれだけを返す
+// ページなら<link rel="alternate">のフィードとよく使われるパスを試し、gofeedで解析できたものを見つけた順に返す
+func discoverFeeds(ctx context.Context, rawURL string) ([]FeedCandidate, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "https://" + rawURL
+	}
+	body, page, err := fetchDiscover(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if c, err := parseCandidate(body, page); err == nil {
+		return []FeedCandidate{*c}, nil
+	}
+
+	urls, err := feedLinks(body, page)
+	if err != nil {
+		return nil, err
+	}
+	root := &url.URL{Scheme: page.Scheme, Host: page.Host}
+	for _, p := range commonFeedPaths {
+		urls = append(urls, root.ResolveReference(&url.URL{Path: p}).String())
+	}
+
+	// 候補を並列に取得して確かめる（結果は候補の順に並べる）
+	results := make([]*FeedCandidate, len(urls))
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			body, final, err := fetchDiscover(ctx, u)
+			if err != nil {
+				return
+			}
+			if c, err := parseCandidate(body, final); err == nil {
+				results[i] = c
+			}
+		}(i, u)
+	}
+	wg.Wait()
+
+	// /feedと/feed/のように同じフィードにリダイレクトされるものは1つにする
+	var found []FeedCandidate
+	seen := map[string]bool{}
+	for _, c := range results {
+		if c == nil || seen[c.URL] {
+			continue
+		}
+		seen[c.URL] = true
+		found = append(found, *c)
+	}
+	return found, nil
+}
+
+// printCandidates 見つかったフィードを番号つきで表示する
+func printCandidates(candidates []FeedCandidate) {
+	for i, c := range candidates {
+		title := c.Title
+		if title == "" {
+			title = "(no title)"
+		}
+		fmt.Printf("%2d. %s [%s, %d items]\n    %s\n", i+1, title, c.Type, c.Items, c.URL)
+	}
+}
+
+// discoverCommand ページのURLからフィードを探して表示する
+// 使い方: discover URL
+func discoverCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: discover URL")
+	}
+	candidates, err := discoverFeeds(context.Background(), args[0])
+	if err != nil {
+		return err
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("no feeds found at %s", args[0])
+	}
+	printCandidates(candidates)
+	return nil
+}
+
+// chooseFeed 購読するフィードのURLを決める。URLがフィードでなければページから探す
+// 複数見つかったときはpick番目（0なら標準入力で選んでもらう）を返す
+// 取得できなければエラーにする（確かめずに登録するには-no-discoverを使う）
+func chooseFeed(rawURL string, pick int) (string, error) {
+	candidates, err := discoverFeeds(context.Background(), rawURL)
+	if err != nil {
+		return "", fmt.Errorf("could not check %s: %v (use -no-discover to add it as is)", rawURL, err)
+	}
+	switch {
+	case len(candidates) == 0:
+		return "", fmt.Errorf("no feeds found at %s (use -no-discover to add it anyway)", rawURL)
+	case pick > len(candidates):
+		printCandidates(candidates)
+		return "", fmt.Errorf("-pick %d: only %d feeds found", pick, len(candidates))
+	case pick > 0:
+		return candidates[pick-1].URL, nil
+	case len(candidates) == 1:
+		if c := candidates[0]; c.URL != rawURL {
+			fmt.Printf("Found feed %q: %s\n", c.Title, c.URL)
+		}
+		return candidates[0].URL, nil
+	}
+
+	printCandidates(candidates)
+	fmt.Printf("Subscribe to [1-%d, Enter to cancel]: ", len(candidates))
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return "", errors.New("canceled (use -pick N to choose without asking)")
+	}
+	n, err := strconv.Atoi(line)
+	if err != nil || n < 1 || n > len(candidates) {
+		return "", fmt.Errorf("invalid choice: %s", line)
+	}
+	return candidates[n-1].URL, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChooseFeed(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/{$}", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<html><head><link rel="alternate" type="application/rss+xml" href="/blog.xml"></head></html>`)
+	})
+	mux.HandleFunc("/blog.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<?xml version="1.0"?><rss version="2.0"><channel><title>Blog</title><link>/</link><description>d</description></channel></rss>`)
+	})
+	mux.HandleFunc("/broken", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	// ページのURLならリンクされたフィードを返す
+	got, err := chooseFeed(srv.URL+"/", 0)
+	if err != nil || got != srv.URL+"/blog.xml" {
+		t.Fatalf("page: %q, %v", got, err)
+	}
+
+	// 取得できなければURLをそのまま返さずにエラーにする
+	for _, u := range []string{srv.URL + "/broken", "http://127.0.0.1:1/feed.xml"} {
+		got, err := chooseFeed(u, 0)
+		if err == nil || got != "" || !strings.Contains(err.Error(), "-no-discover") {
+			t.Errorf("%s: %q, %v, want an error suggesting -no-discover", u, got, err)
+		}
+	}
+}
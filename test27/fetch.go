@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"gorm.io/gorm"
+)
+
+// フィード取得時に送るUser-Agent
+const userAgent = "gosample-rss/1.0"
+
+// FetchResult フィードを取得した結果
+type FetchResult struct {
+	Feed         *gofeed.Feed // 304のときはnil
+	StatusCode   int
+	ETag         string
+	LastModified string
+	NotModified  bool          // 304 Not Modified が返された
+	UpdateHint   time.Duration // フィードのttl/sy:updatePeriodが示す更新間隔（なければ0）
+	FinalURL     string        // リダイレクトされた場合の最終的なURL
+	Bytes        int64         // 受け取った本文のバイト数
+}
+
+// statusError 2xx/304以外のHTTPステータスが返されたことを表すエラー
+type statusError struct {
+	Code   int
+	Status string
+}
+
+func (e *statusError) Error() string {
+	return "http error: " + e.Status
+}
+
+// parseError 取得した本文をフィードとして解析できなかったことを表すエラー
+type parseError struct {
+	err error
+}
+
+func (e *parseError) Error() string {
+	return "parse error: " + e.err.Error()
+}
+
+func (e *parseError) Unwrap() error {
+	return e.err
+}
+
+// retryable リトライすれば成功する見込みのあるエラーかどうか
+// （通信エラー、タイムアウト、429、5xx）
+func retryable(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.Code == http.StatusTooManyRequests || se.Code >= 500
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+// fetchFeed 前回のETag/Last-Modifiedを使って条件付きでフィードを取得する
+// 304が返された場合は本文を解析せずにNotModifiedを返す
+func fetchFeed(ctx context.Context, client *http.Client, url, etag, lastModified string) (*FetchResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &FetchResult{
+		StatusCode:   resp.StatusCode,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	if final := resp.Request.URL.String(); final != url {
+		result.FinalURL = final
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		result.NotModified = true
+		// 304でヘッダが省略された場合は前回の値を使い続ける
+		if result.ETag == "" {
+			result.ETag = etag
+		}
+		if result.LastModified == "" {
+			result.LastModified = lastModified
+		}
+		return result, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return result, &statusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	result.Bytes = int64(len(body))
+	if err != nil {
+		return result, err
+	}
+	feed, err := gofeed.NewParser().Parse(bytes.NewReader(body))
+	if err != nil {
+		return result, &parseError{err: err}
+	}
+	result.Feed = feed
+	result.UpdateHint = feedUpdateHint(body, feed)
+	return result, nil
+}
+
+// FetchOptions フィード取得の並列数やリトライの設定
+type FetchOptions struct {
+	Concurrency     int           // 同時に取得するフィードの数
+	PageConcurrency int           // 同時に保存する記事ページの数
+	HostInterval    time.Duration // 同じホストへのリクエストの最小間隔
+	Timeout         time.Duration // 1リクエストのタイムアウト
+	Retries         int           // 失敗したときのリトライ回数
+	Backoff         time.Duration // 最初のリトライまでの待ち時間（以降は倍々で増やす）
+	MaxFailures     int           // 連続してこの回数だけ失敗した購読を無効にする（0なら無効にしない）
+}
+
+// defaultFetchOptions 既定の取得設定
+var defaultFetchOptions = FetchOptions{
+	Concurrency:     4,
+	PageConcurrency: 8,
+	HostInterval:    time.Second,
+	Timeout:         30 * time.Second,
+	Retries:         3,
+	Backoff:         time.Second,
+	MaxFailures:     10,
+}
+
+// addFlags 取得設定をコマンドラインのフラグに登録する
+func (o *FetchOptions) addFlags(fs *flag.FlagSet) {
+	fs.IntVar(&o.Concurrency, "concurrency", o.Concurrency, "number of feeds fetched in parallel")
+	fs.IntVar(&o.PageConcurrency, "page-concurrency", o.PageConcurrency, "number of article pages archived in parallel")
+	fs.DurationVar(&o.HostInterval, "host-interval", o.HostInterval, "minimum interval between requests to the same host")
+	fs.DurationVar(&o.Timeout, "timeout", o.Timeout, "timeout for each request")
+	fs.IntVar(&o.Retries, "retries", o.Retries, "number of retries for failed requests")
+	fs.DurationVar(&o.Backoff, "backoff", o.Backoff, "initial retry backoff (doubled on each retry)")
+	fs.IntVar(&o.MaxFailures, "max-failures", o.MaxFailures, "disable subscriptions after this many consecutive failures (0 to never disable)")
+}
+
+// hostLimiter 同じホストへのリクエストの間隔を空ける
+type hostLimiter struct {
+	interval time.Duration
+	mu       sync.Mutex
+	next     map[string]time.Time // ホストごとに次にリクエストしてよい時刻
+}
+
+func newHostLimiter(interval time.Duration) *hostLimiter {
+	return &hostLimiter{interval: interval, next: map[string]time.Time{}}
+}
+
+// wait rawURLのホストにリクエストしてよい時刻まで待つ
+func (l *hostLimiter) wait(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next[u.Host]
+	if at.Before(now) {
+		at = now
+	}
+	l.next[u.Host] = at.Add(l.interval)
+	l.mu.Unlock()
+
+	return sleepContext(ctx, time.Until(at))
+}
+
+// sleepContext ctxがキャンセルされるまでの間、dだけ待つ
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// Fetcher 複数のフィードを並列に取得してデータベースに保存する
+type Fetcher struct {
+	db     *gorm.DB
+	client *http.Client
+	opts   FetchOptions
+	hosts  *hostLimiter
+	pages  chan struct{} // 記事ページの保存の同時実行数を制限するセマフォ
+	dbMu   sync.Mutex    // SQLiteへのアクセスを直列化する（"database is locked"を避ける）
+}
+
+func NewFetcher(db *gorm.DB, opts FetchOptions) *Fetcher {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+	if opts.PageConcurrency < 1 {
+		opts.PageConcurrency = 1
+	}
+	return &Fetcher{
+		db:     db,
+		client: &http.Client{},
+		opts:   opts,
+		hosts:  newHostLimiter(opts.HostInterval),
+		pages:  make(chan struct{}, opts.PageConcurrency),
+	}
+}
+
+// withDB データベースへのアクセスを1つずつ実行する
+func (f *Fetcher) withDB(fn func(db *gorm.DB) error) error {
+	f.dbMu.Lock()
+	defer f.dbMu.Unlock()
+	return fn(f.db)
+}
+
+// retry ホストごとの間隔を守りながらfnを実行し、リトライできるエラーなら指数バックオフで再実行する
+func (f *Fetcher) retry(ctx context.Context, rawURL string, fn func(ctx context.Context) error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = f.hosts.wait(ctx, rawURL); err != nil {
+			return err
+		}
+		reqCtx, cancel := context.WithTimeout(ctx, f.opts.Timeout)
+		err = fn(reqCtx)
+		cancel()
+		if err == nil || !retryable(err) || attempt >= f.opts.Retries || ctx.Err() != nil {
+			return err
+		}
+
+		// 待ち時間は倍々で増やし、同時に再試行しないよう揺らぎを加える
+		backoff := f.opts.Backoff << attempt
+		backoff += time.Duration(rand.Int63n(int64(backoff)/2 + 1))
+		if err := sleepContext(ctx, backoff); err != nil {
+			return err
+		}
+	}
+}
+
+// Run URLの一覧をワーカーで並列に取得する。取得に失敗したフィードはエラーを表示して続ける
+func (f *Fetcher) Run(ctx context.Context, urls []string) {
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < f.opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range jobs {
+				if err := f.FetchOne(ctx, u); err != nil {
+					fmt.Printf("%s: %s\n", u, err)
+				}
+			}
+		}()
+	}
+
+	for _, u := range urls {
+		select {
+		case jobs <- u:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// FetchOne 購読のフィードを条件付きで取得し、変更があれば記事ページも保存してデータベースに書き込む
+// 取得の結果はFetchLogに記録する
+func (f *Fetcher) FetchOne(ctx context.Context, feedURL string) error {
+	entry := &FetchLog{URL: feedURL, StartedAt: time.Now()}
+	err := f.fetchOne(ctx, feedURL, entry)
+
+	// 中断された取得は記録せず、失敗としても数えない
+	if ctx.Err() == nil {
+		entry.Duration = time.Since(entry.StartedAt)
+		if err := f.withDB(func(db *gorm.DB) error {
+			return recordAttempt(db, entry, err, f.opts.MaxFailures)
+		}); err != nil {
+			fmt.Printf("%s: failed to record fetch log: %s\n", feedURL, err)
+		}
+	}
+	return err
+}
+
+// fetchOne FetchOneの本体。分かったことをentryに書き込みながら進める
+func (f *Fetcher) fetchOne(ctx context.Context, feedURL string, entry *FetchLog) error {
+	// 前回の取得結果からキャッシュ用のヘッダを取り出す
+	var existing RssFeed
+	var found bool
+	err := f.withDB(func(db *gorm.DB) error {
+		res := db.Where("url = ?", feedURL).Limit(1).Find(&existing)
+		found = res.RowsAffected > 0
+		return res.Error
+	})
+	if err != nil {
+		return err
+	}
+
+	var result *FetchResult
+	err = f.retry(ctx, feedURL, func(ctx context.Context) error {
+		var err error
+		result, err = fetchFeed(ctx, f.client, feedURL, existing.ETag, existing.LastModified)
+		return err
+	})
+	if result != nil {
+		entry.StatusCode = result.StatusCode
+		entry.FinalURL = result.FinalURL
+		entry.Bytes = result.Bytes
+		entry.NotModified = result.NotModified
+	}
+	if err != nil {
+		if found && result != nil {
+			// 失敗したステータスだけは記録しておく（LastFetchedは成功したときだけ進める。試した時間と失敗の回数は購読に記録する）
+			f.withDB(func(db *gorm.DB) error {
+				return db.Model(&existing).Update("last_status", result.StatusCode).Error
+			})
+		}
+		return fmt.Errorf("failed to fetch feed: %w", err)
+	}
+
+	if result.NotModified {
+		fmt.Printf("%s: フィードの更新なし（304）。スキップします。\n", feedURL)
+	} else {
+		// 記事ページの保存は通信に時間がかかるので、データベースのロックを持たずに行う
+		var items []*gofeed.Item
+		err := f.withDB(func(db *gorm.DB) error {
+			var err error
+			items, err = itemsToArchive(db, result.Feed, feedURL)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		archives := f.archivePages(ctx, items)
+
+		// フィードの挿入または更新（URLを基準に）
+		err = f.withDB(func(db *gorm.DB) error {
+			counts, err := upsertFeedByURL(db, result.Feed, feedURL, archives)
+			entry.NewItems = counts.New
+			entry.UpdatedItems = counts.Updated
+			entry.UnchangedItems = counts.Unchanged
+			entry.SkippedItems = counts.Skipped
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to upsert feed: %w", err)
+		}
+	}
+
+	// キャッシュ用のヘッダと取得結果を保存
+	updates := map[string]interface{}{
+		"e_tag":         result.ETag,
+		"last_modified": result.LastModified,
+		"last_status":   result.StatusCode,
+		"last_fetched":  time.Now(),
+	}
+	if result.Feed != nil {
+		updates["update_hint"] = result.UpdateHint
+	}
+	return f.withDB(func(db *gorm.DB) error {
+		return db.Model(&RssFeed{}).Where("url = ?", feedURL).Updates(updates).Error
+	})
+}
+
+// archivePages アイテムのリンク先のページを並列に取得し、識別子ごとのHTMLを返す
+// 取得に失敗したページは含めない
+func (f *Fetcher) archivePages(ctx context.Context, items []*gofeed.Item) map[string]string {
+	archives := map[string]string{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, item := range items {
+		wg.Add(1)
+		go func(item *gofeed.Item) {
+			defer wg.Done()
+			select {
+			case f.pages <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-f.pages }()
+
+			var html string
+			err := f.retry(ctx, item.Link, func(ctx context.Context) error {
+				var err error
+				html, err = getHtml(ctx, item.Link)
+				return err
+			})
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			archives[itemKey(item)] = html
+			mu.Unlock()
+		}(item)
+	}
+	wg.Wait()
+	return archives
+}
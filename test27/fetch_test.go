@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// feedServer ETagとLast-Modifiedで条件付きの取得に答えるテスト用のフィード
+type feedServer struct {
+	mu           sync.Mutex
+	etag         string
+	lastModified string
+	items        int
+	status       int           // 0でなければこのステータスで失敗する
+	requests     int           // フィードへのリクエストの数
+	conditional  []http.Header // 各リクエストの条件付きのヘッダ
+	server       *httptest.Server
+}
+
+func newFeedServer(t *testing.T) *feedServer {
+	s := &feedServer{etag: `"v1"`, lastModified: "Mon, 02 Jan 2006 15:04:05 GMT", items: 2}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/feed.xml", s.handleFeed)
+	mux.HandleFunc("/posts/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "<html><body><p>%s</p></body></html>", r.URL.Path)
+	})
+	s.server = httptest.NewServer(mux)
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func (s *feedServer) handleFeed(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	s.conditional = append(s.conditional, http.Header{
+		"If-None-Match":     r.Header.Values("If-None-Match"),
+		"If-Modified-Since": r.Header.Values("If-Modified-Since"),
+	})
+
+	if s.status != 0 {
+		http.Error(w, "broken", s.status)
+		return
+	}
+	w.Header().Set("ETag", s.etag)
+	w.Header().Set("Last-Modified", s.lastModified)
+	if r.Header.Get("If-None-Match") == s.etag || r.Header.Get("If-Modified-Since") == s.lastModified {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/rss+xml")
+	fmt.Fprint(w, `<?xml version="1.0"?><rss version="2.0"><channel><title>Test feed</title><link>`+s.server.URL+`/</link><description>d</description>`)
+	for i := 1; i <= s.items; i++ {
+		fmt.Fprintf(w, `<item><guid>item-%d</guid><title>Item %d</title><link>%s/posts/%d</link><description>body %d</description></item>`,
+			i, i, s.server.URL, i, i)
+	}
+	fmt.Fprint(w, `</channel></rss>`)
+}
+
+// update フィードの内容を変える（ETagとLast-Modifiedも変わる）
+func (s *feedServer) update(items int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items = items
+	s.etag = fmt.Sprintf(`"v%d"`, items)
+	s.lastModified = "Tue, 03 Jan 2006 15:04:05 GMT"
+}
+
+// fail 以降のリクエストをstatusで失敗させる
+func (s *feedServer) fail(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+// request n番目のリクエストの条件付きのヘッダとリクエストの数
+func (s *feedServer) request(n int) (http.Header, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conditional[n], s.requests
+}
+
+func TestFetchConditionalGet(t *testing.T) {
+	db := newTestDB(t)
+	srv := newFeedServer(t)
+	feedURL := srv.server.URL + "/feed.xml"
+	opts := defaultFetchOptions
+	opts.HostInterval = 0
+	opts.Retries = 0
+	opts.Timeout = 5 * time.Second
+	f := NewFetcher(db, opts)
+	ctx := context.Background()
+
+	snapshot := func() []RssItem {
+		var items []RssItem
+		if err := db.Order("id").Find(&items).Error; err != nil {
+			t.Fatal(err)
+		}
+		return items
+	}
+	lastLog := func() FetchLog {
+		var entry FetchLog
+		if err := db.Order("id desc").Limit(1).Find(&entry).Error; err != nil {
+			t.Fatal(err)
+		}
+		return entry
+	}
+
+	// 1回目: 条件なしで取得して2件保存し、ETagとLast-Modifiedを覚える
+	if err := f.FetchOne(ctx, feedURL); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := srv.request(0); len(got["If-None-Match"]) != 0 || len(got["If-Modified-Since"]) != 0 {
+		t.Fatalf("first request was conditional: %v", got)
+	}
+	before := snapshot()
+	if len(before) != 2 {
+		t.Fatalf("stored %d items, want 2", len(before))
+	}
+	var feed RssFeed
+	if err := db.Where("url = ?", feedURL).First(&feed).Error; err != nil {
+		t.Fatal(err)
+	}
+	if feed.ETag != `"v1"` || feed.LastModified != "Mon, 02 Jan 2006 15:04:05 GMT" {
+		t.Fatalf("cached headers = %q, %q", feed.ETag, feed.LastModified)
+	}
+
+	// 2回目: 覚えたヘッダを送り、304ならアイテムを書き換えない
+	if err := f.FetchOne(ctx, feedURL); err != nil {
+		t.Fatal(err)
+	}
+	got, requests := srv.request(1)
+	if requests != 2 {
+		t.Fatalf("feed requests = %d, want 2", requests)
+	}
+	if got.Get("If-None-Match") != `"v1"` || got.Get("If-Modified-Since") != feed.LastModified {
+		t.Fatalf("second request headers = %v", got)
+	}
+	if entry := lastLog(); !entry.NotModified || entry.StatusCode != http.StatusNotModified || entry.NewItems != 0 || entry.UpdatedItems != 0 {
+		t.Fatalf("fetch log = %+v, want a 304 with no item changes", entry)
+	}
+	if after := snapshot(); !reflect.DeepEqual(after, before) {
+		t.Fatalf("items were rewritten on 304:\nbefore %+v\nafter  %+v", before, after)
+	}
+
+	// 3回目: フィードが変わればETagが合わないので200で取得し、新しいアイテムだけを追加する
+	srv.update(3)
+	if err := f.FetchOne(ctx, feedURL); err != nil {
+		t.Fatal(err)
+	}
+	if entry := lastLog(); entry.NotModified || entry.NewItems != 1 || entry.UnchangedItems != 2 {
+		t.Fatalf("fetch log = %+v, want 1 new and 2 unchanged items", entry)
+	}
+	if err := db.Where("url = ?", feedURL).First(&feed).Error; err != nil {
+		t.Fatal(err)
+	}
+	if feed.ETag != `"v3"` {
+		t.Fatalf("ETag = %q after the feed changed, want \"v3\"", feed.ETag)
+	}
+}
+
+func TestFetchFailureKeepsLastFetched(t *testing.T) {
+	db := newTestDB(t)
+	srv := newFeedServer(t)
+	feedURL := srv.server.URL + "/feed.xml"
+	opts := defaultFetchOptions
+	opts.HostInterval = 0
+	opts.Retries = 0
+	opts.Timeout = 5 * time.Second
+	f := NewFetcher(db, opts)
+
+	if err := f.FetchOne(context.Background(), feedURL); err != nil {
+		t.Fatal(err)
+	}
+	var before RssFeed
+	if err := db.Where("url = ?", feedURL).First(&before).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// 失敗したときはステータスだけを記録し、最後に取得した時間は進めない
+	srv.fail(http.StatusInternalServerError)
+	if err := f.FetchOne(context.Background(), feedURL); err == nil {
+		t.Fatal("fetching a broken feed succeeded")
+	}
+	var after RssFeed
+	if err := db.Where("url = ?", feedURL).First(&after).Error; err != nil {
+		t.Fatal(err)
+	}
+	if after.LastStatus != http.StatusInternalServerError {
+		t.Errorf("last status = %d, want 500", after.LastStatus)
+	}
+	if !after.LastFetched.Equal(before.LastFetched) {
+		t.Errorf("last fetched moved from %v to %v on a failure", before.LastFetched, after.LastFetched)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// フィードの健全性の判定に使う設定
+const (
+	deadFailures      = 3                   // 連続してこの回数だけ失敗したフィードは停止しているとみなす
+	fetchLogRetention = 30 * 24 * time.Hour // 取得ログを残す期間
+)
+
+// FetchLog フィードの取得1回分の記録
+type FetchLog struct {
+	ID             uint      `gorm:"primaryKey"`
+	URL            string    `gorm:"index:idx_fetch_log_url_started"` // 購読のURL
+	StartedAt      time.Time `gorm:"index:idx_fetch_log_url_started"` // 取得を始めた時間
+	Duration       time.Duration
+	StatusCode     int    // 最後に受け取ったHTTPステータス（通信エラーなら0）
+	FinalURL       string // リダイレクトされた場合の最終的なURL
+	Bytes          int64  // 受け取った本文のバイト数
+	NotModified    bool   // 304 Not Modified だった
+	Success        bool
+	Error          string // 失敗した理由
+	ParseError     string // フィードの解析に失敗した場合のエラー
+	NewItems       int
+	UpdatedItems   int
+	UnchangedItems int
+	SkippedItems   int // ルールで保存しなかったアイテム
+}
+
+// recordAttempt 取得の結果をFetchLogに書き込み、購読の連続失敗回数を更新する
+// maxFailures回続けて失敗した購読は無効にする（0なら無効にしない）
+func recordAttempt(db *gorm.DB, entry *FetchLog, fetchErr error, maxFailures int) error {
+	entry.Success = fetchErr == nil
+	if fetchErr != nil {
+		entry.Error = fetchErr.Error()
+		var pe *parseError
+		if errors.As(fetchErr, &pe) {
+			entry.ParseError = pe.err.Error()
+		}
+	}
+	if err := db.Create(entry).Error; err != nil {
+		return err
+	}
+
+	// 古いログは消す
+	err := db.Where("url = ? AND started_at < ?", entry.URL, time.Now().Add(-fetchLogRetention)).Delete(&FetchLog{}).Error
+	if err != nil {
+		return err
+	}
+
+	updates := map[string]interface{}{
+		"last_attempt": time.Now(),
+		"failures":     0,
+	}
+	if fetchErr != nil {
+		updates["failures"] = gorm.Expr("failures + 1")
+	}
+	if err := db.Model(&Subscription{}).Where("url = ?", entry.URL).Updates(updates).Error; err != nil {
+		return err
+	}
+	if fetchErr == nil || maxFailures <= 0 {
+		return nil
+	}
+
+	// 失敗が続いている購読は無効にする
+	var sub Subscription
+	res := db.Where("url = ?", entry.URL).Limit(1).Find(&sub)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 || !sub.Enabled || sub.Failures < maxFailures {
+		return nil
+	}
+	reason := fmt.Sprintf("%d consecutive failures (last: %s)", sub.Failures, entry.Error)
+	err = db.Model(&sub).Updates(map[string]interface{}{
+		"enabled":         false,
+		"disabled_reason": reason,
+	}).Error
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d回続けて取得に失敗したため無効にしました\n", sub.URL, sub.Failures)
+	return nil
+}
+
+// FeedHealth 購読1件の健全性
+type FeedHealth struct {
+	Subscription Subscription
+	LastLog      *FetchLog // 最後の取得（記録がなければnil）
+	LastSuccess  *FetchLog // 最後に成功した取得
+	LastNewItem  time.Time // 最後に新着アイテムが見つかった時間
+	Dead         bool      // 取得できなくなっている
+	Redirected   bool      // 別のURLへリダイレクトされている
+	Stale        bool      // 一定期間、新着アイテムがない
+}
+
+// lastFetchLog 条件に合う最新の取得ログを返す。なければnil
+func lastFetchLog(db *gorm.DB, url string, onlySuccess bool) (*FetchLog, error) {
+	q := db.Where("url = ?", url)
+	if onlySuccess {
+		q = q.Where("success = ?", true)
+	}
+	var entry FetchLog
+	res := q.Order("started_at desc").Limit(1).Find(&entry)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return nil, res.Error
+	}
+	return &entry, nil
+}
+
+// checkFeedHealth 購読の取得ログとアイテムから健全性を判定する
+func checkFeedHealth(db *gorm.DB, sub Subscription, staleAfter time.Duration, now time.Time) (*FeedHealth, error) {
+	h := &FeedHealth{Subscription: sub}
+	var err error
+	if h.LastLog, err = lastFetchLog(db, sub.URL, false); err != nil {
+		return nil, err
+	}
+	if h.LastSuccess, err = lastFetchLog(db, sub.URL, true); err != nil {
+		return nil, err
+	}
+
+	var feed RssFeed
+	res := db.Where("url = ?", sub.URL).Limit(1).Find(&feed)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected > 0 {
+		var item RssItem
+		err := db.Where("feed_id = ?", feed.ID).Order("first_seen desc").Limit(1).Find(&item).Error
+		if err != nil {
+			return nil, err
+		}
+		h.LastNewItem = item.FirstSeen
+	}
+
+	// 自動で無効にされた、失敗が続いている、またはフィードが削除されている
+	gone := h.LastLog != nil && (h.LastLog.StatusCode == http.StatusNotFound || h.LastLog.StatusCode == http.StatusGone)
+	h.Dead = sub.DisabledReason != "" || sub.Failures >= deadFailures || gone
+	h.Redirected = h.LastSuccess != nil && h.LastSuccess.FinalURL != ""
+	h.Stale = !h.Dead && res.RowsAffected > 0 && now.Sub(h.LastNewItem) >= staleAfter
+	return h, nil
+}
+
+// formatTime 日時を表示用に整える。ゼロ値なら"-"
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
+// feedsHealth 停止している、リダイレクトされている、更新が止まっているフィードを一覧にする
+// 使い方: health [-stale-days 7]
+func feedsHealth(db *gorm.DB, args []string) error {
+	fs := flag.NewFlagSet("health", flag.ContinueOnError)
+	staleDays := fs.Int("stale-days", 7, "report feeds without new items for this many days")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	staleAfter := time.Duration(*staleDays) * 24 * time.Hour
+
+	var subs []Subscription
+	if err := db.Order("category, url").Find(&subs).Error; err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var dead, redirected, stale []*FeedHealth
+	for _, sub := range subs {
+		h, err := checkFeedHealth(db, sub, staleAfter, now)
+		if err != nil {
+			return err
+		}
+		if h.Dead {
+			dead = append(dead, h)
+		}
+		if h.Redirected {
+			redirected = append(redirected, h)
+		}
+		if h.Stale {
+			stale = append(stale, h)
+		}
+	}
+
+	fmt.Printf("dead (%d)\n", len(dead))
+	for _, h := range dead {
+		state := "enabled"
+		if !h.Subscription.Enabled {
+			state = "disabled"
+		}
+		lastError := "-"
+		if h.Subscription.DisabledReason != "" {
+			lastError = h.Subscription.DisabledReason
+		} else if h.LastLog != nil && h.LastLog.Error != "" {
+			lastError = h.LastLog.Error
+		}
+		var lastSuccess time.Time
+		if h.LastSuccess != nil {
+			lastSuccess = h.LastSuccess.StartedAt
+		}
+		fmt.Printf("  %s (%s, %d failures, last success %s)\n    %s\n",
+			h.Subscription.URL, state, h.Subscription.Failures, formatTime(lastSuccess), lastError)
+	}
+
+	fmt.Printf("redirected (%d)\n", len(redirected))
+	for _, h := range redirected {
+		fmt.Printf("  %s -> %s\n", h.Subscription.URL, h.LastSuccess.FinalURL)
+	}
+
+	fmt.Printf("stale for %d days (%d)\n", *staleDays, len(stale))
+	for _, h := range stale {
+		fmt.Printf("  %s (last new item %s)\n", h.Subscription.URL, formatTime(h.LastNewItem))
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"gorm.io/gorm"
+)
+
+// RssItemAuthor アイテムの著者
+type RssItemAuthor struct {
+	ID     uint `gorm:"primaryKey"`
+	ItemID uint `gorm:"index"`
+	Name   string
+	Email  string
+}
+
+// RssItemCategory アイテムのカテゴリ（タグ）
+type RssItemCategory struct {
+	ID     uint   `gorm:"primaryKey"`
+	ItemID uint   `gorm:"index"`
+	Name   string `gorm:"index"`
+}
+
+// RssItemEnclosure アイテムの添付ファイル（ポッドキャストの音声など）
+type RssItemEnclosure struct {
+	ID     uint `gorm:"primaryKey"`
+	ItemID uint `gorm:"index"`
+	URL    string
+	Length int64  // バイト数（不明なら0）
+	Type   string `gorm:"index"` // MIMEタイプ（audio/mpegなど）
+}
+
+// newRssItem gofeedのアイテムから保存する内容とメタデータを取り出す
+func newRssItem(item *gofeed.Item) RssItem {
+	rssItem := RssItem{
+		GUID:    item.GUID,
+		Title:   item.Title,
+		Link:    item.Link,
+		Content: item.Description,
+		Body:    item.Content,
+	}
+	if item.PublishedParsed != nil {
+		rssItem.Published = *item.PublishedParsed
+	}
+	if item.UpdatedParsed != nil {
+		rssItem.Updated = *item.UpdatedParsed
+	}
+	if item.Image != nil {
+		rssItem.ImageURL = item.Image.URL
+	} else if item.ITunesExt != nil {
+		rssItem.ImageURL = item.ITunesExt.Image
+	}
+
+	for _, p := range item.Authors {
+		if p == nil || (p.Name == "" && p.Email == "") {
+			continue
+		}
+		rssItem.Authors = append(rssItem.Authors, RssItemAuthor{Name: p.Name, Email: p.Email})
+	}
+
+	// 同じカテゴリが重複して書かれていることがあるので除く
+	seen := map[string]bool{}
+	for _, c := range item.Categories {
+		c = strings.TrimSpace(c)
+		if c == "" || seen[c] {
+			continue
+		}
+		seen[c] = true
+		rssItem.Categories = append(rssItem.Categories, RssItemCategory{Name: c})
+	}
+
+	for _, e := range item.Enclosures {
+		if e == nil || e.URL == "" {
+			continue
+		}
+		length, _ := strconv.ParseInt(strings.TrimSpace(e.Length), 10, 64)
+		rssItem.Enclosures = append(rssItem.Enclosures, RssItemEnclosure{URL: e.URL, Length: length, Type: e.Type})
+	}
+	return rssItem
+}
+
+// itemContentHash アイテムの内容とメタデータのハッシュを求める（変更の検出に使う）
+func itemContentHash(item RssItem) string {
+	h := sha256.New()
+	write := func(s string) {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	for _, s := range []string{item.GUID, item.Title, item.Link, item.Content, item.Body, item.ImageURL} {
+		write(s)
+	}
+	write(item.Published.UTC().String())
+	write(item.Updated.UTC().String())
+	for _, a := range item.Authors {
+		write(a.Name + "\x01" + a.Email)
+	}
+	for _, c := range item.Categories {
+		write(c.Name)
+	}
+	for _, e := range item.Enclosures {
+		write(e.URL + "\x01" + e.Type + "\x01" + strconv.FormatInt(e.Length, 10))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// itemColumns 内容が変わったアイテムを更新するときの列
+func itemColumns(item RssItem) map[string]interface{} {
+	return map[string]interface{}{
+		"guid":      item.GUID,
+		"title":     item.Title,
+		"link":      item.Link,
+		"content":   item.Content,
+		"body":      item.Body,
+		"published": item.Published,
+		"updated":   item.Updated,
+		"image_url": item.ImageURL,
+		"hash":      item.Hash,
+	}
+}
+
+// replaceItemMetadata アイテムの著者・カテゴリ・添付ファイルを入れ替える
+func replaceItemMetadata(tx *gorm.DB, itemID uint, item RssItem) error {
+	for _, model := range []interface{}{&RssItemAuthor{}, &RssItemCategory{}, &RssItemEnclosure{}} {
+		if err := tx.Where("item_id = ?", itemID).Delete(model).Error; err != nil {
+			return err
+		}
+	}
+	for i := range item.Authors {
+		item.Authors[i].ItemID = itemID
+	}
+	for i := range item.Categories {
+		item.Categories[i].ItemID = itemID
+	}
+	for i := range item.Enclosures {
+		item.Enclosures[i].ItemID = itemID
+	}
+	if len(item.Authors) > 0 {
+		if err := tx.Create(&item.Authors).Error; err != nil {
+			return err
+		}
+	}
+	if len(item.Categories) > 0 {
+		if err := tx.Create(&item.Categories).Error; err != nil {
+			return err
+		}
+	}
+	if len(item.Enclosures) > 0 {
+		if err := tx.Create(&item.Enclosures).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// itemMarks アイテムの状態を表す印（N: 未読、S: スター付き、A: アーカイブ）
+func itemMarks(item RssItem) string {
+	marks := []byte("N  ")
+	if item.State != nil {
+		if item.State.Read {
+			marks[0] = ' '
+		}
+		if item.State.Starred {
+			marks[1] = 'S'
+		}
+		if item.State.Archived {
+			marks[2] = 'A'
+		}
+	}
+	return string(marks)
+}
+
+// listItems 保存したアイテムを公開日時の新しい順に表示する。アーカイブしたアイテムは-archivedを付けたときだけ表示する
+// 他のフィードに載った同じ記事は1件にまとめ、"also covered by"として表示する（-duplicatesならすべて表示する）
+// 使い方: items [-feed URL] [-category カテゴリ] [-author 著者] [-media audio] [-tag タグ] [-unread] [-starred] [-duplicates] [-limit 20]
+func listItems(db *gorm.DB, args []string) error {
+	var filter ItemFilter
+	fs := flag.NewFlagSet("items", flag.ContinueOnError)
+	filter.addFlags(fs)
+	limit := fs.Int("limit", 20, "maximum number of items")
+	all := fs.Bool("duplicates", false, "show every copy of a story instead of grouping them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	q := db.Preload("Authors").Preload("Categories").Preload("Enclosures").Preload("State").Preload("Tags")
+	q = filter.apply(db, q, true)
+
+	var items []RssItem
+	if err := q.Order("published desc, first_seen desc").Limit(*limit).Find(&items).Error; err != nil {
+		return err
+	}
+
+	// 同じ記事は1件だけ表示し、他のフィードのものは"also covered by"にまとめる
+	shown := map[uint]bool{}
+	for _, item := range items {
+		if item.ClusterID != 0 && !*all {
+			if shown[item.ClusterID] {
+				continue
+			}
+			shown[item.ClusterID] = true
+		}
+		fmt.Printf("#%-5d %s %s  %s\n", item.ID, itemMarks(item), formatTime(itemDate(item)), item.Title)
+		fmt.Printf("    %s\n", item.Link)
+		if len(item.Authors) > 0 {
+			names := make([]string, len(item.Authors))
+			for i, a := range item.Authors {
+				names[i] = a.Name
+				if names[i] == "" {
+					names[i] = a.Email
+				}
+			}
+			fmt.Printf("    by %s\n", strings.Join(names, ", "))
+		}
+		if len(item.Categories) > 0 {
+			tags := make([]string, len(item.Categories))
+			for i, c := range item.Categories {
+				tags[i] = c.Name
+			}
+			fmt.Printf("    categories: %s\n", strings.Join(tags, ", "))
+		}
+		if len(item.Tags) > 0 {
+			tags := make([]string, len(item.Tags))
+			for i, t := range item.Tags {
+				tags[i] = t.Name
+			}
+			fmt.Printf("    tags: %s\n", strings.Join(tags, ", "))
+		}
+		for _, e := range item.Enclosures {
+			fmt.Printf("    [%s %s] %s\n", e.Type, formatBytes(e.Length), e.URL)
+		}
+		if item.ClusterID != 0 && !*all {
+			peers, err := clusterPeers(db, item.ClusterID, item.ID)
+			if err != nil {
+				return err
+			}
+			for _, p := range peers {
+				fmt.Printf("    also covered by %s: %s\n", p.FeedTitle, p.Link)
+			}
+		}
+	}
+	return nil
+}
+
+// formatBytes バイト数を表示用に整える。不明なら"-"
+func formatBytes(n int64) string {
+	switch {
+	case n <= 0:
+		return "-"
+	case n < 1<<10:
+		return fmt.Sprintf("%dB", n)
+	case n < 1<<20:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	}
+}
+
+// itemDate アイテムの日付（公開日時、更新日時、初めて取得した時間の順）
+func itemDate(item RssItem) time.Time {
+	switch {
+	case !item.Published.IsZero():
+		return item.Published
+	case !item.Updated.IsZero():
+		return item.Updated
+	default:
+		return item.FirstSeen
+	}
+}
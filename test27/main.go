@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"flag"
 	"fmt"
 	"github.com/PuerkitoBio/goquery"
 	"io/ioutil"
@@ -21,23 +25,46 @@ type RssFeed struct {
 	ID            uint `gorm:"primaryKey"`
 	Title         string
 	Description   string
-	Link          string    `gorm:"uniqueIndex:idx_feed_link_version"` // リンクはユニークだが方式とバージョン番号ごとに区別
-	Type          string    // RSSの方式（RSS, Atomなど）
-	VersionNumber string    // バージョン番号（1.0, 2.0など）
-	Updated       time.Time // フィードの更新日時
-	URL           string    `gorm:"unique"` // フィードのURLを保持する
-	LastFetched   time.Time // 最後に取得した時間
-	Items         []RssItem `gorm:"foreignKey:FeedID"`
+	Link          string        `gorm:"uniqueIndex:idx_feed_link_version"` // リンクはユニークだが方式とバージョン番号ごとに区別
+	Type          string        // RSSの方式（RSS, Atomなど）
+	VersionNumber string        // バージョン番号（1.0, 2.0など）
+	Updated       time.Time     // フィードの更新日時
+	URL           string        `gorm:"unique"` // フィードのURLを保持する
+	LastFetched   time.Time     // 最後に取得に成功した時間（失敗しても進めない）
+	ETag          string        // 前回のレスポンスのETag（If-None-Matchで送る）
+	LastModified  string        // 前回のレスポンスのLast-Modified（If-Modified-Sinceで送る）
+	LastStatus    int           // 前回のHTTPステータス
+	UpdateHint    time.Duration // フィードのttl/sy:updatePeriodが示す更新間隔（serveの予定に使う）
+	Items         []RssItem     `gorm:"foreignKey:FeedID"`
 }
 
 // RSSアイテム（詳細）の構造
 type RssItem struct {
-	ID       uint `gorm:"primaryKey"`
-	FeedID   uint
-	Title    string
-	Link     string
-	Content  string
-	Content2 string `gorm:"type:text"`
+	ID         uint   `gorm:"primaryKey"`
+	FeedID     uint   `gorm:"index:idx_item_feed_key"`
+	ItemKey    string `gorm:"index:idx_item_feed_key"` // アイテムの識別子（GUID、リンク、内容のハッシュの順で決める）
+	GUID       string
+	Title      string
+	Link       string
+	Content    string             // 概要（item.Description）
+	Body       string             `gorm:"type:text"` // 本文（item.Content、content:encodedなど）
+	Content2   string             `gorm:"type:text"`
+	Published  time.Time          `gorm:"index"` // 公開日時（なければゼロ値）
+	Updated    time.Time          // 更新日時（なければゼロ値）
+	ImageURL   string             // アイテムの画像
+	Authors    []RssItemAuthor    `gorm:"foreignKey:ItemID"`
+	Categories []RssItemCategory  `gorm:"foreignKey:ItemID"`
+	Enclosures []RssItemEnclosure `gorm:"foreignKey:ItemID"`
+	State      *ItemState         `gorm:"foreignKey:ItemID"` // 既読などの状態（まだ操作していなければnil）
+	Tags       []ItemTag          `gorm:"foreignKey:ItemID"` // 利用者が付けたタグ
+	Hash       string             // 内容の変更を検出するためのハッシュ
+	InFeed     bool               // 最新のフィードに含まれているか（外れたアイテムも履歴として残す）
+	FirstSeen  time.Time          // 初めて取得した時間
+	LastSeen   time.Time          // 最後にフィードで見つかった時間
+	// 重複した記事の検出に使う
+	CanonicalURL string `gorm:"index;not null;default:''"` // 正規化したリンク
+	SimHash      int64  `gorm:"not null;default:0"`        // タイトルと本文のSimHash（0なら未計算）
+	ClusterID    uint   `gorm:"index;not null;default:0"`  // 同じ記事をまとめたStoryCluster（0ならどれにも属さない）
 }
 
 // RSS方式（Type）とバージョン番号を判別する関数
@@ -63,56 +90,245 @@ func isFeedUpdated(existingFeed RssFeed, feed *gofeed.Feed, updatedTime time.Tim
 		existingFeed.Description != feed.Description
 }
 
-// アイテムを保存または更新する処理
-func updateFeedItems(db *gorm.DB, feedID uint, feed *gofeed.Feed) error {
-	// 既存のアイテムを一度削除して新しいものを挿入
-	err := db.Where("feed_id = ?", feedID).Delete(&RssItem{}).Error
+// itemKey アイテムの識別子を求める。GUIDがなければリンク、それもなければ内容のハッシュを使う
+func itemKey(item *gofeed.Item) string {
+	if item.GUID != "" {
+		return item.GUID
+	}
+	if item.Link != "" {
+		return item.Link
+	}
+	return "hash:" + itemHash(item)
+}
+
+// itemHash アイテムの内容のハッシュを求める（GUIDもリンクもないアイテムの識別子に使う）
+func itemHash(item *gofeed.Item) string {
+	h := sha256.New()
+	for _, s := range []string{item.Title, item.Link, item.Description, item.Content} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// itemIndex 既存のアイテムを識別子とリンクで引くための索引
+type itemIndex struct {
+	byKey  map[string]*RssItem
+	byLink map[string]*RssItem
+}
+
+func newItemIndex(items []RssItem) *itemIndex {
+	idx := &itemIndex{byKey: map[string]*RssItem{}, byLink: map[string]*RssItem{}}
+	for i := range items {
+		idx.add(&items[i])
+	}
+	return idx
+}
+
+// add アイテムを索引に加える。リンクで引けるのは識別子を持たない古いアイテムだけ
+// （ポッドキャストのエピソードやライブブログのように、GUIDの違うアイテムが同じリンクを持つことがあるため）
+func (idx *itemIndex) add(item *RssItem) {
+	if item.ItemKey != "" {
+		idx.byKey[item.ItemKey] = item
+	} else if item.Link != "" {
+		idx.byLink[item.Link] = item
+	}
+}
+
+// find 識別子で探し、見つからなければ識別子を持たない古いアイテムをリンクで探す
+// リンクで見つけたアイテムはこの識別子のものとし、同じリンクの別のアイテムには使わない
+func (idx *itemIndex) find(key, link string) *RssItem {
+	if item, ok := idx.byKey[key]; ok {
+		return item
+	}
+	if item, ok := idx.byLink[link]; ok && link != "" {
+		delete(idx.byLink, link)
+		if key != "" {
+			idx.byKey[key] = item
+		}
+		return item
+	}
+	return nil
+}
+
+// itemsToArchive ページを保存する必要があるアイテム（新しいアイテムとリンクが変わったアイテム）を返す
+// フィードに更新がなければ何も返さない
+func itemsToArchive(db *gorm.DB, feed *gofeed.Feed, url string) ([]*gofeed.Item, error) {
+	var existingFeed RssFeed
+	res := db.Where("url = ?", url).Limit(1).Find(&existingFeed)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	var existing []RssItem
+	if res.RowsAffected > 0 {
+		if !isFeedUpdated(existingFeed, feed, feedUpdatedTime(feed)) {
+			return nil, nil
+		}
+		if err := db.Where("feed_id = ?", existingFeed.ID).Find(&existing).Error; err != nil {
+			return nil, err
+		}
+	}
+	idx := newItemIndex(existing)
+
+	// ルールでスキップするアイテムのページは保存しない
+	rules, err := loadRules(db, url)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// 新しいアイテムを挿入
+	var items []*gofeed.Item
 	for _, item := range feed.Items {
+		old := idx.find(itemKey(item), item.Link)
+		if item.Link == "" || (old != nil && old.Link == item.Link) {
+			continue
+		}
+		if old == nil && rules.evaluate(newRssItem(item)).Skip {
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
 
-		html, err := getHtml(item.Link)
+// ItemCounts フィードの取り込みで新規・更新・変更なし・スキップだったアイテムの数
+type ItemCounts struct {
+	New       int
+	Updated   int
+	Unchanged int
+	Skipped   int // ルールで保存しなかった新しいアイテム
+}
 
-		if err != nil {
+// アイテムを保存または更新する処理
+// 新しいアイテムだけを挿入し、内容が変わったアイテムは更新する。フィードから外れたアイテムは削除せずに残す
+// archivesにはitemsToArchiveのアイテムについて保存したページ（識別子ごと）を渡す
+// フィードの保存と同じトランザクション（upsertFeedByURL）の中で呼ぶ
+func updateFeedItems(tx *gorm.DB, feedID uint, feedURL string, feed *gofeed.Feed, archives map[string]string) (ItemCounts, error) {
+	var counts ItemCounts
+
+	// 新しいアイテムに適用するルール
+	rules, err := loadRules(tx, feedURL)
+	if err != nil {
+		return counts, err
+	}
+
+	// 既存のアイテムを取得
+	var existing []RssItem
+	if err := tx.Where("feed_id = ?", feedID).Find(&existing).Error; err != nil {
+		return counts, err
+	}
+	idx := newItemIndex(existing)
+
+	now := time.Now()
+	seen := map[uint]bool{}
+	for _, item := range feed.Items {
+		key := itemKey(item)
+		fields := newRssItem(item)
+		fields.Hash = itemContentHash(fields)
+		old := idx.find(key, item.Link)
+
+		// 新しいアイテムを著者・カテゴリ・添付ファイルとともに挿入
+		// ルールでスキップするアイテムは保存しない（次の取り込みでも新しいアイテムとしてまたスキップされる）
+		if old == nil {
+			result := rules.evaluate(fields)
+			if result.Skip {
+				counts.Skipped++
+				continue
+			}
+			rssItem := fields
+			rssItem.FeedID = feedID
+			rssItem.ItemKey = key
+			rssItem.Content2 = archives[key]
+			rssItem.InFeed = true
+			rssItem.FirstSeen = now
+			rssItem.LastSeen = now
+			if err := tx.Create(&rssItem).Error; err != nil {
+				return ItemCounts{}, err
+			}
+			if err := indexItem(tx, rssItem.ID); err != nil {
+				return ItemCounts{}, err
+			}
+			if err := applyRuleResult(tx, rssItem.ID, result); err != nil {
+				return ItemCounts{}, err
+			}
+			// 他のフィードに同じ記事があればまとめる
+			if err := clusterItem(tx, &rssItem, defaultClusterOptions); err != nil {
+				return ItemCounts{}, err
+			}
+			idx.add(&rssItem)
+			seen[rssItem.ID] = true
+			counts.New++
 			continue
 		}
 
-		rssItem := RssItem{
-			FeedID:   feedID,
-			Title:    item.Title,
-			Link:     item.Link,
-			Content:  item.Description,
-			Content2: html,
+		// 既存のアイテムは、内容が変わっていれば更新する
+		seen[old.ID] = true
+		updates := map[string]interface{}{
+			"item_key":  key,
+			"in_feed":   true,
+			"last_seen": now,
 		}
-		if err := db.Create(&rssItem).Error; err != nil {
-			return err
+		// メタデータを持たない古いアイテムもハッシュが変わるので、ここで埋められる
+		if old.Hash != fields.Hash {
+			for k, v := range itemColumns(fields) {
+				updates[k] = v
+			}
+			if err := replaceItemMetadata(tx, old.ID, fields); err != nil {
+				return ItemCounts{}, err
+			}
+			counts.Updated++
+		} else {
+			counts.Unchanged++
+		}
+		html, archived := archives[key]
+		if archived {
+			updates["content2"] = html
+		}
+		if err := tx.Model(&RssItem{}).Where("id = ?", old.ID).Updates(updates).Error; err != nil {
+			return ItemCounts{}, err
+		}
+		// 検索インデックスは内容か保存したページが変わったときだけ登録し直す
+		if old.Hash != fields.Hash || archived {
+			if err := indexItem(tx, old.ID); err != nil {
+				return ItemCounts{}, err
+			}
 		}
 	}
 
-	return nil
+	// フィードから外れたアイテムは履歴として残し、印だけを付ける
+	var dropped []uint
+	for _, item := range existing {
+		if item.InFeed && !seen[item.ID] {
+			dropped = append(dropped, item.ID)
+		}
+	}
+	if len(dropped) > 0 {
+		err := tx.Model(&RssItem{}).Where("id IN ?", dropped).Update("in_feed", false).Error
+		if err != nil {
+			return ItemCounts{}, err
+		}
+	}
+	return counts, nil
 }
 
 // フィードを更新する処理
-func updateFeed(db *gorm.DB, existingFeed *RssFeed, feed *gofeed.Feed, updatedTime time.Time) error {
+func updateFeed(db *gorm.DB, existingFeed *RssFeed, feed *gofeed.Feed, updatedTime time.Time, archives map[string]string) (ItemCounts, error) {
 	existingFeed.Title = feed.Title
 	existingFeed.Description = feed.Description
 	existingFeed.Updated = updatedTime
 	existingFeed.LastFetched = time.Now()
 
-	// データベースにフィードを更新
+	// データベースにフィードを更新（アイテムと同じトランザクション）
 	if err := db.Save(existingFeed).Error; err != nil {
-		return err
+		return ItemCounts{}, err
 	}
 
 	// アイテムの更新
-	return updateFeedItems(db, existingFeed.ID, feed)
+	return updateFeedItems(db, existingFeed.ID, existingFeed.URL, feed, archives)
 }
 
 // フィードを新規作成する処理
-func createFeed(db *gorm.DB, feed *gofeed.Feed, url string, updatedTime time.Time) error {
+func createFeed(db *gorm.DB, feed *gofeed.Feed, url string, updatedTime time.Time, archives map[string]string) (ItemCounts, error) {
 	// RSS方式とバージョン番号を取得
 	feedType, versionNumber := getRSSTypeAndVersion(feed)
 
@@ -130,45 +346,72 @@ func createFeed(db *gorm.DB, feed *gofeed.Feed, url string, updatedTime time.Tim
 
 	// フィードを保存
 	if err := db.Create(&newFeed).Error; err != nil {
-		return err
+		return ItemCounts{}, err
 	}
 
 	// アイテムの挿入
-	return updateFeedItems(db, newFeed.ID, feed)
+	return updateFeedItems(db, newFeed.ID, url, feed, archives)
 }
 
-// フィードの挿入または更新処理
-func upsertFeedByURL(db *gorm.DB, feed *gofeed.Feed, url string) error {
-	// フィードの更新日時を取得
-	updatedTime := time.Now()
+// feedUpdatedTime フィードの更新日時を取得（なければ現在時刻）
+func feedUpdatedTime(feed *gofeed.Feed) time.Time {
 	if feed.UpdatedParsed != nil {
-		updatedTime = *feed.UpdatedParsed
+		return *feed.UpdatedParsed
 	}
+	return time.Now()
+}
 
-	// URLを基準にして既存フィードを検索
-	var existingFeed RssFeed
-	result := db.Where("url = ?", url).First(&existingFeed)
-
-	if result.Error == nil {
-		// フィードが存在する場合、更新が必要かチェック
-		if !isFeedUpdated(existingFeed, feed, updatedTime) {
-			fmt.Println("フィードの更新なし。スキップします。")
-			return nil
+// フィードの挿入または更新処理。取り込んだアイテムの数を返す
+// フィードとアイテムの保存は1つのトランザクションで行い、途中で失敗したら何も変えない
+func upsertFeedByURL(db *gorm.DB, feed *gofeed.Feed, url string, archives map[string]string) (ItemCounts, error) {
+	// フィードの更新日時を取得
+	updatedTime := feedUpdatedTime(feed)
+
+	var counts ItemCounts
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// URLを基準にして既存フィードを検索
+		var existingFeed RssFeed
+		result := tx.Where("url = ?", url).Limit(1).Find(&existingFeed)
+		if result.Error != nil {
+			return result.Error
 		}
 
-		// フィードの更新処理
-		return updateFeed(db, &existingFeed, feed, updatedTime)
-	} else if result.Error == gorm.ErrRecordNotFound {
-		// 新規フィードの作成処理
-		return createFeed(db, feed, url, updatedTime)
+		var err error
+		if result.RowsAffected > 0 {
+			// フィードが存在する場合、更新が必要かチェック
+			if !isFeedUpdated(existingFeed, feed, updatedTime) {
+				fmt.Println("フィードの更新なし。スキップします。")
+				counts = ItemCounts{Unchanged: len(feed.Items)}
+				return nil
+			}
+
+			// フィードの更新処理
+			counts, err = updateFeed(tx, &existingFeed, feed, updatedTime, archives)
+		} else {
+			// 新規フィードの作成処理
+			counts, err = createFeed(tx, feed, url, updatedTime, archives)
+		}
+		return err
+	})
+	if err != nil {
+		return ItemCounts{}, err
 	}
+	return counts, nil
+}
 
-	return result.Error
+// httpGet ctxでキャンセルできるGETリクエストを送る
+func httpGet(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	return http.DefaultClient.Do(req)
 }
 
 // URLから画像を取得し、Base64に変換する関数
-func imageToBase64(imageURL string) (string, error) {
-	resp, err := http.Get(imageURL)
+func imageToBase64(ctx context.Context, imageURL string) (string, error) {
+	resp, err := httpGet(ctx, imageURL)
 	if err != nil {
 		return "", err
 	}
@@ -186,8 +429,8 @@ func imageToBase64(imageURL string) (string, error) {
 }
 
 // 外部CSSファイルをインライン化する関数
-func inlineCSS(url string) (string, error) {
-	resp, err := http.Get(url)
+func inlineCSS(ctx context.Context, url string) (string, error) {
+	resp, err := httpGet(ctx, url)
 	if err != nil {
 		return "", err
 	}
@@ -202,8 +445,8 @@ func inlineCSS(url string) (string, error) {
 }
 
 // 外部JavaScriptファイルをインライン化する関数
-func inlineJS(url string) (string, error) {
-	resp, err := http.Get(url)
+func inlineJS(ctx context.Context, url string) (string, error) {
+	resp, err := httpGet(ctx, url)
 	if err != nil {
 		return "", err
 	}
@@ -232,18 +475,21 @@ func toAbsoluteURL(baseURL, relativeURL string) string {
 	return base.ResolveReference(u).String()
 }
 
-func getHtml(pageURL string) (string, error) {
+func getHtml(ctx context.Context, pageURL string) (string, error) {
 	// URLからHTMLを取得
-	resp, err := http.Get(pageURL)
+	resp, err := httpGet(ctx, pageURL)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", &statusError{Code: resp.StatusCode, Status: resp.Status}
+	}
 
 	// goqueryでHTMLを解析
 	doc, err := goquery.NewDocumentFromReader(resp.Body)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 
 	// CSSリンクをインライン化
@@ -251,7 +497,7 @@ func getHtml(pageURL string) (string, error) {
 		href, exists := s.Attr("href")
 		if exists {
 			absoluteHref := toAbsoluteURL(pageURL, href)
-			css, err := inlineCSS(absoluteHref)
+			css, err := inlineCSS(ctx, absoluteHref)
 			if err == nil {
 				s.ReplaceWithHtml(css)
 			}
@@ -263,7 +509,7 @@ func getHtml(pageURL string) (string, error) {
 		src, exists := s.Attr("src")
 		if exists {
 			absoluteSrc := toAbsoluteURL(pageURL, src)
-			js, err := inlineJS(absoluteSrc)
+			js, err := inlineJS(ctx, absoluteSrc)
 			if err == nil {
 				s.ReplaceWithHtml(js)
 			}
@@ -275,7 +521,7 @@ func getHtml(pageURL string) (string, error) {
 		src, exists := s.Attr("src")
 		if exists {
 			absoluteSrc := toAbsoluteURL(pageURL, src)
-			base64Data, err := imageToBase64(absoluteSrc)
+			base64Data, err := imageToBase64(ctx, absoluteSrc)
 			if err == nil {
 				s.SetAttr("src", base64Data)
 			}
@@ -322,52 +568,136 @@ func exportContentToHTML(db *gorm.DB) error {
 	return nil
 }
 
+// migrateDB テーブルを作成・更新し、全文検索のインデックスを用意する。購読のテーブルを新しく作った場合はtrueを返す
+func migrateDB(db *gorm.DB) (bool, error) {
+	created := !db.Migrator().HasTable(&Subscription{})
+	err := db.AutoMigrate(&RssFeed{}, &RssItem{}, &RssItemAuthor{}, &RssItemCategory{}, &RssItemEnclosure{}, &ItemState{}, &ItemTag{}, &Subscription{}, &FetchLog{}, &Rule{}, &StoryCluster{}, &NotifyTarget{}, &Notification{})
+	if err != nil {
+		return false, err
+	}
+	if err := setupSearchIndex(db); err != nil {
+		return false, fmt.Errorf("failed to create search index: %v", err)
+	}
+	return created, nil
+}
+
 func main() {
 	// SQLiteデータベース接続
-	db, err := gorm.Open(sqlite.Open("rss.db"), &gorm.Config{})
+	// 他のプロセスが書き込み中でもすぐにエラーにせず、しばらく待つ
+	db, err := gorm.Open(sqlite.Open("rss.db?_busy_timeout=5000"), &gorm.Config{})
 	if err != nil {
 		log.Fatal("failed to connect database")
 	}
 
 	// テーブルのマイグレーション（自動生成）
-	err = db.AutoMigrate(&RssFeed{}, &RssItem{})
+	// 購読のテーブルを初めて作るときだけ既定のフィードを登録する（すべて削除した後に戻らないように）
+	created, err := migrateDB(db)
 	if err != nil {
-		log.Fatal("failed to migrate database schema")
-	}
-
-	// フィードパーサーの初期化
-	fp := gofeed.NewParser()
-
-	// 複数のRSSフィードURL
-	urls := []string{
-		"https://rss.nytimes.com/services/xml/rss/nyt/World.xml",
-		"https://feeds.bbci.co.uk/news/world/rss.xml",
-		"https://www.npr.org/rss/rss.php?id=1001",
-		"http://rss.cnn.com/rss/cnn_topstories.rss",
-		"http://feeds.reuters.com/reuters/topNews",
-		"https://www.theguardian.com/world/rss",
-		"https://www.aljazeera.com/xml/rss/all.xml",
-		"https://hnrss.org/frontpage",
-		"http://feeds.feedburner.com/TechCrunch/",
-		"https://xkcd.com/atom.xml", // 特定のフィード
-	}
-
-	// 各URLのフィードを取得して処理
-	for _, url := range urls {
-		//fmt.Printf("Fetching feed from: %s\n", url)
-		feed, err := fp.ParseURL(url)
-		if err != nil {
-			fmt.Printf("Failed to fetch feed: %s\n", err)
-			continue
+		log.Fatal("failed to migrate database schema: ", err)
+	}
+	if created {
+		if err := seedSubscriptions(db); err != nil {
+			log.Fatal("failed to add default subscriptions: ", err)
 		}
+	}
+
+	// サブコマンドの実行（指定がなければフィードを取得する）
+	args := os.Args[1:]
+	if len(args) == 0 {
+		args = []string{"fetch"}
+	}
+	if err := runCommand(db, args[0], args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runCommand サブコマンドを実行する
+func runCommand(db *gorm.DB, name string, args []string) error {
+	switch name {
+	case "fetch":
+		return fetchFeeds(db, args)
+	case "add":
+		return addSubscription(db, args)
+	case "remove":
+		return removeSubscription(db, args)
+	case "list":
+		return listSubscriptions(db)
+	case "enable":
+		return setSubscriptionEnabled(db, args, true)
+	case "disable":
+		return setSubscriptionEnabled(db, args, false)
+	case "import":
+		return importOPML(db, args)
+	case "export":
+		return exportOPML(db, args)
+	case "serve":
+		return serve(db, args)
+	case "health":
+		return feedsHealth(db, args)
+	case "items":
+		return listItems(db, args)
+	case "search":
+		return searchCommand(db, args)
+	case "mark":
+		return markItems(db, args)
+	case "tag":
+		return tagItem(db, args, false)
+	case "untag":
+		return tagItem(db, args, true)
+	case "reader":
+		return runReader(db, args)
+	case "api":
+		return serveAPI(db, args)
+	case "publish":
+		return publishFeed(db, args)
+	case "rule":
+		return ruleCommand(db, args)
+	case "notify":
+		return notifyCommand(db, args)
+	case "cluster":
+		return clusterCommand(db, args)
+	case "discover":
+		return discoverCommand(args)
+	default:
+		return fmt.Errorf("unknown command: %s", name)
+	}
+}
+
+// fetchFeeds 有効な購読フィードを並列に取得してデータベースに保存する
+// 使い方: fetch [-concurrency 4] [-host-interval 1s] [-timeout 30s] [-retries 3] ...
+func fetchFeeds(db *gorm.DB, args []string) error {
+	opts := defaultFetchOptions
+	fs := flag.NewFlagSet("fetch", flag.ContinueOnError)
+	opts.addFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var subs []Subscription
+	if err := db.Where("enabled = ?", true).Find(&subs).Error; err != nil {
+		return err
+	}
 
-		// フィードの挿入または更新（URLを基準に）
-		err = upsertFeedByURL(db, feed, url)
+	// 取得間隔を過ぎた購読だけを対象にする
+	var urls []string
+	for _, sub := range subs {
+		due, err := isSubscriptionDue(db, sub)
 		if err != nil {
-			fmt.Printf("Failed to upsert feed: %s\n", err)
+			return err
+		}
+		if due {
+			urls = append(urls, sub.URL)
 		}
 	}
 
+	// 各購読のフィードを並列に取得して処理
+	NewFetcher(db, opts).Run(context.Background(), urls)
+
+	// ルールにマッチした新しいアイテムの通知を送る（失敗したものは次の取得のときに再送する）
+	if err := deliverNotifications(context.Background(), db, false); err != nil {
+		return err
+	}
+
 	//// データベースのRssItemをHTMLにエクスポート
 	//err = exportContentToHTML(db)
 	//if err != nil {
@@ -375,4 +705,5 @@ func main() {
 	//}
 
 	fmt.Println("すべてのRSSフィードURLとデータベース操作が完了しました。")
+	return nil
 }
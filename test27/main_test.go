@@ -0,0 +1,100 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/mmcdole/gofeed"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestDB 一時ディレクトリにマイグレーション済みのrss.dbを作る（既定の購読は登録しない）
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rss.db")
+	db, err := gorm.Open(sqlite.Open(path+"?_busy_timeout=5000"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
+
+// feedItemTitles フィードのアイテムのタイトルをGUIDごとにまとめる
+func feedItemTitles(t *testing.T, db *gorm.DB) map[string]string {
+	t.Helper()
+	var items []RssItem
+	if err := db.Find(&items).Error; err != nil {
+		t.Fatal(err)
+	}
+	m := map[string]string{}
+	for _, item := range items {
+		m[item.ItemKey] = item.Title
+	}
+	return m
+}
+
+func TestUpsertKeepsItemsSharingALink(t *testing.T) {
+	db := newTestDB(t)
+	const url = "https://example.com/podcast.xml"
+	feed := &gofeed.Feed{Title: "Podcast", Items: []*gofeed.Item{
+		{GUID: "ep-1", Title: "Episode 1", Link: "https://example.com/show"},
+		{GUID: "ep-2", Title: "Episode 2", Link: "https://example.com/show"},
+	}}
+	counts, err := upsertFeedByURL(db, feed, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts.New != 2 {
+		t.Fatalf("first fetch: %+v, want 2 new items", counts)
+	}
+
+	// 同じリンクの新しいエピソードが増えても、既存のエピソードを上書きしない
+	feed.Items = append(feed.Items, &gofeed.Item{GUID: "ep-3", Title: "Episode 3", Link: "https://example.com/show"})
+	counts, err = upsertFeedByURL(db, feed, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts.New != 1 || counts.Updated != 0 || counts.Unchanged != 2 {
+		t.Fatalf("second fetch: %+v, want 1 new and 2 unchanged", counts)
+	}
+	want := map[string]string{"ep-1": "Episode 1", "ep-2": "Episode 2", "ep-3": "Episode 3"}
+	if got := feedItemTitles(t, db); len(got) != 3 || got["ep-1"] != want["ep-1"] || got["ep-2"] != want["ep-2"] || got["ep-3"] != want["ep-3"] {
+		t.Fatalf("items = %v, want %v", got, want)
+	}
+}
+
+func TestUpsertMatchesLegacyItemByLink(t *testing.T) {
+	db := newTestDB(t)
+	const url = "https://example.com/feed.xml"
+	feed := &gofeed.Feed{Title: "Blog", Items: []*gofeed.Item{{GUID: "post-1", Title: "Post", Link: "https://example.com/post"}}}
+	if _, err := upsertFeedByURL(db, feed, url, nil); err != nil {
+		t.Fatal(err)
+	}
+	// 識別子を保存していなかった以前のバージョンのアイテム
+	if err := db.Model(&RssItem{}).Where("1 = 1").Update("item_key", "").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	feed.Items[0].Title = "Post (updated)"
+	counts, err := upsertFeedByURL(db, feed, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts.New != 0 || counts.Updated != 1 {
+		t.Fatalf("counts = %+v, want the legacy item to be updated", counts)
+	}
+	if got := feedItemTitles(t, db); len(got) != 1 || got["post-1"] != "Post (updated)" {
+		t.Fatalf("items = %v", got)
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 通知の送信の設定
+const (
+	notifyTimeout     = 30 * time.Second // 1回の送信（Webhookまたはコマンド）のタイムアウト
+	notifyMaxAttempts = 5                // これだけ失敗したら諦める
+	notifyRetryDelay  = time.Minute      // 最初の再送までの時間（失敗するたびに倍にする）
+	notifyBatchSize   = 100              // 1回に送る通知の上限
+)
+
+// 通知の状態
+const (
+	notificationPending = "pending" // 未送信（失敗して再送を待っているものを含む）
+	notificationSent    = "sent"
+	notificationFailed  = "failed" // notifyMaxAttempts回失敗した
+)
+
+// NotifyTarget 通知の送り先。ルールの動作notifyで名前を指定する
+type NotifyTarget struct {
+	ID        uint   `gorm:"primaryKey"`
+	Name      string `gorm:"uniqueIndex"`
+	URL       string // WebhookのURL（POSTでJSONを送る）
+	Secret    string // 空でなければWebhookの本文のHMAC-SHA256の署名を付ける
+	Command   string // 実行するコマンド（標準入力にJSONを渡す）
+	CreatedAt time.Time
+}
+
+// Notification 送り先ごとのアイテムの通知。同じアイテムを同じ送り先に2回送らないよう組で一意にする
+type Notification struct {
+	ID          uint      `gorm:"primaryKey"`
+	TargetID    uint      `gorm:"uniqueIndex:idx_notification_target_item"`
+	ItemID      uint      `gorm:"uniqueIndex:idx_notification_target_item"`
+	Status      string    `gorm:"index;not null;default:'pending'"`
+	Attempts    int       `gorm:"not null;default:0"`
+	NextAttempt time.Time // この時間を過ぎたら（再）送信する
+	LastError   string
+	SentAt      time.Time
+	CreatedAt   time.Time
+}
+
+// NotificationPayload 送り先に渡すJSON
+type NotificationPayload struct {
+	Event  string    `json:"event"` // 常に"item.new"
+	ID     uint      `json:"id"`    // 通知のID（再送でも変わらないので、受け取る側で重複を除ける）
+	Target string    `json:"target"`
+	Feed   APIFeed   `json:"feed"`
+	Item   APIItem   `json:"item"`
+	SentAt time.Time `json:"sent_at"`
+}
+
+// kind 送り先の種類（webhookまたはcommand）
+func (t NotifyTarget) kind() string {
+	if t.Command != "" {
+		return "command"
+	}
+	return "webhook"
+}
+
+// validate 送り先の名前があり、WebhookのURLかコマンドのどちらか一方だけが指定されているか調べる
+func (t NotifyTarget) validate() error {
+	if t.Name == "" {
+		return errors.New("name is empty")
+	}
+	if (t.URL == "") == (t.Command == "") {
+		return errors.New("specify either -webhook or -command")
+	}
+	if t.URL != "" {
+		u, err := url.Parse(t.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhook URL: %s", t.URL)
+		}
+	}
+	if t.Secret != "" && t.Command != "" {
+		return errors.New("-secret is only for webhooks")
+	}
+	return nil
+}
+
+// queueNotifications 保存したアイテムの通知を送り先ごとに記録する（送信は取り込みのトランザクションの後）
+func queueNotifications(tx *gorm.DB, itemID uint, targets []string) error {
+	for _, name := range targets {
+		var target NotifyTarget
+		res := tx.Where("name = ?", name).Limit(1).Find(&target)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			// ルールを追加した後で送り先を削除した場合
+			log.Printf("notify: unknown target %q", name)
+			continue
+		}
+		// すでに記録してあれば何もしない（一意のインデックスで重複を防ぐ）
+		n := Notification{TargetID: target.ID, ItemID: itemID, Status: notificationPending, NextAttempt: time.Now()}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&n).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliverNotifications 送信時刻を過ぎた未送信の通知を送る。all（notify deliver -all）なら再送を待っているものも今送る
+// 失敗した通知は間隔を倍にしながらnotifyMaxAttempts回まで再送する
+func deliverNotifications(ctx context.Context, db *gorm.DB, all bool) error {
+	q := db.Where("status = ?", notificationPending)
+	if !all {
+		q = q.Where("julianday(next_attempt) <= julianday(?)", time.Now())
+	}
+	var pending []Notification
+	if err := q.Order("id").Limit(notifyBatchSize).Find(&pending).Error; err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: notifyTimeout}
+	targets := map[uint]*NotifyTarget{}
+	for _, n := range pending {
+		if ctx.Err() != nil {
+			return nil
+		}
+		target, ok := targets[n.TargetID]
+		if !ok {
+			var t NotifyTarget
+			res := db.Where("id = ?", n.TargetID).Limit(1).Find(&t)
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected > 0 {
+				target = &t
+			}
+			targets[n.TargetID] = target
+		}
+
+		var err error
+		if target == nil {
+			err = errors.New("target was removed")
+		} else {
+			err = sendNotification(ctx, db, client, *target, n)
+		}
+		if err != nil && ctx.Err() != nil {
+			// 終了するために打ち切った送信は失敗に数えない
+			return nil
+		}
+
+		n.Attempts++
+		updates := map[string]interface{}{"attempts": n.Attempts}
+		switch {
+		case err == nil:
+			updates["status"] = notificationSent
+			updates["sent_at"] = time.Now()
+			updates["last_error"] = ""
+		case target == nil || n.Attempts >= notifyMaxAttempts:
+			updates["status"] = notificationFailed
+			updates["last_error"] = err.Error()
+		default:
+			updates["next_attempt"] = time.Now().Add(notifyRetryDelay << uint(n.Attempts-1))
+			updates["last_error"] = err.Error()
+		}
+		if err != nil {
+			log.Printf("notify: #%d to %s (attempt %d): %v", n.ID, targetName(target), n.Attempts, err)
+		}
+		if err := db.Model(&Notification{}).Where("id = ?", n.ID).Updates(updates).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// targetName ログに出す送り先の名前
+func targetName(t *NotifyTarget) string {
+	if t == nil {
+		return "(removed)"
+	}
+	return t.Name
+}
+
+// sendNotification 通知のアイテムをJSONにして送り先に送る
+func sendNotification(ctx context.Context, db *gorm.DB, client *http.Client, target NotifyTarget, n Notification) error {
+	payload, err := notificationPayload(db, target, n)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+	if target.Command != "" {
+		return runNotifyCommand(ctx, target.Command, body)
+	}
+	return postWebhook(ctx, client, target, n.ID, body)
+}
+
+// notificationPayload 通知で送るフィードとアイテム（保存したページは含めない）
+func notificationPayload(db *gorm.DB, target NotifyTarget, n Notification) (NotificationPayload, error) {
+	var item RssItem
+	res := db.Omit("content2").
+		Preload("Authors").Preload("Categories").Preload("Enclosures").Preload("State").Preload("Tags").
+		Where("id = ?", n.ItemID).Limit(1).Find(&item)
+	if res.Error != nil {
+		return NotificationPayload{}, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return NotificationPayload{}, fmt.Errorf("item %d not found", n.ItemID)
+	}
+	var archived int64
+	if err := db.Model(&RssItem{}).Where("id = ? AND content2 <> ''", item.ID).Count(&archived).Error; err != nil {
+		return NotificationPayload{}, err
+	}
+
+	var feed RssFeed
+	if err := db.Where("id = ?", item.FeedID).Limit(1).Find(&feed).Error; err != nil {
+		return NotificationPayload{}, err
+	}
+	// 購読がなければ（購読を削除した後の再送など）フィードの情報だけを送る
+	var sub Subscription
+	res = db.Where("url = ?", feed.URL).Limit(1).Find(&sub)
+	if res.Error != nil {
+		return NotificationPayload{}, res.Error
+	}
+	if res.RowsAffected == 0 {
+		sub = Subscription{URL: feed.URL}
+	}
+	apiFeed := newAPIFeed(sub, &feed)
+
+	return NotificationPayload{
+		Event:  "item.new",
+		ID:     n.ID,
+		Target: target.Name,
+		Feed:   apiFeed,
+		Item:   newAPIItem(item, archived > 0),
+		SentAt: time.Now().UTC(),
+	}, nil
+}
+
+// signPayload Webhookの本文のHMAC-SHA256の署名（"sha256="と16進数）
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook JSONをWebhookのURLにPOSTする。2xx以外の応答は失敗にする
+// 受け取る側はX-RSS-SignatureをSecretで検証し、X-RSS-Delivery（通知のID）で重複を除ける
+func postWebhook(ctx context.Context, client *http.Client, target NotifyTarget, id uint, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("X-RSS-Event", "item.new")
+	req.Header.Set("X-RSS-Delivery", strconv.FormatUint(uint64(id), 10))
+	if target.Secret != "" {
+		req.Header.Set("X-RSS-Signature", signPayload(target.Secret, body))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// shellCommand コマンドの文字列をOSのシェルで実行するコマンドにする
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
+
+// runNotifyCommand コマンドの標準入力にJSONを渡して実行する。終了コードが0でなければ失敗にする
+func runNotifyCommand(ctx context.Context, command string, body []byte) error {
+	cmd := shellCommand(ctx, command)
+	cmd.Stdin = bytes.NewReader(body)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			if len(msg) > 200 {
+				msg = msg[:200] + "..."
+			}
+			return fmt.Errorf("%v: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// notifyCommand 通知の送り先を追加・一覧・削除し、未送信の通知を送る
+// 使い方: notify add -webhook URL [-secret S] 名前 / notify add -command "コマンド" 名前 / notify list / notify remove 名前 / notify deliver [-all] [-failed]
+func notifyCommand(db *gorm.DB, args []string) error {
+	usage := errors.New(`usage: notify add -webhook URL [-secret SECRET] NAME | notify add -command "COMMAND" NAME | notify list | notify remove NAME | notify deliver [-all] [-failed]`)
+	if len(args) == 0 {
+		return usage
+	}
+	switch args[0] {
+	case "add":
+		var t NotifyTarget
+		fs := flag.NewFlagSet("notify add", flag.ContinueOnError)
+		fs.StringVar(&t.URL, "webhook", "", "URL to POST the item JSON to")
+		fs.StringVar(&t.Secret, "secret", "", "sign webhook bodies with HMAC-SHA256 using this secret")
+		fs.StringVar(&t.Command, "command", "", "shell command to run with the item JSON on stdin")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return usage
+		}
+		t.Name = strings.TrimSpace(fs.Arg(0))
+		if err := t.validate(); err != nil {
+			return err
+		}
+		var count int64
+		if err := db.Model(&NotifyTarget{}).Where("name = ?", t.Name).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("notify target already exists: %s", t.Name)
+		}
+		if err := db.Create(&t).Error; err != nil {
+			return err
+		}
+		fmt.Printf("Added %s target %s\n", t.kind(), t.Name)
+		return nil
+
+	case "list":
+		var targets []NotifyTarget
+		if err := db.Order("name").Find(&targets).Error; err != nil {
+			return err
+		}
+		for _, t := range targets {
+			var counts []struct {
+				Status string
+				Count  int
+			}
+			err := db.Model(&Notification{}).Select("status, COUNT(*) AS count").
+				Where("target_id = ?", t.ID).Group("status").Scan(&counts).Error
+			if err != nil {
+				return err
+			}
+			byStatus := map[string]int{}
+			for _, c := range counts {
+				byStatus[c.Status] = c.Count
+			}
+			dest := t.URL
+			if t.Command != "" {
+				dest = t.Command
+			}
+			if t.Secret != "" {
+				dest += " (signed)"
+			}
+			fmt.Printf("%-16s %-7s %s  sent %d, pending %d, failed %d\n", t.Name, t.kind(), dest,
+				byStatus[notificationSent], byStatus[notificationPending], byStatus[notificationFailed])
+		}
+		return nil
+
+	case "remove":
+		if len(args) != 2 {
+			return usage
+		}
+		var target NotifyTarget
+		res := db.Where("name = ?", args[1]).Limit(1).Find(&target)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("notify target not found: %s", args[1])
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("target_id = ?", target.ID).Delete(&Notification{}).Error; err != nil {
+				return err
+			}
+			return tx.Delete(&target).Error
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Removed notify target %s\n", target.Name)
+		return nil
+
+	case "deliver":
+		fs := flag.NewFlagSet("notify deliver", flag.ContinueOnError)
+		all := fs.Bool("all", false, "send pending notifications now instead of waiting for the retry delay")
+		failed := fs.Bool("failed", false, "retry notifications that gave up after too many attempts")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *failed {
+			err := db.Model(&Notification{}).Where("status = ?", notificationFailed).
+				Updates(map[string]interface{}{"status": notificationPending, "attempts": 0, "next_attempt": time.Now()}).Error
+			if err != nil {
+				return err
+			}
+		}
+		if err := deliverNotifications(context.Background(), db, *all); err != nil {
+			return err
+		}
+		var pending int64
+		if err := db.Model(&Notification{}).Where("status = ?", notificationPending).Count(&pending).Error; err != nil {
+			return err
+		}
+		fmt.Printf("%d notifications pending\n", pending)
+		return nil
+	}
+	return usage
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"gorm.io/gorm"
+)
+
+// webhookRequest Webhookが受け取ったリクエスト
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// webhookServer 最初のfailures回は500を返し、その後は204を返すWebhook
+type webhookServer struct {
+	mu       sync.Mutex
+	failures int
+	requests []webhookRequest
+}
+
+func (s *webhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, webhookRequest{header: r.Header.Clone(), body: body})
+	if len(s.requests) <= s.failures {
+		http.Error(w, "temporarily broken", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// received 受け取ったリクエストの写し
+func (s *webhookServer) received() []webhookRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]webhookRequest(nil), s.requests...)
+}
+
+// queueTestNotification アイテムを1件取り込み、WebhookのURLの送り先への通知を記録する
+func queueTestNotification(t *testing.T, db *gorm.DB, webhookURL, secret string) Notification {
+	t.Helper()
+	feed := &gofeed.Feed{Title: "Blog", Items: []*gofeed.Item{{GUID: "post-1", Title: "New post", Link: "https://example.com/1"}}}
+	if _, err := upsertFeedByURL(db, feed, "https://example.com/feed.xml", nil); err != nil {
+		t.Fatal(err)
+	}
+	var item RssItem
+	if err := db.Where("item_key = ?", "post-1").First(&item).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&NotifyTarget{Name: "hook", URL: webhookURL, Secret: secret}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := queueNotifications(db, item.ID, []string{"hook"}); err != nil {
+		t.Fatal(err)
+	}
+	var n Notification
+	if err := db.First(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// loadNotification 通知を読み直す
+func loadNotification(t *testing.T, db *gorm.DB, id uint) Notification {
+	t.Helper()
+	var n Notification
+	if err := db.First(&n, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestWebhookSignatureAndRetry(t *testing.T) {
+	db := newTestDB(t)
+	hook := &webhookServer{failures: 1}
+	srv := httptest.NewServer(hook)
+	defer srv.Close()
+	const secret = "s3cret"
+	n := queueTestNotification(t, db, srv.URL, secret)
+	ctx := context.Background()
+
+	// 1回目は500なので、1分後に再送する
+	before := time.Now()
+	if err := deliverNotifications(ctx, db, false); err != nil {
+		t.Fatal(err)
+	}
+	got := loadNotification(t, db, n.ID)
+	if got.Status != notificationPending || got.Attempts != 1 || !strings.Contains(got.LastError, "500") {
+		t.Fatalf("after a 500: %+v", got)
+	}
+	if wait := got.NextAttempt.Sub(before); wait < notifyRetryDelay || wait > notifyRetryDelay+time.Minute {
+		t.Errorf("next attempt in %v, want about %v", wait, notifyRetryDelay)
+	}
+
+	// 再送の時刻まではそのまま
+	if err := deliverNotifications(ctx, db, false); err != nil {
+		t.Fatal(err)
+	}
+	if requests := hook.received(); len(requests) != 1 {
+		t.Fatalf("sent %d times before the retry delay, want 1", len(requests))
+	}
+
+	// 時刻が来たら再送して送信済みにする
+	if err := db.Model(&Notification{}).Where("id = ?", n.ID).Update("next_attempt", time.Now().Add(-time.Second)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := deliverNotifications(ctx, db, false); err != nil {
+		t.Fatal(err)
+	}
+	got = loadNotification(t, db, n.ID)
+	if got.Status != notificationSent || got.Attempts != 2 || got.LastError != "" || got.SentAt.IsZero() {
+		t.Fatalf("after the retry: %+v", got)
+	}
+
+	requests := hook.received()
+	if len(requests) != 2 {
+		t.Fatalf("webhook received %d requests, want 2", len(requests))
+	}
+	for i, req := range requests {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(req.body)
+		if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); req.header.Get("X-RSS-Signature") != want {
+			t.Errorf("request %d: X-RSS-Signature = %q, want %q", i, req.header.Get("X-RSS-Signature"), want)
+		}
+		// 再送でも通知のIDは変わらない
+		if got := req.header.Get("X-RSS-Delivery"); got != strconv.FormatUint(uint64(n.ID), 10) {
+			t.Errorf("request %d: X-RSS-Delivery = %q", i, got)
+		}
+		if req.header.Get("Content-Type") != "application/json" || req.header.Get("X-RSS-Event") != "item.new" {
+			t.Errorf("request %d: headers = %v", i, req.header)
+		}
+		var payload NotificationPayload
+		if err := json.Unmarshal(req.body, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.ID != n.ID || payload.Target != "hook" || payload.Item.Title != "New post" || payload.Feed.URL != "https://example.com/feed.xml" {
+			t.Errorf("request %d: payload = %+v", i, payload)
+		}
+	}
+
+	// 同じアイテムを同じ送り先にもう一度記録しても送らない
+	if err := queueNotifications(db, n.ItemID, []string{"hook"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := deliverNotifications(ctx, db, true); err != nil {
+		t.Fatal(err)
+	}
+	if requests := hook.received(); len(requests) != 2 {
+		t.Errorf("webhook received %d requests after re-queueing, want 2", len(requests))
+	}
+}
+
+func TestWebhookGivesUpAfterMaxAttempts(t *testing.T) {
+	db := newTestDB(t)
+	hook := &webhookServer{failures: notifyMaxAttempts + 1}
+	srv := httptest.NewServer(hook)
+	defer srv.Close()
+	n := queueTestNotification(t, db, srv.URL, "")
+
+	for i := 0; i < notifyMaxAttempts+1; i++ {
+		if err := deliverNotifications(context.Background(), db, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := loadNotification(t, db, n.ID)
+	if got.Status != notificationFailed || got.Attempts != notifyMaxAttempts {
+		t.Fatalf("notification = %+v, want failed after %d attempts", got, notifyMaxAttempts)
+	}
+	requests := hook.received()
+	if len(requests) != notifyMaxAttempts {
+		t.Errorf("webhook received %d requests, want %d", len(requests), notifyMaxAttempts)
+	}
+	// Secretがなければ署名しない
+	if sig := requests[0].header.Get("X-RSS-Signature"); sig != "" {
+		t.Errorf("X-RSS-Signature = %q without a secret", sig)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html/charset"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// OPML OPML 1.0/2.0 の文書
+type OPML struct {
+	XMLName xml.Name  `xml:"opml"`
+	Version string    `xml:"version,attr"`
+	Head    OPMLHead  `xml:"head"`
+	Body    []Outline `xml:"body>outline"`
+}
+
+// OPMLHead OPMLのヘッダ
+type OPMLHead struct {
+	Title       string `xml:"title,omitempty"`
+	DateCreated string `xml:"dateCreated,omitempty"`
+}
+
+// Outline OPMLのoutline要素。xmlUrlがなく子を持つものはカテゴリ（フォルダ）として扱う
+type Outline struct {
+	Text     string    `xml:"text,attr"`
+	Title    string    `xml:"title,attr,omitempty"`
+	Type     string    `xml:"type,attr,omitempty"`
+	XMLURL   string    `xml:"xmlUrl,attr,omitempty"`
+	HTMLURL  string    `xml:"htmlUrl,attr,omitempty"`
+	Category string    `xml:"category,attr,omitempty"`
+	Outlines []Outline `xml:"outline"`
+}
+
+// ImportReport OPMLの取り込み結果
+type ImportReport struct {
+	Added   []string
+	Skipped []string // 登録済みのURL
+	Invalid []string // URLがない、または不正なoutline
+}
+
+// parseOPML OPMLを読み込む
+func parseOPML(r io.Reader) (*OPML, error) {
+	var doc OPML
+	dec := xml.NewDecoder(r)
+	// Shift_JISやISO-8859-1などUTF-8以外で書かれたOPMLは、宣言された文字コードからUTF-8に変換して読む
+	dec.CharsetReader = charset.NewReaderLabel
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// outlineCategory OPML 2.0のcategory属性（"/Tech/Go"のような形式）からカテゴリを取り出す
+func outlineCategory(o Outline) string {
+	if o.Category == "" {
+		return ""
+	}
+	first := strings.Split(o.Category, ",")[0]
+	return strings.Trim(strings.TrimSpace(first), "/")
+}
+
+// validFeedURL 購読できるURLかどうか
+func validFeedURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// importOutlines outlineを再帰的にたどって購読を登録する。入れ子のカテゴリは"/"でつなぐ
+func importOutlines(db *gorm.DB, outlines []Outline, category string, report *ImportReport) error {
+	for _, o := range outlines {
+		name := o.Title
+		if name == "" {
+			name = o.Text
+		}
+
+		if o.XMLURL == "" {
+			if len(o.Outlines) == 0 {
+				report.Invalid = append(report.Invalid, name)
+				continue
+			}
+			// カテゴリ（フォルダ）
+			child := name
+			if category != "" {
+				child = category + "/" + name
+			}
+			if err := importOutlines(db, o.Outlines, child, report); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !validFeedURL(o.XMLURL) {
+			report.Invalid = append(report.Invalid, o.XMLURL)
+			continue
+		}
+
+		sub := Subscription{
+			URL:      o.XMLURL,
+			Title:    name,
+			Category: category,
+			Enabled:  true,
+		}
+		if sub.Category == "" {
+			sub.Category = outlineCategory(o)
+		}
+
+		// URLのユニークインデックスで重複を除く
+		result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&sub)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			report.Skipped = append(report.Skipped, o.XMLURL)
+		} else {
+			report.Added = append(report.Added, o.XMLURL)
+		}
+	}
+	return nil
+}
+
+// importOPML OPMLファイルを購読に取り込み、結果を表示する
+func importOPML(db *gorm.DB, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: import FILE")
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	doc, err := parseOPML(f)
+	if err != nil {
+		return fmt.Errorf("failed to parse OPML: %v", err)
+	}
+
+	var report ImportReport
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return importOutlines(tx, doc.Body, "", &report)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, u := range report.Added {
+		fmt.Printf("added   %s\n", u)
+	}
+	for _, u := range report.Skipped {
+		fmt.Printf("skipped %s\n", u)
+	}
+	for _, u := range report.Invalid {
+		fmt.Printf("invalid %s\n", u)
+	}
+	fmt.Printf("%d added, %d skipped, %d invalid\n", len(report.Added), len(report.Skipped), len(report.Invalid))
+	return nil
+}
+
+// buildOPML 購読の一覧からOPML 2.0の文書を作る。カテゴリの"/"は入れ子のoutlineにする
+func buildOPML(db *gorm.DB) (*OPML, error) {
+	var subs []Subscription
+	if err := db.Order("category, url").Find(&subs).Error; err != nil {
+		return nil, err
+	}
+
+	doc := &OPML{
+		Version: "2.0",
+		Head: OPMLHead{
+			Title:       "RSS subscriptions",
+			DateCreated: time.Now().Format(time.RFC1123Z),
+		},
+	}
+
+	// カテゴリのパスごとにoutlineを組み立てる
+	type folder struct {
+		outline  Outline
+		children map[string]*folder
+		order    []string
+	}
+	root := &folder{children: map[string]*folder{}}
+	for _, sub := range subs {
+		node := root
+		if sub.Category != "" {
+			for _, name := range strings.Split(sub.Category, "/") {
+				child, ok := node.children[name]
+				if !ok {
+					child = &folder{outline: Outline{Text: name, Title: name}, children: map[string]*folder{}}
+					node.children[name] = child
+					node.order = append(node.order, name)
+				}
+				node = child
+			}
+		}
+
+		// 取得済みのフィードがあればタイトルとサイトのURLを使う
+		var feed RssFeed
+		db.Where("url = ?", sub.URL).Limit(1).Find(&feed)
+		title := sub.Title
+		if title == "" {
+			title = feed.Title
+		}
+		if title == "" {
+			title = sub.URL
+		}
+		node.outline.Outlines = append(node.outline.Outlines, Outline{
+			Text:    title,
+			Title:   title,
+			Type:    "rss",
+			XMLURL:  sub.URL,
+			HTMLURL: feed.Link,
+		})
+	}
+
+	// フォルダをoutlineに変換する（フィードの後にフォルダを並べる）
+	var flatten func(f *folder) []Outline
+	flatten = func(f *folder) []Outline {
+		outlines := f.outline.Outlines
+		sort.Strings(f.order)
+		for _, name := range f.order {
+			child := f.children[name]
+			o := child.outline
+			o.Outlines = flatten(child)
+			outlines = append(outlines, o)
+		}
+		return outlines
+	}
+	doc.Body = flatten(root)
+	return doc, nil
+}
+
+// exportOPML 購読の一覧をOPMLとしてファイル（指定がなければ標準出力）に書き出す
+func exportOPML(db *gorm.DB, args []string) error {
+	doc, err := buildOPML(db)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if len(args) > 0 {
+		f, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
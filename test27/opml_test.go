@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"os"
+	"reflect"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+// importFile testdataのOPMLを取り込む
+func importFile(t *testing.T, db *gorm.DB, path string) ImportReport {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	doc, err := parseOPML(f)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	var report ImportReport
+	if err := importOutlines(db, doc.Body, "", &report); err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+// subscriptionsByURL 購読のタイトルとカテゴリをURLごとにまとめる
+func subscriptionsByURL(t *testing.T, db *gorm.DB) map[string][2]string {
+	t.Helper()
+	var subs []Subscription
+	if err := db.Find(&subs).Error; err != nil {
+		t.Fatal(err)
+	}
+	m := map[string][2]string{}
+	for _, s := range subs {
+		m[s.URL] = [2]string{s.Title, s.Category}
+	}
+	return m
+}
+
+func TestImportOPML(t *testing.T) {
+	db := newTestDB(t)
+	report := importFile(t, db, "testdata/subscriptions.opml")
+	if len(report.Added) != 5 || len(report.Skipped) != 1 || len(report.Invalid) != 2 {
+		t.Fatalf("report = %+v, want 5 added, 1 skipped, 2 invalid", report)
+	}
+	want := map[string][2]string{
+		"https://xkcd.com/atom.xml":                   {"xkcd", ""},
+		"https://hnrss.org/frontpage":                 {"Hacker News", "Tech"},
+		"https://go.dev/blog/feed.atom":               {"The Go Blog", "Tech/Go"},
+		"https://www3.nhk.or.jp/rss/news/cat0.xml":    {"NHKニュース", "ニュース"},
+		"https://feeds.bbci.co.uk/news/world/rss.xml": {"BBC", "World/Europe"},
+	}
+	if got := subscriptionsByURL(t, db); !reflect.DeepEqual(got, want) {
+		t.Errorf("subscriptions = %v, want %v", got, want)
+	}
+}
+
+func TestImportOPMLCharsets(t *testing.T) {
+	for _, tt := range []struct {
+		file, url, title, category string
+	}{
+		{"testdata/shift_jis.opml", "https://b.hatena.ne.jp/hotentry/it.rss", "はてなブックマーク - 人気エントリー", "技術"},
+		{"testdata/iso-8859-1.opml", "https://www.lemonde.fr/rss/une.xml", "Le Monde - À la une", "Actualités"},
+	} {
+		t.Run(tt.file, func(t *testing.T) {
+			db := newTestDB(t)
+			importFile(t, db, tt.file)
+			got := subscriptionsByURL(t, db)
+			if want := [2]string{tt.title, tt.category}; got[tt.url] != want {
+				t.Errorf("subscription = %q, want %q", got[tt.url], want)
+			}
+		})
+	}
+}
+
+func TestOPMLRoundTrip(t *testing.T) {
+	src := newTestDB(t)
+	importFile(t, src, "testdata/subscriptions.opml")
+
+	doc, err := buildOPML(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).Encode(doc); err != nil {
+		t.Fatal(err)
+	}
+
+	exported, err := parseOPML(&buf)
+	if err != nil {
+		t.Fatalf("exported OPML does not parse: %v", err)
+	}
+	dst := newTestDB(t)
+	var report ImportReport
+	if err := importOutlines(dst, exported.Body, "", &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Skipped) != 0 || len(report.Invalid) != 0 {
+		t.Errorf("re-import report = %+v", report)
+	}
+	if got, want := subscriptionsByURL(t, dst), subscriptionsByURL(t, src); !reflect.DeepEqual(got, want) {
+		t.Errorf("after round trip = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 出力するフィードの既定の件数と上限
+const (
+	defaultOutputLimit = 50
+	maxOutputLimit     = 500
+)
+
+// outputGenerator 出力するフィードの名前（Generator）
+const outputGenerator = "tama-jp/gosample rss"
+
+// OutputOptions まとめて出力するアイテムの条件とフィードの情報
+type OutputOptions struct {
+	FeedURLs []string // 元のフィードのURL（空ならすべて）
+	Keyword  string   // タイトル・概要・本文に含まれる語
+	Tag      string   // 利用者が付けたタグ
+	Category string   // フィードのカテゴリ
+	Limit    int
+	Title    string
+	SelfURL  string // 出力するフィード自身のURL（分かれば）
+}
+
+// OutputFeed 出力するフィード
+type OutputFeed struct {
+	Title       string
+	Description string
+	SelfURL     string
+	Link        string // RSSのchannelのlink（自身のURL、なければ元のフィードが1つならそのサイトのURL）
+	Updated     time.Time
+	Items       []RssItem
+	Sources     map[uint]RssFeed // アイテムの元のフィード
+}
+
+// outputFormats 出力の形式ごとのContent-Typeと書き出す関数
+var outputFormats = map[string]struct {
+	contentType string
+	write       func(io.Writer, *OutputFeed) error
+}{
+	"rss":  {"application/rss+xml; charset=utf-8", writeRSS},
+	"atom": {"application/atom+xml; charset=utf-8", writeAtom},
+	"json": {"application/feed+json; charset=utf-8", writeJSONFeed},
+}
+
+// buildOutputFeed 条件に合うアイテムを新しい順に集めて、出力するフィードを作る
+func buildOutputFeed(db *gorm.DB, opts OutputOptions) (*OutputFeed, error) {
+	if opts.Limit <= 0 || opts.Limit > maxOutputLimit {
+		return nil, fmt.Errorf("limit must be between 1 and %d", maxOutputLimit)
+	}
+
+	q := db.Omit("content2").Preload("Authors").Preload("Categories").Preload("Enclosures")
+	q = ItemFilter{Tag: opts.Tag, Category: opts.Category}.apply(db, q, false)
+	if len(opts.FeedURLs) > 0 {
+		q = q.Where("feed_id IN (?)", db.Model(&RssFeed{}).Select("id").Where("url IN ?", opts.FeedURLs))
+	}
+	if opts.Keyword != "" {
+		// LIKEはASCIIの大文字と小文字を区別しない
+		like := "%" + escapeLike(opts.Keyword) + "%"
+		q = q.Where(`title LIKE ? ESCAPE '\' OR content LIKE ? ESCAPE '\' OR body LIKE ? ESCAPE '\'`, like, like, like)
+	}
+
+	// 公開日時がなければ初めて取得した時間で並べる（タイムゾーンが混在するのでjuliandayで比べる）
+	order := clause.OrderBy{Expression: clause.Expr{
+		SQL:  "julianday(CASE WHEN published = ? THEN first_seen ELSE published END) DESC, id DESC",
+		Vars: []interface{}{time.Time{}},
+	}}
+	var items []RssItem
+	if err := q.Order(order).Limit(opts.Limit).Find(&items).Error; err != nil {
+		return nil, err
+	}
+
+	feed := &OutputFeed{Title: opts.Title, SelfURL: opts.SelfURL, Link: opts.SelfURL, Items: items, Sources: map[uint]RssFeed{}}
+	var sources []RssFeed
+	sq := db.Select("id", "title", "link", "url")
+	if len(opts.FeedURLs) > 0 {
+		sq = sq.Where("url IN ?", opts.FeedURLs)
+	}
+	if err := sq.Order("title").Find(&sources).Error; err != nil {
+		return nil, err
+	}
+	titles := make([]string, 0, len(sources))
+	for _, s := range sources {
+		feed.Sources[s.ID] = s
+		titles = append(titles, s.Title)
+	}
+	if feed.Link == "" && len(sources) == 1 {
+		feed.Link = sources[0].Link
+	}
+	if feed.Title == "" {
+		feed.Title = "Merged feed"
+	}
+	feed.Description = "Items from " + strings.Join(titles, ", ")
+	for _, item := range items {
+		if d := itemModified(item); d.After(feed.Updated) {
+			feed.Updated = d
+		}
+	}
+	if feed.Updated.IsZero() {
+		feed.Updated = time.Now()
+	}
+	return feed, nil
+}
+
+// itemModified アイテムの更新日時（なければ公開日時、初めて取得した時間の順）
+func itemModified(item RssItem) time.Time {
+	if !item.Updated.IsZero() {
+		return item.Updated
+	}
+	return itemDate(item)
+}
+
+// itemID 出力するアイテムのID。GUIDがなければリンク、どちらもなければデータベースのIDから作る
+func itemID(item RssItem) string {
+	switch {
+	case item.GUID != "":
+		return item.GUID
+	case item.Link != "":
+		return item.Link
+	default:
+		return fmt.Sprintf("urn:rss-item:%d", item.ID)
+	}
+}
+
+// isAbsoluteURI Atomのidに使えるURIかどうか
+func isAbsoluteURI(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme != "" && !strings.ContainsAny(s, " \t\n")
+}
+
+// itemAuthorNames アイテムの著者の名前（名前がなければメールアドレス）
+func itemAuthorNames(item RssItem) []string {
+	var names []string
+	for _, a := range item.Authors {
+		name := a.Name
+		if name == "" {
+			name = a.Email
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// RSS 2.0
+
+type rssDocument struct {
+	XMLName    xml.Name   `xml:"rss"`
+	Version    string     `xml:"version,attr"`
+	AtomNS     string     `xml:"xmlns:atom,attr"`
+	ContentNS  string     `xml:"xmlns:content,attr"`
+	DublinCore string     `xml:"xmlns:dc,attr"`
+	Channel    rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	AtomLink      *atomLink `xml:"atom:link,omitempty"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Generator     string    `xml:"generator"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string         `xml:"title,omitempty"`
+	Link        string         `xml:"link,omitempty"`
+	Description string         `xml:"description,omitempty"`
+	Content     *rssCDATA      `xml:"content:encoded,omitempty"`
+	Creators    []string       `xml:"dc:creator"`
+	Categories  []string       `xml:"category"`
+	Enclosures  []rssEnclosure `xml:"enclosure"`
+	GUID        rssGUID        `xml:"guid"`
+	PubDate     string         `xml:"pubDate,omitempty"`
+	Source      *rssSource     `xml:"source,omitempty"`
+}
+
+type rssCDATA struct {
+	Text string `xml:",cdata"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type rssSource struct {
+	URL   string `xml:"url,attr"`
+	Title string `xml:",chardata"`
+}
+
+// writeRSS RSS 2.0で書き出す。channelのlinkは必須なので、Linkがなければエラーにする
+func writeRSS(w io.Writer, feed *OutputFeed) error {
+	if feed.Link == "" {
+		return errors.New("RSS needs a channel link: specify -self with the URL where the feed will be published")
+	}
+	doc := rssDocument{
+		Version:    "2.0",
+		AtomNS:     "http://www.w3.org/2005/Atom",
+		ContentNS:  "http://purl.org/rss/1.0/modules/content/",
+		DublinCore: "http://purl.org/dc/elements/1.1/",
+		Channel: rssChannel{
+			Title:         feed.Title,
+			Link:          feed.Link,
+			Description:   feed.Description,
+			LastBuildDate: feed.Updated.Format(time.RFC1123Z),
+			Generator:     outputGenerator,
+		},
+	}
+	if feed.SelfURL != "" {
+		doc.Channel.AtomLink = &atomLink{Href: feed.SelfURL, Rel: "self", Type: "application/rss+xml"}
+	}
+
+	for _, item := range feed.Items {
+		ri := rssItem{
+			Title:       item.Title,
+			Link:        item.Link,
+			Description: item.Content,
+			Creators:    itemAuthorNames(item),
+			PubDate:     itemDate(item).Format(time.RFC1123Z),
+			GUID:        rssGUID{Value: itemID(item), IsPermaLink: item.GUID == "" && item.Link != ""},
+		}
+		if item.Body != "" {
+			ri.Content = &rssCDATA{Text: item.Body}
+		}
+		for _, c := range item.Categories {
+			ri.Categories = append(ri.Categories, c.Name)
+		}
+		for _, e := range item.Enclosures {
+			ri.Enclosures = append(ri.Enclosures, rssEnclosure{URL: e.URL, Length: e.Length, Type: e.Type})
+		}
+		if src, ok := feed.Sources[item.FeedID]; ok {
+			ri.Source = &rssSource{URL: src.URL, Title: src.Title}
+		}
+		doc.Channel.Items = append(doc.Channel.Items, ri)
+	}
+	return writeXML(w, doc)
+}
+
+// Atom 1.0
+
+type atomDocument struct {
+	XMLName   xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Subtitle  string      `xml:"subtitle,omitempty"`
+	Updated   string      `xml:"updated"`
+	Links     []atomLink  `xml:"link"`
+	Author    atomPerson  `xml:"author"`
+	Generator string      `xml:"generator"`
+	Entries   []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href   string `xml:"href,attr"`
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type atomPerson struct {
+	Name  string `xml:"name"`
+	Email string `xml:"email,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomEntry struct {
+	ID         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Updated    string         `xml:"updated"`
+	Published  string         `xml:"published,omitempty"`
+	Links      []atomLink     `xml:"link"`
+	Authors    []atomPerson   `xml:"author"`
+	Categories []atomCategory `xml:"category"`
+	Summary    *atomText      `xml:"summary,omitempty"`
+	Content    *atomText      `xml:"content,omitempty"`
+}
+
+// writeAtom Atom 1.0で書き出す
+func writeAtom(w io.Writer, feed *OutputFeed) error {
+	id := feed.SelfURL
+	if id == "" {
+		id = "urn:rss-merged:" + url.PathEscape(feed.Title)
+	}
+	doc := atomDocument{
+		ID:        id,
+		Title:     feed.Title,
+		Subtitle:  feed.Description,
+		Updated:   feed.Updated.Format(time.RFC3339),
+		Author:    atomPerson{Name: feed.Title}, // エントリーに著者がないときに使われる
+		Generator: outputGenerator,
+	}
+	if feed.SelfURL != "" {
+		doc.Links = append(doc.Links, atomLink{Href: feed.SelfURL, Rel: "self", Type: "application/atom+xml"})
+	}
+
+	for _, item := range feed.Items {
+		entry := atomEntry{
+			ID:      itemID(item),
+			Title:   item.Title,
+			Updated: itemModified(item).Format(time.RFC3339),
+		}
+		if !isAbsoluteURI(entry.ID) {
+			entry.ID = fmt.Sprintf("urn:rss-item:%d", item.ID)
+		}
+		if !item.Published.IsZero() {
+			entry.Published = item.Published.Format(time.RFC3339)
+		}
+		if item.Link != "" {
+			entry.Links = append(entry.Links, atomLink{Href: item.Link, Rel: "alternate"})
+		}
+		for _, e := range item.Enclosures {
+			entry.Links = append(entry.Links, atomLink{Href: e.URL, Rel: "enclosure", Type: e.Type, Length: e.Length})
+		}
+		for _, a := range item.Authors {
+			entry.Authors = append(entry.Authors, atomPerson{Name: a.Name, Email: a.Email})
+			if a.Name == "" {
+				entry.Authors[len(entry.Authors)-1].Name = a.Email
+			}
+		}
+		for _, c := range item.Categories {
+			entry.Categories = append(entry.Categories, atomCategory{Term: c.Name})
+		}
+		if item.Content != "" {
+			entry.Summary = &atomText{Type: "html", Text: item.Content}
+		}
+		if item.Body != "" {
+			entry.Content = &atomText{Type: "html", Text: item.Body}
+		}
+		doc.Entries = append(doc.Entries, entry)
+	}
+	return writeXML(w, doc)
+}
+
+// writeXML XML宣言を付けて書き出す
+func writeXML(w io.Writer, doc interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// JSON Feed 1.1
+
+type jsonFeedDocument struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	FeedURL     string         `json:"feed_url,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	ID            string               `json:"id"`
+	URL           string               `json:"url,omitempty"`
+	Title         string               `json:"title,omitempty"`
+	ContentHTML   string               `json:"content_html,omitempty"`
+	Summary       string               `json:"summary,omitempty"`
+	Image         string               `json:"image,omitempty"`
+	DatePublished string               `json:"date_published,omitempty"`
+	DateModified  string               `json:"date_modified,omitempty"`
+	Authors       []jsonFeedAuthor     `json:"authors,omitempty"`
+	Tags          []string             `json:"tags,omitempty"`
+	Attachments   []jsonFeedAttachment `json:"attachments,omitempty"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+}
+
+type jsonFeedAttachment struct {
+	URL         string `json:"url"`
+	MIMEType    string `json:"mime_type"`
+	SizeInBytes int64  `json:"size_in_bytes,omitempty"`
+}
+
+// writeJSONFeed JSON Feed 1.1で書き出す
+func writeJSONFeed(w io.Writer, feed *OutputFeed) error {
+	doc := jsonFeedDocument{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       feed.Title,
+		FeedURL:     feed.SelfURL,
+		Description: feed.Description,
+		Items:       []jsonFeedItem{},
+	}
+	for _, item := range feed.Items {
+		ji := jsonFeedItem{
+			ID:            itemID(item),
+			URL:           item.Link,
+			Title:         item.Title,
+			ContentHTML:   item.Body,
+			Image:         item.ImageURL,
+			DatePublished: itemDate(item).Format(time.RFC3339),
+		}
+		// 本文がなければ概要を本文にする（content_htmlかcontent_textが必須）
+		if ji.ContentHTML == "" {
+			ji.ContentHTML = item.Content
+		} else {
+			ji.Summary = stripHTML(item.Content)
+		}
+		if !item.Updated.IsZero() {
+			ji.DateModified = item.Updated.Format(time.RFC3339)
+		}
+		for _, name := range itemAuthorNames(item) {
+			ji.Authors = append(ji.Authors, jsonFeedAuthor{Name: name})
+		}
+		for _, c := range item.Categories {
+			ji.Tags = append(ji.Tags, c.Name)
+		}
+		for _, e := range item.Enclosures {
+			mimeType := e.Type
+			if mimeType == "" {
+				mimeType = "application/octet-stream"
+			}
+			ji.Attachments = append(ji.Attachments, jsonFeedAttachment{URL: e.URL, MIMEType: mimeType, SizeInBytes: e.Length})
+		}
+		doc.Items = append(doc.Items, ji)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+// outputFormatOf ファイルの拡張子から出力の形式を決める
+func outputFormatOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".atom":
+		return "atom"
+	case ".json":
+		return "json"
+	default:
+		return "rss"
+	}
+}
+
+// publishFeed 複数のフィードのアイテムをまとめたフィードをファイル（-oがなければ標準出力）に書き出す
+// 使い方: publish [-format rss|atom|json] [-o merged.xml] [-feed URL]... [-keyword 語] [-tag タグ] [-category カテゴリ] [-limit 50]
+func publishFeed(db *gorm.DB, args []string) error {
+	opts := OutputOptions{Limit: defaultOutputLimit}
+	fs := flag.NewFlagSet("publish", flag.ContinueOnError)
+	format := fs.String("format", "", "output format: rss, atom or json (default: from the -o extension, else rss)")
+	out := fs.String("o", "", "output file (default: standard output)")
+	fs.Func("feed", "include items of the feed with this URL (repeatable; default: all feeds)", func(s string) error {
+		opts.FeedURLs = append(opts.FeedURLs, s)
+		return nil
+	})
+	fs.StringVar(&opts.Keyword, "keyword", "", "only items containing this word in the title or content")
+	fs.StringVar(&opts.Tag, "tag", "", "only items with this user tag")
+	fs.StringVar(&opts.Category, "category", "", "only items in this feed category")
+	fs.IntVar(&opts.Limit, "limit", opts.Limit, "maximum number of items")
+	fs.StringVar(&opts.Title, "title", "", "title of the merged feed")
+	fs.StringVar(&opts.SelfURL, "self", "", "URL where the merged feed will be published")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *format == "" {
+		*format = outputFormatOf(*out)
+	}
+	f, ok := outputFormats[*format]
+	if !ok {
+		return fmt.Errorf("unknown format: %s (rss, atom or json)", *format)
+	}
+
+	feed, err := buildOutputFeed(db, opts)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		return f.write(os.Stdout, feed)
+	}
+
+	// 購読している側が書きかけのファイルを読まないよう、一時ファイルに書いてから置き換える
+	tmp, err := os.CreateTemp(filepath.Dir(*out), ".publish-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := f.write(tmp, feed); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), *out); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d items to %s\n", len(feed.Items), *out)
+	return nil
+}
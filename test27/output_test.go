@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"gorm.io/gorm"
+)
+
+// seedOutputFeeds 2つのフィードにアイテムを取り込む
+func seedOutputFeeds(t *testing.T, db *gorm.DB) {
+	t.Helper()
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, site := range []string{"alpha", "beta"} {
+		feed := &gofeed.Feed{Title: strings.ToUpper(site[:1]) + site[1:], Link: "https://" + site + ".example.com/"}
+		for j := 1; j <= 3; j++ {
+			published := base.Add(time.Duration(j*2+i) * time.Hour)
+			feed.Items = append(feed.Items, &gofeed.Item{
+				GUID:            fmt.Sprintf("%s-%d", site, j),
+				Title:           fmt.Sprintf("%s <post> %d & more", site, j),
+				Link:            fmt.Sprintf("https://%s.example.com/posts/%d", site, j),
+				Description:     fmt.Sprintf("<p>summary %d</p>", j),
+				Content:         fmt.Sprintf("<p>body %d</p>", j),
+				PublishedParsed: &published,
+				Authors:         []*gofeed.Person{{Name: "Author " + site}},
+				Categories:      []string{"news"},
+			})
+		}
+		if _, err := upsertFeedByURL(db, feed, "https://"+site+".example.com/feed.xml", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOutputRoundTrip(t *testing.T) {
+	db := newTestDB(t)
+	seedOutputFeeds(t, db)
+	out, err := buildOutputFeed(db, OutputOptions{Limit: 10, Title: "Merged", SelfURL: "https://example.com/merged"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Items) != 6 {
+		t.Fatalf("%d items, want 6", len(out.Items))
+	}
+
+	for _, name := range []string{"rss", "atom", "json"} {
+		var buf bytes.Buffer
+		if err := outputFormats[name].write(&buf, out); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		parsed, err := gofeed.NewParser().Parse(&buf)
+		if err != nil {
+			t.Fatalf("%s: gofeed cannot parse the output: %v", name, err)
+		}
+		if parsed.FeedType != name {
+			t.Errorf("%s: parsed as %s", name, parsed.FeedType)
+		}
+		if parsed.Title != "Merged" {
+			t.Errorf("%s: title = %q", name, parsed.Title)
+		}
+		if len(parsed.Items) != len(out.Items) {
+			t.Fatalf("%s: %d items, want %d", name, len(parsed.Items), len(out.Items))
+		}
+		for i, item := range out.Items {
+			got := parsed.Items[i]
+			if got.Title != item.Title || got.Link != item.Link {
+				t.Errorf("%s item %d: %q %s, want %q %s", name, i, got.Title, got.Link, item.Title, item.Link)
+			}
+			if !got.PublishedParsed.Equal(item.Published) {
+				t.Errorf("%s item %d: published %v, want %v", name, i, got.PublishedParsed, item.Published)
+			}
+		}
+	}
+}
+
+func TestOutputRSSChannelLink(t *testing.T) {
+	db := newTestDB(t)
+	seedOutputFeeds(t, db)
+	channelLink := func(opts OutputOptions) (string, error) {
+		opts.Limit = 10
+		out, err := buildOutputFeed(db, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := writeRSS(&buf, out); err != nil {
+			return "", err
+		}
+		parsed, err := gofeed.NewParser().Parse(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed.Link, nil
+	}
+
+	if link, err := channelLink(OutputOptions{SelfURL: "https://example.com/merged"}); err != nil || link != "https://example.com/merged" {
+		t.Errorf("with self: %q, %v", link, err)
+	}
+	// 元のフィードが1つならそのサイトのURL
+	if link, err := channelLink(OutputOptions{FeedURLs: []string{"https://beta.example.com/feed.xml"}}); err != nil || link != "https://beta.example.com/" {
+		t.Errorf("single source: %q, %v", link, err)
+	}
+	// 複数のフィードをまとめるなら-selfが必要
+	if _, err := channelLink(OutputOptions{}); err == nil || !strings.Contains(err.Error(), "-self") {
+		t.Errorf("merged without self: %v, want an error asking for -self", err)
+	}
+}
+
+func TestOutputKeywordIsLiteral(t *testing.T) {
+	db := newTestDB(t)
+	feed := &gofeed.Feed{Title: "Shop", Link: "https://shop.example.com/", Items: []*gofeed.Item{
+		{GUID: "1", Title: "100% off", Link: "https://shop.example.com/1"},
+		{GUID: "2", Title: "1000 items", Link: "https://shop.example.com/2"},
+		{GUID: "3", Title: "snake_case", Link: "https://shop.example.com/3"},
+		{GUID: "4", Title: "snakeXcase", Link: "https://shop.example.com/4"},
+		{GUID: "5", Title: `C:\path`, Link: "https://shop.example.com/5"},
+	}}
+	if _, err := upsertFeedByURL(db, feed, "https://shop.example.com/feed.xml", nil); err != nil {
+		t.Fatal(err)
+	}
+	for keyword, want := range map[string]string{"0%": "100% off", "e_c": "snake_case", `:\p`: `C:\path`} {
+		out, err := buildOutputFeed(db, OutputOptions{Keyword: keyword, Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out.Items) != 1 || out.Items[0].Title != want {
+			var titles []string
+			for _, item := range out.Items {
+				titles = append(titles, item.Title)
+			}
+			t.Errorf("keyword %q: %v, want only %q", keyword, titles, want)
+		}
+	}
+}
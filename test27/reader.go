@@ -0,0 +1,752 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/mattn/go-tty"
+	"golang.org/x/sys/unix"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// リーダーで使う特殊キー（矢印キーなどのエスケープシーケンスを変換したもの）
+const (
+	keyEscape rune = -(iota + 1)
+	keyUp
+	keyDown
+	keyRight
+	keyLeft
+)
+
+// ペイン
+const (
+	paneFeeds = iota
+	paneItems
+	paneArticle
+)
+
+// 一覧に読み込むアイテムの上限
+const readerItemLimit = 500
+
+// 画面下に表示するキーの説明
+const readerHelp = "j/k:move h/l:pane enter:open r:read s:star a:archive R:feed read u:unread only v:saved page o:open /:search q:quit"
+
+// readerFeed フィード一覧の1行
+type readerFeed struct {
+	ID     uint // 0なら「すべてのアイテム」
+	URL    string
+	Title  string
+	Unread int
+}
+
+// Reader rss.dbのフィード・アイテム・記事を3つのペインで表示する端末用のリーダー
+type Reader struct {
+	Input chan rune // キー入力
+	Quit  bool
+
+	db    *gorm.DB
+	feeds []readerFeed
+	items []RssItem
+	focus int
+
+	// 各ペインの選択位置と表示の先頭
+	feedSel, feedTop int
+	itemSel, itemTop int
+	scroll           int
+
+	// 表示中の記事を折り返した行（アイテムと幅が変わったときだけ作り直す）
+	lines      []string
+	linesID    uint
+	linesWidth int
+	linesSaved bool
+
+	savedPage  bool   // 記事の代わりに保存したページ（Content2）を表示する
+	unreadOnly bool   // 未読のアイテムだけを表示する
+	query      string // 検索中の検索式
+	prompt     []rune // 検索式の入力中の文字列
+	prompting  bool
+	pendingG   bool // ggの1文字目を受け取った
+	message    string
+
+	width, height int
+}
+
+func newReader(db *gorm.DB) *Reader {
+	return &Reader{
+		Input: make(chan rune),
+		// SQLのログが画面を崩さないよう、エラーは画面下に表示する
+		db:     db.Session(&gorm.Session{Logger: db.Logger.LogMode(logger.Silent)}),
+		width:  80,
+		height: 24,
+	}
+}
+
+// loadFeeds フィードの一覧を未読数とともに読み込む
+func (r *Reader) loadFeeds() error {
+	var feeds []readerFeed
+	err := r.db.Raw(`SELECT f.id, f.url, COALESCE(NULLIF(s.title, ''), f.title) AS title, COUNT(i.id) AS unread
+		FROM rss_feeds f
+		LEFT JOIN subscriptions s ON s.url = f.url
+		LEFT JOIN rss_items i ON i.feed_id = f.id
+			AND i.id NOT IN (SELECT item_id FROM item_states WHERE read = ? OR archived = ?)
+		GROUP BY f.id
+		ORDER BY title`, true, true).Scan(&feeds).Error
+	if err != nil {
+		return err
+	}
+
+	all := readerFeed{Title: "All items"}
+	for _, f := range feeds {
+		all.Unread += f.Unread
+	}
+	r.feeds = append([]readerFeed{all}, feeds...)
+	if r.feedSel >= len(r.feeds) {
+		r.feedSel = len(r.feeds) - 1
+	}
+	return nil
+}
+
+// loadItems 選択中のフィードのアイテムを読み込む。検索中なら検索にヒットしたものだけにする
+// 選択していたアイテムがあれば、読み込み後も同じアイテムを選択する
+func (r *Reader) loadItems() error {
+	var selected uint
+	if item := r.selectedItem(); item != nil {
+		selected = item.ID
+	}
+	// 読み込みに失敗したときは一覧を空にする
+	r.items = nil
+	r.itemSel, r.itemTop = 0, 0
+
+	feed := r.feeds[r.feedSel]
+	filter := ItemFilter{FeedURL: feed.URL, Unread: r.unreadOnly}
+	// 本文と保存したページは大きいので、記事を開いたときに読み込む
+	q := filter.apply(r.db, r.db.Omit("body", "content2").Preload("State"), true)
+
+	var rank map[uint]int
+	if r.query != "" {
+		if searchIndexEnabled {
+			results, err := searchItems(r.db, r.query, SearchOptions{FeedURL: feed.URL, Limit: readerItemLimit})
+			if err != nil {
+				return err
+			}
+			rank = map[uint]int{}
+			ids := make([]uint, len(results))
+			for i, res := range results {
+				ids[i] = res.ID
+				rank[res.ID] = i
+			}
+			q = q.Where("id IN ?", ids)
+		} else {
+			// FTS5なしでビルドしたときはタイトルと概要の部分一致で探す
+			like := "%" + escapeLike(r.query) + "%"
+			q = q.Where(`title LIKE ? ESCAPE '\' OR content LIKE ? ESCAPE '\'`, like, like)
+		}
+	}
+
+	var items []RssItem
+	if err := q.Order("published desc, first_seen desc").Limit(readerItemLimit).Find(&items).Error; err != nil {
+		return err
+	}
+	if rank != nil {
+		sort.SliceStable(items, func(i, j int) bool { return rank[items[i].ID] < rank[items[j].ID] })
+	}
+	r.items = items
+	for i, item := range items {
+		if item.ID == selected {
+			r.itemSel = i
+		}
+	}
+	return nil
+}
+
+// reload フィードとアイテムを読み込み直し、失敗したらメッセージに表示する
+func (r *Reader) reload() {
+	if err := r.loadFeeds(); err != nil {
+		r.message = err.Error()
+		return
+	}
+	if err := r.loadItems(); err != nil {
+		r.message = err.Error()
+	}
+}
+
+// selectedItem 選択中のアイテム。なければnil
+func (r *Reader) selectedItem() *RssItem {
+	if r.itemSel < 0 || r.itemSel >= len(r.items) {
+		return nil
+	}
+	return &r.items[r.itemSel]
+}
+
+// setState 選択中のアイテムの状態を変更し、表示中の状態とフィードの未読数にも反映する
+func (r *Reader) setState(column string, value bool) {
+	item := r.selectedItem()
+	if item == nil {
+		return
+	}
+	items := r.db.Model(&RssItem{}).Select("id").Where("id = ?", item.ID)
+	if _, err := setItemState(r.db, items, column, value); err != nil {
+		r.message = err.Error()
+		return
+	}
+	if item.State == nil {
+		item.State = &ItemState{ItemID: item.ID}
+	}
+	switch column {
+	case "read":
+		item.State.Read = value
+	case "starred":
+		item.State.Starred = value
+	case "archived":
+		item.State.Archived = value
+	}
+	if err := r.loadFeeds(); err != nil {
+		r.message = err.Error()
+	}
+}
+
+// markFeedRead 選択中のフィード（「すべてのアイテム」ならすべて）のアイテムを既読にする
+func (r *Reader) markFeedRead() {
+	feed := r.feeds[r.feedSel]
+	items := ItemFilter{FeedURL: feed.URL}.apply(r.db, r.db.Model(&RssItem{}).Select("id"), false)
+	n, err := setItemState(r.db, items, "read", true)
+	if err != nil {
+		r.message = err.Error()
+		return
+	}
+	r.message = fmt.Sprintf("%d items marked read", n)
+	r.reload()
+}
+
+// openItem 選択中のアイテムを記事ペインに表示し、既読にする
+func (r *Reader) openItem() {
+	item := r.selectedItem()
+	if item == nil {
+		return
+	}
+	r.focus = paneArticle
+	r.scroll = 0
+	if item.State == nil || !item.State.Read {
+		r.setState("read", true)
+	}
+}
+
+// browserCommand URLをブラウザで開くコマンド（$BROWSERがあればそれを使う）
+func browserCommand(url string) *exec.Cmd {
+	if browser := os.Getenv("BROWSER"); browser != "" {
+		return exec.Command(browser, url)
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("open", url)
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		return exec.Command("xdg-open", url)
+	}
+}
+
+// openInBrowser 選択中のアイテムのリンクをブラウザで開き、実行したコマンドを表示する
+func (r *Reader) openInBrowser() {
+	item := r.selectedItem()
+	if item == nil || item.Link == "" {
+		return
+	}
+	cmd := browserCommand(item.Link)
+	line := strings.Join(cmd.Args, " ")
+	if err := cmd.Start(); err != nil {
+		r.message = fmt.Sprintf("$ %s (failed: %v)", line, err)
+		return
+	}
+	go cmd.Wait()
+	r.message = "$ " + line
+}
+
+// articleLines 選択中のアイテムを幅wで折り返した行
+func (r *Reader) articleLines(w int) []string {
+	item := r.selectedItem()
+	if item == nil {
+		return nil
+	}
+	if r.linesID == item.ID && r.linesWidth == w && r.linesSaved == r.savedPage {
+		return r.lines
+	}
+
+	var full RssItem
+	err := r.db.Preload("Authors").Preload("Categories").Where("id = ?", item.ID).Limit(1).Find(&full).Error
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var b strings.Builder
+	b.WriteString(full.Title + "\n")
+	b.WriteString(formatTime(itemDate(full)))
+	if len(full.Authors) > 0 {
+		b.WriteString("  by " + full.Authors[0].Name)
+	}
+	b.WriteString("\n" + full.Link + "\n")
+	if len(full.Categories) > 0 {
+		names := make([]string, len(full.Categories))
+		for i, c := range full.Categories {
+			names[i] = c.Name
+		}
+		b.WriteString("[" + strings.Join(names, ", ") + "]\n")
+	}
+	b.WriteString("\n")
+
+	switch {
+	case r.savedPage && full.Content2 == "":
+		b.WriteString("(no saved page)")
+	case r.savedPage:
+		b.WriteString(htmlToText(full.Content2))
+	case full.Body != "":
+		b.WriteString(htmlToText(full.Body))
+	default:
+		b.WriteString(htmlToText(full.Content))
+	}
+
+	r.lines = wrapText(b.String(), w)
+	r.linesID, r.linesWidth, r.linesSaved = item.ID, w, r.savedPage
+	return r.lines
+}
+
+// paneWidths 3つのペインの幅（間の区切り線の分を除く）
+func (r *Reader) paneWidths() (int, int, int) {
+	fw := r.width / 5
+	if fw < 16 {
+		fw = 16
+	}
+	if fw > 30 {
+		fw = 30
+	}
+	iw := (r.width - fw - 2) * 2 / 5
+	if iw < 1 {
+		iw = 1
+	}
+	aw := r.width - fw - iw - 2
+	if aw < 1 {
+		aw = 1
+	}
+	return fw, iw, aw
+}
+
+// rows ペインに表示できる行数（見出し、ステータス行、キーの説明の分を除く）
+func (r *Reader) rows() int {
+	if r.height < 4 {
+		return 1
+	}
+	return r.height - 3
+}
+
+// scrollTo 選択位置selが表示範囲に入るように表示の先頭を調整する
+func scrollTo(sel, top, rows int) int {
+	if sel < top {
+		return sel
+	}
+	if sel >= top+rows {
+		return sel - rows + 1
+	}
+	return top
+}
+
+// move 注目しているペインの選択位置（記事ならスクロール位置）をdだけ動かす
+func (r *Reader) move(d int) {
+	clamp := func(v, n int) int {
+		if v >= n {
+			v = n - 1
+		}
+		if v < 0 {
+			v = 0
+		}
+		return v
+	}
+	switch r.focus {
+	case paneFeeds:
+		sel := clamp(r.feedSel+d, len(r.feeds))
+		if sel != r.feedSel {
+			r.feedSel = sel
+			r.itemSel = -1
+			if err := r.loadItems(); err != nil {
+				r.message = err.Error()
+			}
+		}
+	case paneItems:
+		r.itemSel = clamp(r.itemSel+d, len(r.items))
+		r.scroll = 0
+	case paneArticle:
+		_, _, aw := r.paneWidths()
+		r.scroll = clamp(r.scroll+d, len(r.articleLines(aw-1))-r.rows()+1)
+	}
+}
+
+// handleKey キー入力を処理する
+func (r *Reader) handleKey(k rune) {
+	if r.prompting {
+		r.handlePromptKey(k)
+		return
+	}
+	r.message = ""
+
+	// gg: 先頭へ
+	if r.pendingG {
+		r.pendingG = false
+		if k == 'g' {
+			r.move(-1 << 30)
+			return
+		}
+	}
+
+	page := r.rows()
+	switch k {
+	case 'q':
+		r.Quit = true
+	case 'j', keyDown:
+		r.move(1)
+	case 'k', keyUp:
+		r.move(-1)
+	case 'g':
+		r.pendingG = true
+	case 'G':
+		r.move(1 << 30)
+	case 4: // Ctrl-D
+		r.move(page / 2)
+	case 21: // Ctrl-U
+		r.move(-page / 2)
+	case ' ':
+		r.move(page - 1)
+	case 'b':
+		r.move(-(page - 1))
+	case 'h', keyLeft, keyEscape:
+		if r.focus > paneFeeds {
+			r.focus--
+		}
+	case 'l', keyRight, '\r', '\n':
+		switch r.focus {
+		case paneFeeds:
+			r.focus = paneItems
+		case paneItems:
+			r.openItem()
+		}
+	case 'r':
+		if item := r.selectedItem(); item != nil {
+			r.setState("read", item.State == nil || !item.State.Read)
+		}
+	case 's':
+		if item := r.selectedItem(); item != nil {
+			r.setState("starred", item.State == nil || !item.State.Starred)
+		}
+	case 'a':
+		if item := r.selectedItem(); item != nil {
+			r.setState("archived", item.State == nil || !item.State.Archived)
+		}
+	case 'R':
+		r.markFeedRead()
+	case 'u':
+		r.unreadOnly = !r.unreadOnly
+		if err := r.loadItems(); err != nil {
+			r.message = err.Error()
+		}
+	case 'v':
+		r.savedPage = !r.savedPage
+		r.scroll = 0
+	case 'o':
+		r.openInBrowser()
+	case '/':
+		r.prompting = true
+		r.prompt = []rune(r.query)
+	}
+}
+
+// handlePromptKey 検索式の入力中のキー入力を処理する。空のまま確定すると検索をやめる
+func (r *Reader) handlePromptKey(k rune) {
+	switch k {
+	case keyEscape:
+		r.prompting = false
+	case '\r', '\n':
+		r.prompting = false
+		r.query = strings.TrimSpace(string(r.prompt))
+		r.itemSel = -1
+		if err := r.loadItems(); err != nil {
+			r.message = err.Error()
+			return
+		}
+		if r.query != "" {
+			r.message = fmt.Sprintf("%d items match %q", len(r.items), r.query)
+			if !searchIndexEnabled {
+				r.message += " (title/summary only: build with -tags sqlite_fts5 for full-text search)"
+			}
+		}
+		r.focus = paneItems
+	case 127, 8: // Backspace
+		if len(r.prompt) > 0 {
+			r.prompt = r.prompt[:len(r.prompt)-1]
+		}
+	default:
+		if k >= ' ' {
+			r.prompt = append(r.prompt, k)
+		}
+	}
+}
+
+// draw 画面全体を描画する
+func (r *Reader) draw() {
+	fw, iw, aw := r.paneWidths()
+	rows := r.rows()
+	r.feedTop = scrollTo(r.feedSel, r.feedTop, rows)
+	r.itemTop = scrollTo(r.itemSel, r.itemTop, rows)
+	lines := r.articleLines(aw - 1)
+
+	var b strings.Builder
+	// 選択中の行は、注目しているペインなら反転、それ以外は太字にする
+	cell := func(text string, w int, selected bool, pane int) string {
+		s := fitWidth(text, w)
+		switch {
+		case selected && r.focus == pane:
+			return "\033[7m" + s + "\033[0m"
+		case selected:
+			return "\033[1m" + s + "\033[0m"
+		}
+		return s
+	}
+
+	// 見出し
+	itemsTitle := " Items"
+	if r.unreadOnly {
+		itemsTitle += " (unread)"
+	}
+	if r.query != "" {
+		itemsTitle += " /" + r.query
+	}
+	b.WriteString("\033[1;1H\033[4m")
+	b.WriteString(fitWidth(" Feeds", fw) + "│" + fitWidth(itemsTitle, iw) + "│" + fitWidth(" Article", aw))
+	b.WriteString("\033[0m")
+
+	for y := 0; y < rows; y++ {
+		fmt.Fprintf(&b, "\033[%d;1H", y+2)
+
+		var feedText string
+		if i := r.feedTop + y; i < len(r.feeds) {
+			f := r.feeds[i]
+			count := ""
+			if f.Unread > 0 {
+				count = fmt.Sprintf("%d", f.Unread)
+			}
+			feedText = " " + fitWidth(f.Title, fw-len(count)-2) + count
+		}
+		b.WriteString(cell(feedText, fw, r.feedTop+y == r.feedSel, paneFeeds))
+		b.WriteString("│")
+
+		var itemText string
+		if i := r.itemTop + y; i < len(r.items) {
+			itemText = itemMarks(r.items[i]) + " " + r.items[i].Title
+		}
+		b.WriteString(cell(itemText, iw, r.itemTop+y == r.itemSel, paneItems))
+		b.WriteString("│")
+
+		var line string
+		if i := r.scroll + y; i < len(lines) {
+			line = " " + lines[i]
+		}
+		b.WriteString(fitWidth(line, aw))
+	}
+
+	// ステータス行とキーの説明（検索式の入力中はプロンプト）
+	status := r.message
+	if status == "" && len(lines) > rows {
+		status = fmt.Sprintf("%d/%d lines", r.scroll+rows, len(lines))
+	}
+	fmt.Fprintf(&b, "\033[%d;1H\033[7m%s\033[0m", rows+2, fitWidth(status, r.width))
+	fmt.Fprintf(&b, "\033[%d;1H", rows+3)
+	if r.prompting {
+		b.WriteString(fitWidth("/"+string(r.prompt), r.width-1))
+	} else {
+		b.WriteString(fitWidth(readerHelp, r.width-1))
+	}
+	// 最後の列は書かないので、前の表示が残らないよう消す
+	b.WriteString("\033[K")
+	fmt.Print(b.String())
+}
+
+// run ttyからの入力を受け取りながら、qが押されるかctxがキャンセルされるまで表示を続ける
+func (r *Reader) run(ctx context.Context) error {
+	t, err := tty.Open()
+	if err != nil {
+		return err
+	}
+	// 大きさが取れない端末では80x24とみなす
+	r.width, r.height = 80, 24
+	if w, h, err := t.Size(); err == nil && w > 0 && h > 0 {
+		r.width, r.height = w, h
+	}
+	resize := t.SIGWINCH()
+
+	ctx, cancel := context.WithCancel(ctx)
+	errc := make(chan error, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := r.readInput(ctx, t); err != nil {
+			errc <- err
+		}
+	}()
+
+	// 代替画面に切り替えてカーソルを隠す
+	fmt.Print("\033[?1049h\033[?25l\033[2J")
+
+	// 終了時は入力の読み取りを止めてからターミナルを元に戻す
+	defer func() {
+		cancel()
+		wg.Wait()
+		fmt.Print("\033[?25h\033[?1049l")
+		t.Close()
+	}()
+
+	r.reload()
+	r.draw()
+	for !r.Quit {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errc:
+			return err
+		case ws := <-resize:
+			if ws.W > 0 && ws.H > 0 {
+				r.width, r.height = ws.W, ws.H
+			}
+			fmt.Print("\033[2J")
+		case k := <-r.Input:
+			r.handleKey(k)
+		}
+		if !r.Quit {
+			r.draw()
+		}
+	}
+	return nil
+}
+
+// readInput ttyからキー入力を読み取ってInputへ送る。ctxがキャンセルされると終了する
+func (r *Reader) readInput(ctx context.Context, t *tty.TTY) error {
+	for {
+		ok, err := waitInput(ctx, t, 100)
+		if err != nil || !ok {
+			return err
+		}
+		k, err := t.ReadRune()
+		if err != nil {
+			return err
+		}
+		if k == '\033' {
+			if k = readEscape(t); k == 0 {
+				// 扱わないシーケンスは読み捨てる
+				continue
+			}
+		}
+		select {
+		case r.Input <- k:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// waitInput ttyから読み取れる入力が来るまで待つ。timeoutミリ秒ごとにctxのキャンセルを確かめる
+func waitInput(ctx context.Context, t *tty.TTY, timeout int) (bool, error) {
+	fds := []unix.PollFd{{Fd: int32(t.Input().Fd()), Events: unix.POLLIN}}
+	for {
+		if ctx.Err() != nil {
+			return false, nil
+		}
+		if t.Buffered() {
+			return true, nil
+		}
+		n, err := unix.Poll(fds, timeout)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if n > 0 {
+			return true, nil
+		}
+	}
+}
+
+// readEscape ESCに続くシーケンスを読み取り、矢印キーを特殊キーに変換する
+// 続く入力がすぐに来なければESCキーが単独で押されたとみなす
+func readEscape(t *tty.TTY) rune {
+	fds := []unix.PollFd{{Fd: int32(t.Input().Fd()), Events: unix.POLLIN}}
+	if !t.Buffered() {
+		if n, err := unix.Poll(fds, 30); err != nil || n == 0 {
+			return keyEscape
+		}
+	}
+	return parseEscape(t.ReadRune)
+}
+
+// parseEscape ESCのあとのシーケンスをnextで最後まで読み、矢印キーなら特殊キーを返す
+// それ以外のシーケンス（DeleteやPageUpなど）は残りをキー入力として扱わないよう終端まで読み捨てて0を返す
+func parseEscape(next func() (rune, error)) rune {
+	k, err := next()
+	if err != nil || (k != '[' && k != 'O') {
+		return keyEscape
+	}
+	ss3 := k == 'O'
+	var params []rune
+	for {
+		k, err = next()
+		if err != nil {
+			return keyEscape
+		}
+		// SS3は1文字、CSIはパラメータと中間のバイト（0x20〜0x3F）のあとの0x40〜0x7Eで終わる
+		if ss3 || (k >= 0x40 && k <= 0x7e) {
+			break
+		}
+		if k < 0x20 || k > 0x3f {
+			return 0
+		}
+		params = append(params, k)
+	}
+	if len(params) > 0 {
+		return 0
+	}
+	switch k {
+	case 'A':
+		return keyUp
+	case 'B':
+		return keyDown
+	case 'C':
+		return keyRight
+	case 'D':
+		return keyLeft
+	}
+	return 0
+}
+
+// runReader 端末用のリーダーを起動する
+// 使い方: reader [-unread]
+func runReader(db *gorm.DB, args []string) error {
+	fs := flag.NewFlagSet("reader", flag.ContinueOnError)
+	unread := fs.Bool("unread", false, "show only unread items")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	r := newReader(db)
+	r.unreadOnly = *unread
+	return r.run(ctx)
+}
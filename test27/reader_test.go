@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseEscape(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string // ESCのあとに続く入力
+		want rune
+		rest string // シーケンスのあとに残る入力
+	}{
+		{"up", "[A", keyUp, ""},
+		{"down", "[Bj", keyDown, "j"},
+		{"right in application mode", "OC", keyRight, ""},
+		{"left", "[D", keyLeft, ""},
+		{"delete", "[3~j", 0, "j"},
+		{"page up", "[5~", 0, ""},
+		{"page down", "[6~k", 0, "k"},
+		{"ctrl up", "[1;5Aq", 0, "q"},
+		{"f1", "OPq", 0, "q"},
+		{"f5", "[15~", 0, ""},
+		{"alt key", "j", keyEscape, ""},
+		{"escape alone", "", keyEscape, ""},
+		{"cut short", "[3", keyEscape, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := strings.NewReader(tt.in)
+			if got := parseEscape(func() (rune, error) {
+				k, _, err := r.ReadRune()
+				return k, err
+			}); got != tt.want {
+				t.Errorf("parseEscape(%q) = %d, want %d", tt.in, got, tt.want)
+			}
+			rest := tt.in[len(tt.in)-r.Len():]
+			if rest != tt.rest {
+				t.Errorf("parseEscape(%q) left %q unread, want %q", tt.in, rest, tt.rest)
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Rule 取り込むときにアイテムに適用するルール
+// 例: タイトルに"Sponsored"を含むアイテムは保存しない、本文が"golang"にマッチすればgoタグを付ける
+type Rule struct {
+	ID        uint   `gorm:"primaryKey"`
+	FeedURL   string `gorm:"index"` // 対象のフィードのURL（空ならすべてのフィード）
+	Field     string // 調べる項目（title, content, author, category）
+	Operator  string // contains（部分一致、大文字と小文字を区別しない）, regex（正規表現）, not（含まない。項目が空ならマッチしない）
+	Pattern   string
+	Action    string // skip（保存しない）, tag, star, read, notify
+	Tag       string // Actionがtagのときに付けるタグ
+	Notify    string // Actionがnotifyのときの通知の送り先（NotifyTargetの名前）
+	Enabled   bool   `gorm:"default:true"`
+	CreatedAt time.Time
+}
+
+// ルールで使える項目・演算子・動作
+var (
+	ruleFields    = []string{"title", "content", "author", "category"}
+	ruleOperators = []string{"contains", "regex", "not"}
+	ruleActions   = []string{"skip", "tag", "star", "read", "notify"}
+)
+
+// validate ルールの項目・演算子・動作が正しく、正規表現がコンパイルできるか調べる
+func (r Rule) validate() error {
+	for _, c := range []struct {
+		name, value string
+		allowed     []string
+	}{{"field", r.Field, ruleFields}, {"op", r.Operator, ruleOperators}, {"action", r.Action, ruleActions}} {
+		if !containsString(c.allowed, c.value) {
+			return fmt.Errorf("invalid %s %q (%s)", c.name, c.value, strings.Join(c.allowed, ", "))
+		}
+	}
+	if r.Pattern == "" {
+		return errors.New("pattern is empty")
+	}
+	if r.Operator == "regex" {
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			return fmt.Errorf("invalid regex: %v", err)
+		}
+	}
+	if r.Action == "tag" && strings.TrimSpace(r.Tag) == "" {
+		return errors.New("action tag needs -tag")
+	}
+	if r.Action == "notify" && strings.TrimSpace(r.Notify) == "" {
+		return errors.New("action notify needs -notify")
+	}
+	return nil
+}
+
+// containsString sがlistに含まれるか
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// RuleSet フィードに適用するルール（正規表現はコンパイル済み）
+type RuleSet struct {
+	rules   []Rule
+	regexps map[uint]*regexp.Regexp
+}
+
+// RuleResult アイテムにマッチしたルールの動作をまとめたもの
+type RuleResult struct {
+	Skip   bool
+	Tags   []string
+	Star   bool
+	Read   bool
+	Notify []string // 通知の送り先の名前
+}
+
+// loadRules feedURLのフィードに適用する有効なルールを読み込む
+func loadRules(db *gorm.DB, feedURL string) (*RuleSet, error) {
+	var rules []Rule
+	err := db.Where("enabled = ? AND (feed_url = '' OR feed_url = ?)", true, feedURL).Order("id").Find(&rules).Error
+	if err != nil {
+		return nil, err
+	}
+	rs := &RuleSet{regexps: map[uint]*regexp.Regexp{}}
+	for _, r := range rules {
+		if r.Operator == "regex" {
+			re, err := regexp.Compile(r.Pattern)
+			if err != nil {
+				// 追加するときに確かめているので、データベースを直接書き換えた場合だけ
+				log.Printf("rule %d: invalid regex %q: %v", r.ID, r.Pattern, err)
+				continue
+			}
+			rs.regexps[r.ID] = re
+		}
+		rs.rules = append(rs.rules, r)
+	}
+	return rs, nil
+}
+
+// evaluate アイテムにルールを当てはめる。内容の項目はHTMLを取り除いてから調べる
+func (rs *RuleSet) evaluate(item RssItem) RuleResult {
+	var result RuleResult
+	if rs == nil || len(rs.rules) == 0 {
+		return result
+	}
+
+	var content []string
+	values := func(field string) []string {
+		switch field {
+		case "title":
+			return []string{item.Title}
+		case "content":
+			if content == nil {
+				content = []string{stripHTML(item.Content) + "\n" + stripHTML(item.Body)}
+			}
+			return content
+		case "author":
+			var v []string
+			for _, a := range item.Authors {
+				v = append(v, a.Name, a.Email)
+			}
+			return v
+		case "category":
+			var v []string
+			for _, c := range item.Categories {
+				v = append(v, c.Name)
+			}
+			return v
+		}
+		return nil
+	}
+
+	for _, r := range rs.rules {
+		if !rs.matches(r, values(r.Field)) {
+			continue
+		}
+		switch r.Action {
+		case "skip":
+			result.Skip = true
+		case "tag":
+			if !containsString(result.Tags, r.Tag) {
+				result.Tags = append(result.Tags, r.Tag)
+			}
+		case "star":
+			result.Star = true
+		case "read":
+			result.Read = true
+		case "notify":
+			if !containsString(result.Notify, r.Notify) {
+				result.Notify = append(result.Notify, r.Notify)
+			}
+		}
+	}
+	return result
+}
+
+// matches 項目の値のどれかがルールのパターンにマッチするか（notならどれも含まないか）
+// notは著者やカテゴリのない（項目が空の）アイテムにはマッチしない
+func (rs *RuleSet) matches(r Rule, values []string) bool {
+	contains := func() bool {
+		pattern := strings.ToLower(r.Pattern)
+		for _, v := range values {
+			if strings.Contains(strings.ToLower(v), pattern) {
+				return true
+			}
+		}
+		return false
+	}
+	switch r.Operator {
+	case "contains":
+		return contains()
+	case "not":
+		for _, v := range values {
+			if strings.TrimSpace(v) != "" {
+				return !contains()
+			}
+		}
+		return false
+	case "regex":
+		re := rs.regexps[r.ID]
+		for _, v := range values {
+			if re.MatchString(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyRuleResult 保存したアイテムにルールのタグ・スター・既読を付け、通知を記録する
+func applyRuleResult(tx *gorm.DB, itemID uint, result RuleResult) error {
+	for _, tag := range result.Tags {
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&ItemTag{ItemID: itemID, Name: tag}).Error; err != nil {
+			return err
+		}
+	}
+	items := tx.Model(&RssItem{}).Select("id").Where("id = ?", itemID)
+	for _, s := range []struct {
+		column string
+		on     bool
+	}{{"starred", result.Star}, {"read", result.Read}} {
+		if !s.on {
+			continue
+		}
+		if _, err := setItemState(tx, items, s.column, true); err != nil {
+			return err
+		}
+	}
+	return queueNotifications(tx, itemID, result.Notify)
+}
+
+// ruleCommand 取り込みのルールを追加・一覧・削除する
+// 使い方: rule add [-feed URL] -field title -op contains -action skip [-tag タグ] [-notify 送り先] パターン / rule list / rule remove ID
+func ruleCommand(db *gorm.DB, args []string) error {
+	usage := errors.New("usage: rule add [-feed URL] -field title|content|author|category -op contains|regex|not -action skip|tag|star|read|notify [-tag TAG] [-notify TARGET] PATTERN | rule list | rule remove ID")
+	if len(args) == 0 {
+		return usage
+	}
+	switch args[0] {
+	case "add":
+		var r Rule
+		fs := flag.NewFlagSet("rule add", flag.ContinueOnError)
+		fs.StringVar(&r.FeedURL, "feed", "", "apply only to the feed with this URL")
+		fs.StringVar(&r.Field, "field", "title", "field to match: "+strings.Join(ruleFields, ", "))
+		fs.StringVar(&r.Operator, "op", "contains", "operator: "+strings.Join(ruleOperators, ", "))
+		fs.StringVar(&r.Action, "action", "", "action: "+strings.Join(ruleActions, ", "))
+		fs.StringVar(&r.Tag, "tag", "", "tag to add when the action is tag")
+		fs.StringVar(&r.Notify, "notify", "", "notify target to send the item to when the action is notify")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return usage
+		}
+		r.Pattern = fs.Arg(0)
+		r.Tag = strings.TrimSpace(r.Tag)
+		r.Enabled = true
+		if err := r.validate(); err != nil {
+			return err
+		}
+		if err := db.Create(&r).Error; err != nil {
+			return err
+		}
+		fmt.Printf("Added rule #%d\n", r.ID)
+		return nil
+
+	case "list":
+		var rules []Rule
+		if err := db.Order("id").Find(&rules).Error; err != nil {
+			return err
+		}
+		for _, r := range rules {
+			action := r.Action
+			switch r.Action {
+			case "tag":
+				action += " " + r.Tag
+			case "notify":
+				action += " " + r.Notify
+			}
+			scope := "all feeds"
+			if r.FeedURL != "" {
+				scope = r.FeedURL
+			}
+			fmt.Printf("#%-4d %s %s %q -> %s  (%s)\n", r.ID, r.Field, r.Operator, r.Pattern, action, scope)
+		}
+		return nil
+
+	case "remove":
+		if len(args) != 2 {
+			return usage
+		}
+		id, err := strconv.ParseUint(strings.TrimPrefix(args[1], "#"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid rule ID: %s", args[1])
+		}
+		res := db.Delete(&Rule{}, id)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("rule not found: %d", id)
+		}
+		fmt.Printf("Removed rule #%d\n", id)
+		return nil
+	}
+	return usage
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mmcdole/gofeed"
+	"gorm.io/gorm"
+)
+
+// ruleItem ルールを当てはめるテスト用のアイテム
+var ruleItem = RssItem{
+	Title:      "Go 1.23 released",
+	Content:    "<p>The <b>Golang</b> team is happy</p>",
+	Body:       "<div>Range over func</div>",
+	Authors:    []RssItemAuthor{{Name: "Alice", Email: "alice@example.com"}},
+	Categories: []RssItemCategory{{Name: "Release"}, {Name: "Go"}},
+}
+
+// loadTestRules rulesを保存してfeedURLのフィードに適用するルールを読み込む
+func loadTestRules(t *testing.T, db *gorm.DB, feedURL string, rules ...Rule) *RuleSet {
+	t.Helper()
+	for _, r := range rules {
+		r.Enabled = true
+		if err := r.validate(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Create(&r).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	rs, err := loadRules(db, feedURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rs
+}
+
+func TestRuleMatches(t *testing.T) {
+	anonymous := RssItem{Title: "Untitled", Content: "no metadata"}
+	tests := []struct {
+		field, op, pattern string
+		item               RssItem
+		want               bool
+	}{
+		{"title", "contains", "RELEASED", ruleItem, true},
+		{"title", "contains", "beta", ruleItem, false},
+		{"title", "regex", `^Go \d+\.\d+`, ruleItem, true},
+		{"title", "regex", `(?i)^golang`, ruleItem, false},
+		{"title", "not", "beta", ruleItem, true},
+		{"title", "not", "go 1", ruleItem, false},
+		// 内容は概要と本文のHTMLを除いて調べる
+		{"content", "contains", "golang team", ruleItem, true},
+		{"content", "contains", "range over", ruleItem, true},
+		{"content", "contains", "<b>", ruleItem, false},
+		{"content", "regex", `\bfunc\b`, ruleItem, true},
+		{"content", "not", "rust", ruleItem, true},
+		// 著者は名前とメールアドレスの両方を調べる
+		{"author", "contains", "alice", ruleItem, true},
+		{"author", "contains", "@example.com", ruleItem, true},
+		{"author", "regex", `^Bob$`, ruleItem, false},
+		{"author", "not", "bob", ruleItem, true},
+		{"author", "not", "alice", ruleItem, false},
+		{"category", "contains", "release", ruleItem, true},
+		{"category", "regex", `^Go$`, ruleItem, true},
+		{"category", "not", "go", ruleItem, false},
+		{"category", "not", "sports", ruleItem, true},
+		// 項目が空ならnotもマッチしない
+		{"author", "not", "bob", anonymous, false},
+		{"category", "not", "sports", anonymous, false},
+		{"author", "contains", "bob", anonymous, false},
+		{"category", "regex", `.*`, anonymous, false},
+	}
+	for _, tt := range tests {
+		db := newTestDB(t)
+		rs := loadTestRules(t, db, "", Rule{Field: tt.field, Operator: tt.op, Pattern: tt.pattern, Action: "star"})
+		if got := rs.evaluate(tt.item).Star; got != tt.want {
+			t.Errorf("%s %s %q on %q: matched = %v, want %v", tt.field, tt.op, tt.pattern, tt.item.Title, got, tt.want)
+		}
+	}
+}
+
+func TestRuleActions(t *testing.T) {
+	db := newTestDB(t)
+	const feedURL = "https://example.com/feed.xml"
+	rs := loadTestRules(t, db, feedURL,
+		Rule{Field: "title", Operator: "contains", Pattern: "go", Action: "tag", Tag: "go"},
+		Rule{Field: "category", Operator: "contains", Pattern: "go", Action: "tag", Tag: "go"}, // 同じタグは1つにまとめる
+		Rule{Field: "content", Operator: "regex", Pattern: `(?i)golang`, Action: "tag", Tag: "lang"},
+		Rule{Field: "author", Operator: "contains", Pattern: "alice", Action: "star"},
+		Rule{Field: "category", Operator: "contains", Pattern: "release", Action: "read"},
+		Rule{Field: "title", Operator: "contains", Pattern: "released", Action: "notify", Notify: "hook"},
+		Rule{Field: "title", Operator: "contains", Pattern: "sponsored", Action: "skip"},
+		// 別のフィードのルールと無効にしたルールは当てはめない
+		Rule{FeedURL: "https://other.example.com/feed.xml", Field: "title", Operator: "contains", Pattern: "go", Action: "skip"},
+	)
+	if err := db.Create(&Rule{Field: "title", Operator: "contains", Pattern: "go", Action: "skip"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&Rule{}).Where("id = (SELECT MAX(id) FROM rules)").Update("enabled", false).Error; err != nil {
+		t.Fatal(err)
+	}
+	if rs, err := loadRules(db, feedURL); err != nil || len(rs.rules) != 7 {
+		t.Fatalf("loaded rules = %v, %v, want 7", rs, err)
+	}
+
+	want := RuleResult{Tags: []string{"go", "lang"}, Star: true, Read: true, Notify: []string{"hook"}}
+	if got := rs.evaluate(ruleItem); !reflect.DeepEqual(got, want) {
+		t.Errorf("evaluate = %+v, want %+v", got, want)
+	}
+	sponsored := RssItem{Title: "Sponsored: buy now"}
+	if got := rs.evaluate(sponsored); !reflect.DeepEqual(got, RuleResult{Skip: true}) {
+		t.Errorf("evaluate sponsored = %+v, want only skip", got)
+	}
+	var none *RuleSet
+	if got := none.evaluate(ruleItem); !reflect.DeepEqual(got, RuleResult{}) {
+		t.Errorf("evaluate without rules = %+v", got)
+	}
+}
+
+func TestUpdateFeedItemsRules(t *testing.T) {
+	db := newTestDB(t)
+	const feedURL = "https://example.com/feed.xml"
+	loadTestRules(t, db, feedURL,
+		Rule{Field: "title", Operator: "contains", Pattern: "sponsored", Action: "skip"},
+		Rule{Field: "category", Operator: "contains", Pattern: "go", Action: "tag", Tag: "go"},
+		Rule{Field: "author", Operator: "contains", Pattern: "alice", Action: "star"},
+		Rule{Field: "content", Operator: "regex", Pattern: `(?i)\bchangelog\b`, Action: "read"},
+	)
+	feed := &gofeed.Feed{Title: "Blog", Link: "https://example.com/", Items: []*gofeed.Item{
+		{GUID: "go", Title: "Go news", Link: "https://example.com/go", Categories: []string{"Go"},
+			Authors: []*gofeed.Person{{Name: "Alice"}}, Description: "see the Changelog"},
+		{GUID: "ad", Title: "Sponsored post", Link: "https://example.com/ad", Categories: []string{"Go"}},
+		{GUID: "plain", Title: "Other news", Link: "https://example.com/plain"},
+	}}
+
+	f := RssFeed{URL: feedURL, Link: feed.Link, Title: feed.Title}
+	if err := db.Create(&f).Error; err != nil {
+		t.Fatal(err)
+	}
+	var counts ItemCounts
+	err := db.Transaction(func(tx *gorm.DB) (err error) {
+		counts, err = updateFeedItems(tx, f.ID, feedURL, feed, nil)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts.New != 2 || counts.Skipped != 1 {
+		t.Fatalf("counts = %+v, want 2 new and 1 skipped", counts)
+	}
+	var ad int64
+	if err := db.Model(&RssItem{}).Where("item_key = ?", "ad").Count(&ad).Error; err != nil || ad != 0 {
+		t.Fatalf("skipped item stored: %d, %v", ad, err)
+	}
+
+	states := itemStates(t, db)
+	if s := states["go"]; !s.Starred || !s.Read || s.Archived {
+		t.Errorf("go item state = %+v, want starred and read", s)
+	}
+	if s := states["plain"]; s.Starred || s.Read {
+		t.Errorf("plain item state = %+v, want untouched", s)
+	}
+	var tags []ItemTag
+	if err := db.Find(&tags).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags[0].ItemID != itemIDByKey(t, db, "go") || tags[0].Name != "go" {
+		t.Errorf("tags = %+v, want go on the go item", tags)
+	}
+}
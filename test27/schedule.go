@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/mmcdole/gofeed/rss"
+	"gorm.io/gorm"
+)
+
+// 取得間隔の設定
+const (
+	defaultPollInterval = time.Hour       // 手がかりがないときの取得間隔
+	minPollInterval     = 5 * time.Minute // フィードのヒントや更新頻度から決めるときの下限
+	maxPollInterval     = 24 * time.Hour  // フィードのヒントや更新頻度から決めるときの上限
+	maxFailureBackoff   = 24 * time.Hour  // 失敗が続いたときに遅らせる上限
+	observedItemSamples = 10              // 更新頻度を求めるときに見る新着の回数
+)
+
+// syndicationPeriods sy:updatePeriodの値ごとの期間
+var syndicationPeriods = map[string]time.Duration{
+	"hourly":  time.Hour,
+	"daily":   24 * time.Hour,
+	"weekly":  7 * 24 * time.Hour,
+	"monthly": 30 * 24 * time.Hour,
+	"yearly":  365 * 24 * time.Hour,
+}
+
+// feedUpdateHint フィードが示している更新間隔を求める
+// RSSの<ttl>（分）を優先し、なければsy:updatePeriod/sy:updateFrequencyを使う。どちらもなければ0
+func feedUpdateHint(body []byte, feed *gofeed.Feed) time.Duration {
+	// gofeedの共通形式には<ttl>が含まれないので、RSSとして読み直す
+	if feed.FeedType == "rss" {
+		if f, err := (&rss.Parser{}).Parse(bytes.NewReader(body)); err == nil {
+			if ttl, err := strconv.Atoi(strings.TrimSpace(f.TTL)); err == nil && ttl > 0 {
+				return time.Duration(ttl) * time.Minute
+			}
+		}
+	}
+
+	sy := feed.Extensions["sy"]
+	if sy == nil {
+		return 0
+	}
+	var period, frequency string
+	if ext := sy["updatePeriod"]; len(ext) > 0 {
+		period = strings.ToLower(strings.TrimSpace(ext[0].Value))
+	}
+	if ext := sy["updateFrequency"]; len(ext) > 0 {
+		frequency = strings.TrimSpace(ext[0].Value)
+	}
+	if period == "" && frequency == "" {
+		return 0
+	}
+
+	// 省略時はdaily、1回
+	d, ok := syndicationPeriods[period]
+	if !ok {
+		d = syndicationPeriods["daily"]
+	}
+	if n, err := strconv.Atoi(frequency); err == nil && n > 0 {
+		d /= time.Duration(n)
+	}
+	return d
+}
+
+// observedInterval 新着アイテムが見つかった時刻の間隔の平均を求める
+// 最後の新着から今までの時間も含めるので、更新が止まったフィードほど間隔が延びる。記録が足りなければ0
+func observedInterval(db *gorm.DB, feedID uint, now time.Time) (time.Duration, error) {
+	var times []time.Time
+	err := db.Model(&RssItem{}).
+		Where("feed_id = ?", feedID).
+		Distinct().
+		Order("first_seen desc").
+		Limit(observedItemSamples).
+		Pluck("first_seen", &times).Error
+	if err != nil {
+		return 0, err
+	}
+	if len(times) < 2 {
+		return 0, nil
+	}
+	oldest := times[len(times)-1]
+	return now.Sub(oldest) / time.Duration(len(times)), nil
+}
+
+// clampInterval 取得間隔を下限と上限の間に収める
+func clampInterval(d time.Duration) time.Duration {
+	if d < minPollInterval {
+		return minPollInterval
+	}
+	if d > maxPollInterval {
+		return maxPollInterval
+	}
+	return d
+}
+
+// pollInterval 購読の取得間隔を決める
+// 購読に指定した間隔、フィードのttl/sy:updatePeriod、観測した更新頻度、既定値の順に使う
+func pollInterval(db *gorm.DB, sub Subscription, feed *RssFeed, now time.Time) (time.Duration, error) {
+	if sub.FetchInterval > 0 {
+		return sub.FetchInterval, nil
+	}
+	if feed == nil {
+		return defaultPollInterval, nil
+	}
+	if feed.UpdateHint > 0 {
+		return clampInterval(feed.UpdateHint), nil
+	}
+	observed, err := observedInterval(db, feed.ID, now)
+	if err != nil {
+		return 0, err
+	}
+	if observed > 0 {
+		return clampInterval(observed), nil
+	}
+	return defaultPollInterval, nil
+}
+
+// failureBackoff 連続して失敗した回数に応じて取得間隔を倍々に延ばす
+func failureBackoff(interval time.Duration, failures int) time.Duration {
+	// もともと上限より長い間隔はそのまま使う
+	backoff := interval
+	for i := 0; i < failures && backoff < maxFailureBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxFailureBackoff && interval < maxFailureBackoff {
+		return maxFailureBackoff
+	}
+	return backoff
+}
+
+// nextFetchTime 購読を次に取得する時刻を求める。まだ取得したことがなければゼロ値（すぐに取得する）
+// 前回の取得時刻（LastFetched、フィードがまだなければ前回試した時刻）に取得間隔を足して決める
+func nextFetchTime(db *gorm.DB, sub Subscription, now time.Time) (time.Time, error) {
+	var feed RssFeed
+	res := db.Where("url = ?", sub.URL).Limit(1).Find(&feed)
+	if res.Error != nil {
+		return time.Time{}, res.Error
+	}
+	var feedPtr *RssFeed
+	if res.RowsAffected > 0 {
+		feedPtr = &feed
+	}
+
+	last := feed.LastFetched
+	if sub.LastAttempt.After(last) {
+		last = sub.LastAttempt
+	}
+	if last.IsZero() {
+		return time.Time{}, nil
+	}
+
+	interval, err := pollInterval(db, sub, feedPtr, now)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if sub.Failures > 0 {
+		interval = failureBackoff(interval, sub.Failures)
+	}
+	return last.Add(interval), nil
+}
+
+// dueSubscriptions 取得時刻を過ぎた有効な購読のURLと、それ以外で最も早い取得時刻を返す
+func dueSubscriptions(db *gorm.DB, now time.Time) ([]string, time.Time, error) {
+	var subs []Subscription
+	if err := db.Where("enabled = ?", true).Find(&subs).Error; err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var urls []string
+	var next time.Time
+	for _, sub := range subs {
+		at, err := nextFetchTime(db, sub, now)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		if !at.After(now) {
+			urls = append(urls, sub.URL)
+		} else if next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	return urls, next, nil
+}
+
+// serve 購読ごとの予定に従ってフィードを取得し続ける
+// SIGINT/SIGTERMを受け取ると新しい取得を始めずに、実行中の取得を打ち切って終了する
+// 使い方: serve [-check 1m] [fetchと同じオプション]
+func serve(db *gorm.DB, args []string) error {
+	opts := defaultFetchOptions
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	opts.addFlags(fs)
+	check := fs.Duration("check", time.Minute, "maximum interval between schedule checks")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fetcher := NewFetcher(db, opts)
+	log.Println("serve: started")
+	for ctx.Err() == nil {
+		urls, next, err := dueSubscriptions(db, time.Now())
+		if err != nil {
+			return err
+		}
+		if len(urls) > 0 {
+			log.Printf("serve: fetching %d feeds", len(urls))
+			fetcher.Run(ctx, urls)
+		}
+		// 新しいアイテムの通知と、失敗した通知の再送
+		if err := deliverNotifications(ctx, db, false); err != nil {
+			log.Printf("serve: notify: %v", err)
+		}
+		if len(urls) > 0 {
+			continue
+		}
+
+		// 次の取得時刻まで待つ（購読の追加や変更に気づけるよう、長くてもcheckごとに確認する）
+		wait := *check
+		if !next.IsZero() && time.Until(next) < wait {
+			wait = time.Until(next)
+		}
+		sleepContext(ctx, wait)
+	}
+	log.Println("serve: stopped")
+	return nil
+}
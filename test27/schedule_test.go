@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"gorm.io/gorm"
+)
+
+// createObservedFeed 新着がeveryごとに見つかったcount件のアイテムを持つフィードを作る
+func createObservedFeed(t *testing.T, db *gorm.DB, url string, hint time.Duration, now time.Time, every time.Duration, count int) *RssFeed {
+	t.Helper()
+	feed := &RssFeed{URL: url, Link: url, Title: url, UpdateHint: hint, LastFetched: now}
+	if err := db.Create(feed).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= count; i++ {
+		item := RssItem{FeedID: feed.ID, ItemKey: fmt.Sprintf("%s-%d", url, i), FirstSeen: now.Add(-time.Duration(i) * every)}
+		if err := db.Create(&item).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return feed
+}
+
+func TestPollInterval(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	hinted := createObservedFeed(t, db, "https://example.com/hinted.xml", 2*time.Hour, now, 10*time.Minute, 5)
+	observed := createObservedFeed(t, db, "https://example.com/observed.xml", 0, now, 3*time.Hour, 4)
+	tooFast := createObservedFeed(t, db, "https://example.com/fast.xml", time.Minute, now, 0, 0)
+	tooSlow := createObservedFeed(t, db, "https://example.com/slow.xml", 0, now, 30*24*time.Hour, 3)
+	single := createObservedFeed(t, db, "https://example.com/single.xml", 0, now, time.Hour, 1)
+
+	for _, tc := range []struct {
+		name string
+		sub  Subscription
+		feed *RssFeed
+		want time.Duration
+	}{
+		{"subscription interval wins over the hint", Subscription{FetchInterval: 10 * time.Minute}, hinted, 10 * time.Minute},
+		{"subscription interval is not clamped", Subscription{FetchInterval: time.Minute}, nil, time.Minute},
+		{"not fetched yet", Subscription{}, nil, defaultPollInterval},
+		{"hint wins over the observed interval", Subscription{}, hinted, 2 * time.Hour},
+		{"hint is clamped to the minimum", Subscription{}, tooFast, minPollInterval},
+		// 4件が3時間ごと: 最も古い12時間前から今までを4で割る
+		{"observed interval", Subscription{}, observed, 3 * time.Hour},
+		{"observed interval is clamped to the maximum", Subscription{}, tooSlow, maxPollInterval},
+		{"too few items to observe", Subscription{}, single, defaultPollInterval},
+	} {
+		got, err := pollInterval(db, tc.sub, tc.feed, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestFailureBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		interval time.Duration
+		failures int
+		want     time.Duration
+	}{
+		{time.Hour, 0, time.Hour},
+		{time.Hour, 1, 2 * time.Hour},
+		{time.Hour, 3, 8 * time.Hour},
+		{time.Hour, 5, maxFailureBackoff}, // 32時間は上限で切る
+		{time.Hour, 100, maxFailureBackoff},
+		{10 * time.Hour, 2, maxFailureBackoff},
+		{48 * time.Hour, 3, 48 * time.Hour}, // もともと上限より長い間隔はそのまま
+	} {
+		if got := failureBackoff(tc.interval, tc.failures); got != tc.want {
+			t.Errorf("failureBackoff(%v, %d) = %v, want %v", tc.interval, tc.failures, got, tc.want)
+		}
+	}
+}
+
+func TestNextFetchTime(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	fetched := now.Add(-30 * time.Minute)
+	createObservedFeed(t, db, "https://example.com/feed.xml", 2*time.Hour, fetched, 0, 0)
+
+	for _, tc := range []struct {
+		name string
+		sub  Subscription
+		want time.Time
+	}{
+		{"never fetched", Subscription{URL: "https://example.com/new.xml"}, time.Time{}},
+		{"failed before the first fetch", Subscription{URL: "https://example.com/new.xml", LastAttempt: now, Failures: 1}, now.Add(2 * defaultPollInterval)},
+		{"last fetch plus the hint", Subscription{URL: "https://example.com/feed.xml"}, fetched.Add(2 * time.Hour)},
+		{"later failed attempt with backoff", Subscription{URL: "https://example.com/feed.xml", LastAttempt: now, Failures: 2}, now.Add(8 * time.Hour)},
+	} {
+		got, err := nextFetchTime(db, tc.sub, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(tc.want) {
+			t.Errorf("%s: %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestFeedUpdateHint(t *testing.T) {
+	for _, tc := range []struct {
+		name, body string
+		want       time.Duration
+	}{
+		{"ttl", `<rss version="2.0"><channel><title>t</title><ttl>90</ttl></channel></rss>`, 90 * time.Minute},
+		{"ttl wins over sy", `<rss version="2.0" xmlns:sy="http://purl.org/rss/1.0/modules/syndication/"><channel><title>t</title><ttl>30</ttl><sy:updatePeriod>daily</sy:updatePeriod></channel></rss>`, 30 * time.Minute},
+		{"sy period and frequency", `<rss version="2.0" xmlns:sy="http://purl.org/rss/1.0/modules/syndication/"><channel><title>t</title><sy:updatePeriod>hourly</sy:updatePeriod><sy:updateFrequency>2</sy:updateFrequency></channel></rss>`, 30 * time.Minute},
+		{"sy frequency defaults to daily", `<rss version="2.0" xmlns:sy="http://purl.org/rss/1.0/modules/syndication/"><channel><title>t</title><sy:updateFrequency>4</sy:updateFrequency></channel></rss>`, 6 * time.Hour},
+		{"no hint", `<rss version="2.0"><channel><title>t</title></channel></rss>`, 0},
+	} {
+		feed, err := gofeed.NewParser().Parse(strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := feedUpdateHint([]byte(tc.body), feed); got != tc.want {
+			t.Errorf("%s: %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
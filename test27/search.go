@@ -0,0 +1,431 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/PuerkitoBio/goquery"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// searchIndexEnabled 全文検索のインデックスが使えるかどうか
+// FTS5はgo-sqlite3を -tags sqlite_fts5 でビルドしたときだけ使える
+var searchIndexEnabled bool
+
+// errSearchUnavailable FTS5なしでビルドされているときのエラー
+var errSearchUnavailable = errors.New("full-text search is unavailable: this binary was built without -tags sqlite_fts5 (rebuild with go build -tags sqlite_fts5, then run search -reindex)")
+
+// searchTokenizer 検索インデックスのトークナイザ
+// 日本語のように単語を空白で区切らない言語でも部分一致で探せるように、3文字ずつに区切るtrigramを使う
+const searchTokenizer = "trigram remove_diacritics 1"
+
+// minTrigramQuery trigramのインデックスで検索できる最短の文字数（これより短い語はLIKEで探す）
+const minTrigramQuery = 3
+
+// setupSearchIndex 全文検索用のFTS5仮想テーブルを作る。作ったばかりなら既存のアイテムを登録する
+// FTS5が使えなければ検索を無効にしてnilを返す
+func setupSearchIndex(db *gorm.DB) error {
+	exists := db.Migrator().HasTable("rss_items_fts")
+	// FTS5がないときのエラーは想定内なのでログに出さない
+	quiet := db.Session(&gorm.Session{Logger: db.Logger.LogMode(logger.Silent)})
+	if exists {
+		// 以前のunicode61で作ったインデックスは日本語を探せないので作り直す
+		var ddl string
+		if err := db.Raw("SELECT sql FROM sqlite_master WHERE name = 'rss_items_fts'").Scan(&ddl).Error; err != nil {
+			return err
+		}
+		if !strings.Contains(ddl, searchTokenizer) {
+			if err := quiet.Exec("DROP TABLE rss_items_fts").Error; err == nil {
+				exists = false
+			}
+		}
+	}
+	err := quiet.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS rss_items_fts
+		USING fts5(title, content, archive, tokenize = '` + searchTokenizer + `')`).Error
+	if err == nil {
+		// FTS5付きでビルドしたときに作ったテーブルが残っていると作成は成功するので、読んで確かめる
+		err = quiet.Exec("SELECT rowid FROM rss_items_fts LIMIT 0").Error
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "no such module: fts5") {
+			return nil
+		}
+		return err
+	}
+	searchIndexEnabled = true
+	if exists {
+		return nil
+	}
+	return reindexItems(db)
+}
+
+// stripHTML HTMLからタグとスクリプト・スタイルを取り除いた本文を返す
+func stripHTML(html string) string {
+	if html == "" {
+		return ""
+	}
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
+	if err != nil {
+		return html
+	}
+	doc.Find("script, style, noscript, template").Remove()
+	return strings.Join(strings.Fields(doc.Text()), " ")
+}
+
+// indexItem アイテムのタイトル・概要・保存したページを検索インデックスに登録し直す
+func indexItem(db *gorm.DB, itemID uint) error {
+	if !searchIndexEnabled {
+		return nil
+	}
+	var item RssItem
+	res := db.Select("id", "title", "content", "body", "content2").Where("id = ?", itemID).Limit(1).Find(&item)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return res.Error
+	}
+
+	// 概要だけのフィードもあるので本文もまとめて登録する
+	content := stripHTML(item.Content)
+	if body := stripHTML(item.Body); body != "" && body != content {
+		content += " " + body
+	}
+	if err := db.Exec("DELETE FROM rss_items_fts WHERE rowid = ?", item.ID).Error; err != nil {
+		return err
+	}
+	return db.Exec("INSERT INTO rss_items_fts (rowid, title, content, archive) VALUES (?, ?, ?, ?)",
+		item.ID, stripHTML(item.Title), content, stripHTML(item.Content2)).Error
+}
+
+// reindexItems すべてのアイテムを検索インデックスに登録し直す
+func reindexItems(db *gorm.DB) error {
+	if !searchIndexEnabled {
+		return errSearchUnavailable
+	}
+	var ids []uint
+	if err := db.Model(&RssItem{}).Order("id").Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM rss_items_fts").Error; err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := indexItem(tx, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SearchResult 検索にヒットしたアイテム
+type SearchResult struct {
+	ID        uint
+	Title     string
+	Link      string
+	FeedTitle string
+	Published time.Time
+	FirstSeen time.Time
+	Snippet   string
+	Rank      float64
+}
+
+// SearchOptions 検索の条件
+type SearchOptions struct {
+	FeedURL string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+	Mark    [2]string // ヒットした語の前後に付ける文字列
+}
+
+// searchTerm 検索式の語。"フレーズ"は1つの語にする
+type searchTerm struct {
+	Text   string
+	Prefix bool // 末尾に*が付いている（前方一致）
+}
+
+// parseSearchQuery 検索式を空白で区切った語に分ける
+// OR・NOT・NEAR・括弧・列の指定などFTS5の演算子を使った式ならfalse（検索式をそのままMATCHに渡す）
+func parseSearchQuery(query string) ([]searchTerm, bool) {
+	var terms []searchTerm
+	rs := []rune(query)
+	for i := 0; i < len(rs); {
+		if rs[i] == ' ' || rs[i] == '\t' || rs[i] == '\n' {
+			i++
+			continue
+		}
+		var term searchTerm
+		if rs[i] == '"' {
+			// ""は"そのもの
+			var b strings.Builder
+			for i++; i < len(rs); i++ {
+				if rs[i] == '"' {
+					if i+1 < len(rs) && rs[i+1] == '"' {
+						b.WriteRune('"')
+						i++
+						continue
+					}
+					i++
+					break
+				}
+				b.WriteRune(rs[i])
+			}
+			term.Text = b.String()
+			// "フレーズ" * の形の前方一致
+			j := i
+			for j < len(rs) && rs[j] == ' ' {
+				j++
+			}
+			if j < len(rs) && rs[j] == '*' {
+				i = j
+			}
+		} else {
+			j := i
+			for j < len(rs) && rs[j] != ' ' && rs[j] != '\t' && rs[j] != '\n' && rs[j] != '"' {
+				j++
+			}
+			term.Text = string(rs[i:j])
+			i = j
+			switch {
+			case term.Text == "AND":
+				continue
+			case term.Text == "OR" || term.Text == "NOT" || term.Text == "NEAR" || strings.ContainsAny(term.Text, "():^{}"):
+				return nil, false
+			}
+		}
+		if i < len(rs) && rs[i] == '*' {
+			term.Prefix = true
+			i++
+		} else if strings.HasSuffix(term.Text, "*") {
+			term.Prefix = true
+			term.Text = strings.TrimRight(term.Text, "*")
+		}
+		if strings.TrimSpace(term.Text) != "" {
+			terms = append(terms, term)
+		}
+	}
+	return terms, true
+}
+
+// ftsPhrase 語をFTS5のフレーズとして書く（記号を含む語もそのまま探せる）
+func ftsPhrase(t searchTerm) string {
+	p := `"` + strings.ReplaceAll(t.Text, `"`, `""`) + `"`
+	if t.Prefix {
+		p += " *"
+	}
+	return p
+}
+
+// searchItems FTS5の検索式（"フレーズ"やprefix*が使える）でアイテムを探し、関連度の高い順に返す
+// trigramでは3文字より短い語がヒットしないので、短い語はインデックスの部分一致（LIKE）で絞り込む
+// すべての語が短ければ関連度が求められないので、新しい順に返す
+func searchItems(db *gorm.DB, query string, opts SearchOptions) ([]SearchResult, error) {
+	if !searchIndexEnabled {
+		return nil, errSearchUnavailable
+	}
+	query = strings.TrimSpace(query)
+
+	match := query
+	var shortTerms []string
+	if terms, ok := parseSearchQuery(query); ok {
+		var phrases []string
+		for _, t := range terms {
+			if utf8.RuneCountInString(t.Text) < minTrigramQuery {
+				shortTerms = append(shortTerms, t.Text)
+			} else {
+				phrases = append(phrases, ftsPhrase(t))
+			}
+		}
+		match = strings.Join(phrases, " ")
+	}
+	likeOnly := match == ""
+	if likeOnly && len(shortTerms) == 0 {
+		return nil, errors.New("empty search query")
+	}
+
+	// タイトルの一致を重く、保存したページの一致を軽く見る
+	sql := `SELECT i.id, i.title, i.link, f.title AS feed_title, i.published, i.first_seen,
+			snippet(rss_items_fts, -1, ?, ?, '…', 16) AS snippet,
+			bm25(rss_items_fts, 10.0, 3.0, 1.0) AS rank
+		FROM rss_items_fts
+		JOIN rss_items i ON i.id = rss_items_fts.rowid
+		JOIN rss_feeds f ON f.id = i.feed_id
+		WHERE rss_items_fts MATCH ?`
+	args := []interface{}{opts.Mark[0], opts.Mark[1], match}
+	if likeOnly {
+		// snippetとbm25はMATCHでしか使えないので、抜粋は最初の語からGoで作る
+		like := "%" + escapeLike(shortTerms[0]) + "%"
+		sql = `SELECT i.id, i.title, i.link, f.title AS feed_title, i.published, i.first_seen,
+				CASE WHEN rss_items_fts.content LIKE ? ESCAPE '\' THEN rss_items_fts.content
+					WHEN rss_items_fts.archive LIKE ? ESCAPE '\' THEN rss_items_fts.archive
+					ELSE rss_items_fts.title END AS snippet
+			FROM rss_items_fts
+			JOIN rss_items i ON i.id = rss_items_fts.rowid
+			JOIN rss_feeds f ON f.id = i.feed_id
+			WHERE 1 = 1`
+		args = []interface{}{like, like}
+	}
+	for _, term := range shortTerms {
+		like := "%" + escapeLike(term) + "%"
+		sql += ` AND (rss_items_fts.title LIKE ? ESCAPE '\' OR rss_items_fts.content LIKE ? ESCAPE '\' OR rss_items_fts.archive LIKE ? ESCAPE '\')`
+		args = append(args, like, like, like)
+	}
+
+	// 公開日時がなければ初めて取得した時間で絞り込む（タイムゾーンが混在するのでjuliandayで比べる）
+	date := "julianday(CASE WHEN i.published = ? THEN i.first_seen ELSE i.published END)"
+	if opts.FeedURL != "" {
+		sql += " AND f.url = ?"
+		args = append(args, opts.FeedURL)
+	}
+	if !opts.Since.IsZero() {
+		sql += " AND " + date + " >= julianday(?)"
+		args = append(args, time.Time{}, opts.Since)
+	}
+	if !opts.Until.IsZero() {
+		sql += " AND " + date + " < julianday(?)"
+		args = append(args, time.Time{}, opts.Until)
+	}
+	if likeOnly {
+		sql += " ORDER BY " + date + " DESC LIMIT ?"
+		args = append(args, time.Time{}, opts.Limit)
+	} else {
+		sql += " ORDER BY rank LIMIT ?"
+		args = append(args, opts.Limit)
+	}
+
+	var results []SearchResult
+	if err := db.Raw(sql, args...).Scan(&results).Error; err != nil {
+		return nil, fmt.Errorf("search failed (check the query syntax): %v", err)
+	}
+	if likeOnly {
+		for i := range results {
+			results[i].Snippet = likeSnippet(results[i].Snippet, shortTerms[0], opts.Mark)
+		}
+	}
+	return results, nil
+}
+
+// likeEscaper LIKEのパターンで特別な意味を持つ文字をエスケープする（ESCAPE '\' と一緒に使う）
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// escapeLike 文字列をそのまま探すLIKEのパターンにする
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// likeSnippet 本文のうち最初にtermを含むあたりを切り出し、termの前後にmarkを付ける
+func likeSnippet(text, term string, mark [2]string) string {
+	const around = 32 // 前後に残す文字数
+	runes := []rune(text)
+	lower := []rune(strings.ToLower(text))
+	needle := []rune(strings.ToLower(term))
+	at := -1
+	if len(lower) == len(runes) {
+		at = runeIndex(lower, needle)
+	}
+	if at < 0 {
+		if len(runes) > 2*around {
+			return string(runes[:2*around]) + "…"
+		}
+		return text
+	}
+
+	start, end := max(at-around, 0), min(at+len(needle)+around, len(runes))
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	b.WriteString(string(runes[start:at]))
+	b.WriteString(mark[0] + string(runes[at:at+len(needle)]) + mark[1])
+	b.WriteString(string(runes[at+len(needle) : end]))
+	if end < len(runes) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// runeIndex sの中でsubが最初に現れる位置（なければ-1）
+func runeIndex(s, sub []rune) int {
+	for i := 0; i+len(sub) <= len(s); i++ {
+		if string(s[i:i+len(sub)]) == string(sub) {
+			return i
+		}
+	}
+	return -1
+}
+
+// isTerminal 標準出力が端末かどうか（端末なら色を付けて表示する）
+func isTerminal() bool {
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// searchCommand 保存したアイテムを全文検索する
+// 使い方: search [-feed URL] [-since 2024-01-01] [-until 2024-02-01] [-limit 20] [-reindex] 検索式
+func searchCommand(db *gorm.DB, args []string) error {
+	fs := flag.NewFlagSet("search", flag.ContinueOnError)
+	feedURL := fs.String("feed", "", "only items of the feed with this URL")
+	since := fs.String("since", "", "only items published on or after this date (YYYY-MM-DD)")
+	until := fs.String("until", "", "only items published before this date (YYYY-MM-DD)")
+	limit := fs.Int("limit", 20, "maximum number of results")
+	reindex := fs.Bool("reindex", false, "rebuild the search index")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if !searchIndexEnabled {
+		return errSearchUnavailable
+	}
+
+	if *reindex {
+		if err := reindexItems(db); err != nil {
+			return err
+		}
+		fmt.Println("検索インデックスを作り直しました。")
+		if fs.NArg() == 0 {
+			return nil
+		}
+	}
+	if fs.NArg() == 0 {
+		return errors.New(`usage: search [-feed URL] [-since YYYY-MM-DD] [-until YYYY-MM-DD] [-limit n] QUERY (e.g. '"exact phrase"', 'gola*')`)
+	}
+
+	opts := SearchOptions{FeedURL: *feedURL, Limit: *limit, Mark: [2]string{"[", "]"}}
+	if isTerminal() {
+		opts.Mark = [2]string{"\033[1;33m", "\033[0m"}
+	}
+	for _, d := range []struct {
+		value string
+		dst   *time.Time
+	}{{*since, &opts.Since}, {*until, &opts.Until}} {
+		if d.value == "" {
+			continue
+		}
+		t, err := time.ParseInLocation("2006-01-02", d.value, time.Local)
+		if err != nil {
+			return fmt.Errorf("invalid date %q: %v", d.value, err)
+		}
+		*d.dst = t
+	}
+
+	results, err := searchItems(db, strings.Join(fs.Args(), " "), opts)
+	if err != nil {
+		return err
+	}
+	for _, r := range results {
+		date := r.Published
+		if date.IsZero() {
+			date = r.FirstSeen
+		}
+		fmt.Printf("%s  %s  (%s)\n", formatTime(date), r.Title, r.FeedTitle)
+		fmt.Printf("    %s\n", r.Link)
+		fmt.Printf("    %s\n", r.Snippet)
+	}
+	fmt.Printf("%d results\n", len(results))
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func TestSearchCJK(t *testing.T) {
+	db := newTestDB(t)
+	if !searchIndexEnabled {
+		t.Skip("built without -tags sqlite_fts5")
+	}
+	feed := &gofeed.Feed{Title: "ブログ", Items: []*gofeed.Item{
+		{GUID: "1", Title: "東京都の天気予報", Link: "https://example.com/1", Description: "明日は晴れのち曇りでしょう。"},
+		{GUID: "2", Title: "Go言語の並行処理", Link: "https://example.com/2", Description: "goroutineとchannelの使い方"},
+		{GUID: "3", Title: "100% done_ok", Link: "https://example.com/3", Description: "progress"},
+	}}
+	if _, err := upsertFeedByURL(db, feed, "https://example.com/feed.xml", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  string // 最初にヒットするアイテムのタイトル（空ならヒットしない）
+	}{
+		{"天気予報", "東京都の天気予報"}, // 空白で区切られていない語の途中
+		{"晴れのち", "東京都の天気予報"},
+		{"並行", "Go言語の並行処理"}, // trigramより短い語
+		{"gorout*", "Go言語の並行処理"},
+		{"%", "100% done_ok"}, // LIKEのワイルドカードは文字として探す
+		{"_", "100% done_ok"},
+		{"大阪府", ""},
+	} {
+		results, err := searchItems(db, tc.query, SearchOptions{Limit: 10, Mark: [2]string{"[", "]"}})
+		if err != nil {
+			t.Fatalf("%q: %v", tc.query, err)
+		}
+		if tc.want == "" {
+			if len(results) != 0 {
+				t.Errorf("%q: got %d results, want none", tc.query, len(results))
+			}
+			continue
+		}
+		if len(results) != 1 || results[0].Title != tc.want {
+			t.Errorf("%q: got %+v, want %q", tc.query, results, tc.want)
+		}
+	}
+}
+
+func TestLikeSnippet(t *testing.T) {
+	if got := likeSnippet("明日は晴れのち曇り", "晴れ", [2]string{"[", "]"}); got != "明日は[晴れ]のち曇り" {
+		t.Fatalf("snippet = %q", got)
+	}
+}
+
+func TestSearchIndexRebuiltWithTrigram(t *testing.T) {
+	db := newTestDB(t)
+	if !searchIndexEnabled {
+		t.Skip("built without -tags sqlite_fts5")
+	}
+	feed := &gofeed.Feed{Title: "ブログ", Items: []*gofeed.Item{{GUID: "1", Title: "東京都の天気予報", Link: "https://example.com/1"}}}
+	if _, err := upsertFeedByURL(db, feed, "https://example.com/feed.xml", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 以前のバージョンが作ったunicode61のインデックスは作り直して登録し直す
+	if err := db.Exec("DROP TABLE rss_items_fts").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("CREATE VIRTUAL TABLE rss_items_fts USING fts5(title, content, archive, tokenize = 'unicode61 remove_diacritics 2')").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := setupSearchIndex(db); err != nil {
+		t.Fatal(err)
+	}
+	results, err := searchItems(db, "天気予報", SearchOptions{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("got %d results after rebuilding the index, want 1", len(results))
+	}
+}
+
+func TestSearchMultiWord(t *testing.T) {
+	db := newTestDB(t)
+	if !searchIndexEnabled {
+		t.Skip("built without -tags sqlite_fts5")
+	}
+	feed := &gofeed.Feed{Title: "Tech", Items: []*gofeed.Item{
+		{GUID: "1", Title: "Go vs Rust for services", Link: "https://example.com/1", Description: "latency benchmark"},
+		{GUID: "2", Title: "Rust in the kernel", Link: "https://example.com/2", Description: "drivers"},
+		{GUID: "3", Title: "C++ and AI tooling", Link: "https://example.com/3", Description: "compilers"},
+		{GUID: "4", Title: "AI news roundup", Link: "https://example.com/4", Description: "weekly"},
+		{GUID: "5", Title: "Local news", Link: "https://example.com/5", Description: "weather"},
+	}}
+	if _, err := upsertFeedByURL(db, feed, "https://example.com/feed.xml", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  []string // ヒットするアイテムのGUID（順不同）
+	}{
+		{"go vs rust", []string{"1"}},               // 3文字より短い語を含む
+		{"rust", []string{"1", "2"}},                //
+		{"C++ ai", []string{"3"}},                   // 記号を含む語と短い語
+		{`"AI" news`, []string{"4"}},                // 短いフレーズ
+		{"ai", []string{"3", "4"}},                  // 短い語だけ
+		{"news OR kernel", []string{"2", "4", "5"}}, // 演算子を使った式はそのまま
+		{"rust*", []string{"1", "2"}},
+		{"go python", nil},
+	} {
+		results, err := searchItems(db, tc.query, SearchOptions{Limit: 10})
+		if err != nil {
+			t.Fatalf("%q: %v", tc.query, err)
+		}
+		got := map[string]bool{}
+		for _, r := range results {
+			got[strings.TrimPrefix(r.Link, "https://example.com/")] = true
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%q: got %v, want %v", tc.query, got, tc.want)
+			continue
+		}
+		for _, id := range tc.want {
+			if !got[id] {
+				t.Errorf("%q: got %v, want %v", tc.query, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	terms, ok := parseSearchQuery(`go "say ""hi""" gorout* "pre" *`)
+	want := []searchTerm{{"go", false}, {`say "hi"`, false}, {"gorout", true}, {"pre", true}}
+	if !ok || len(terms) != len(want) {
+		t.Fatalf("terms = %+v, %v", terms, ok)
+	}
+	for i := range want {
+		if terms[i] != want[i] {
+			t.Errorf("term %d = %+v, want %+v", i, terms[i], want[i])
+		}
+	}
+	for _, q := range []string{"a OR b", "NOT x", "NEAR(a b)", "title:go"} {
+		if _, ok := parseSearchQuery(q); ok {
+			t.Errorf("%q should be passed to MATCH as is", q)
+		}
+	}
+}
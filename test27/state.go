@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ItemState アイテムの既読・スター・アーカイブの状態
+// アイテムの行とは別のテーブルにしているので、フィードを取り込み直しても消えない
+type ItemState struct {
+	ItemID    uint `gorm:"primaryKey;autoIncrement:false"`
+	Read      bool `gorm:"not null;default:false"`
+	Starred   bool `gorm:"not null;default:false"`
+	Archived  bool `gorm:"not null;default:false"`
+	UpdatedAt time.Time
+}
+
+// ItemTag 利用者がアイテムに付けたタグ（フィードのカテゴリとは別）
+type ItemTag struct {
+	ID     uint   `gorm:"primaryKey"`
+	ItemID uint   `gorm:"uniqueIndex:idx_item_tag"`
+	Name   string `gorm:"uniqueIndex:idx_item_tag"`
+}
+
+// itemStateActions markコマンドの操作ごとに変更する列と値
+var itemStateActions = map[string]struct {
+	column string
+	value  bool
+}{
+	"read":      {"read", true},
+	"unread":    {"read", false},
+	"star":      {"starred", true},
+	"unstar":    {"starred", false},
+	"archive":   {"archived", true},
+	"unarchive": {"archived", false},
+}
+
+// ItemFilter アイテムを絞り込む条件
+type ItemFilter struct {
+	FeedURL  string
+	Category string // フィードのカテゴリ
+	Author   string
+	Media    string // 添付ファイルのMIMEタイプの前方一致
+	Tag      string // 利用者が付けたタグ
+	Unread   bool
+	Starred  bool
+	Archived bool // アーカイブしたアイテムだけにする
+	Days     int  // この日数より古いアイテムだけにする（0なら絞り込まない）
+}
+
+// addFlags 絞り込みの条件をコマンドラインのフラグに登録する
+func (f *ItemFilter) addFlags(fs *flag.FlagSet) {
+	fs.StringVar(&f.FeedURL, "feed", f.FeedURL, "only items of the feed with this URL")
+	fs.StringVar(&f.Category, "category", f.Category, "only items in this feed category")
+	fs.StringVar(&f.Author, "author", f.Author, "only items by this author")
+	fs.StringVar(&f.Media, "media", f.Media, "only items with enclosures of this MIME type prefix (e.g. audio, video/mp4)")
+	fs.StringVar(&f.Tag, "tag", f.Tag, "only items with this user tag")
+	fs.BoolVar(&f.Unread, "unread", f.Unread, "only unread items")
+	fs.BoolVar(&f.Starred, "starred", f.Starred, "only starred items")
+	fs.BoolVar(&f.Archived, "archived", f.Archived, "only archived items")
+	fs.IntVar(&f.Days, "days", f.Days, "only items older than this many days")
+}
+
+// empty 条件が何も指定されていないかどうか
+func (f ItemFilter) empty() bool {
+	return f == ItemFilter{}
+}
+
+// apply qに絞り込みの条件を加える。hideArchivedならArchivedの指定がない限りアーカイブしたアイテムを除く
+func (f ItemFilter) apply(db, q *gorm.DB, hideArchived bool) *gorm.DB {
+	states := func(column string) *gorm.DB {
+		return db.Model(&ItemState{}).Select("item_id").Where(column+" = ?", true)
+	}
+	if f.FeedURL != "" {
+		q = q.Where("feed_id IN (?)", db.Model(&RssFeed{}).Select("id").Where("url = ?", f.FeedURL))
+	}
+	if f.Category != "" {
+		q = q.Where("id IN (?)", db.Model(&RssItemCategory{}).Select("item_id").Where("LOWER(name) = LOWER(?)", f.Category))
+	}
+	if f.Author != "" {
+		q = q.Where("id IN (?)", db.Model(&RssItemAuthor{}).Select("item_id").Where("LOWER(name) = LOWER(?)", f.Author))
+	}
+	if f.Media != "" {
+		q = q.Where("id IN (?)", db.Model(&RssItemEnclosure{}).Select("item_id").Where("type LIKE ?", f.Media+"%"))
+	}
+	if f.Tag != "" {
+		q = q.Where("id IN (?)", db.Model(&ItemTag{}).Select("item_id").Where("name = ?", f.Tag))
+	}
+	if f.Unread {
+		q = q.Where("id NOT IN (?)", states("read"))
+	}
+	if f.Starred {
+		q = q.Where("id IN (?)", states("starred"))
+	}
+	if f.Archived {
+		q = q.Where("id IN (?)", states("archived"))
+	} else if hideArchived {
+		q = q.Where("id NOT IN (?)", states("archived"))
+	}
+	if f.Days > 0 {
+		// 公開日時がなければ初めて取得した時間で比べる（タイムゾーンが混在するのでjuliandayで比べる）
+		before := time.Now().AddDate(0, 0, -f.Days)
+		q = q.Where("julianday(CASE WHEN published = ? THEN first_seen ELSE published END) < julianday(?)", time.Time{}, before)
+	}
+	return q
+}
+
+// setItemState itemsで選んだアイテムの状態の列を変更し、変更したアイテムの数を返す
+func setItemState(db *gorm.DB, items *gorm.DB, column string, value bool) (int64, error) {
+	var n int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// 状態の行がまだないアイテムの分を作る
+		err := tx.Exec("INSERT INTO item_states (item_id, updated_at) SELECT id, ? FROM rss_items WHERE id IN (?) ON CONFLICT (item_id) DO NOTHING",
+			time.Now(), items).Error
+		if err != nil {
+			return err
+		}
+		res := tx.Model(&ItemState{}).Where("item_id IN (?)", items).Where(column+" <> ?", value).Update(column, value)
+		n = res.RowsAffected
+		return res.Error
+	})
+	return n, err
+}
+
+// parseItemIDs コマンドラインのアイテムIDを読む
+func parseItemIDs(args []string) ([]uint, error) {
+	ids := make([]uint, 0, len(args))
+	for _, a := range args {
+		id, err := strconv.ParseUint(strings.TrimPrefix(a, "#"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid item ID: %s", a)
+		}
+		ids = append(ids, uint(id))
+	}
+	return ids, nil
+}
+
+// markItems アイテムを既読・スター付き・アーカイブにする（またはその逆）
+// IDを指定しなければ、絞り込みの条件に合うアイテムをまとめて変更する
+// 使い方: mark [-feed URL] [-days N] [-all] ... read|unread|star|unstar|archive|unarchive [ID...]
+func markItems(db *gorm.DB, args []string) error {
+	var filter ItemFilter
+	fs := flag.NewFlagSet("mark", flag.ContinueOnError)
+	filter.addFlags(fs)
+	all := fs.Bool("all", false, "change all items (required when no ID or filter is given)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	usage := errors.New("usage: mark [-feed URL] [-days N] [-all] ... read|unread|star|unstar|archive|unarchive [ID...]")
+	if fs.NArg() == 0 {
+		return usage
+	}
+	action, ok := itemStateActions[fs.Arg(0)]
+	if !ok {
+		return usage
+	}
+	ids, err := parseItemIDs(fs.Args()[1:])
+	if err != nil {
+		return err
+	}
+	// 条件なしですべてのアイテムを変えてしまわないよう、-allを求める
+	if len(ids) == 0 && filter.empty() && !*all {
+		return errors.New("specify item IDs, a filter (e.g. -feed, -days) or -all")
+	}
+
+	items := filter.apply(db, db.Model(&RssItem{}).Select("id"), false)
+	if len(ids) > 0 {
+		items = items.Where("id IN ?", ids)
+	}
+	n, err := setItemState(db, items, action.column, action.value)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d items marked %s\n", n, fs.Arg(0))
+	return nil
+}
+
+// tagItem アイテムにタグを付ける（removeなら外す）
+// 使い方: tag ID TAG... / untag ID TAG...
+func tagItem(db *gorm.DB, args []string, remove bool) error {
+	if len(args) < 2 {
+		return errors.New("usage: tag|untag ID TAG...")
+	}
+	ids, err := parseItemIDs(args[:1])
+	if err != nil {
+		return err
+	}
+	var count int64
+	if err := db.Model(&RssItem{}).Where("id = ?", ids[0]).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("item not found: %d", ids[0])
+	}
+
+	for _, name := range args[1:] {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if remove {
+			err = db.Where("item_id = ? AND name = ?", ids[0], name).Delete(&ItemTag{}).Error
+		} else {
+			err = db.Clauses(clause.OnConflict{DoNothing: true}).Create(&ItemTag{ItemID: ids[0], Name: name}).Error
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"gorm.io/gorm"
+)
+
+// stateFeed 公開日時が1日前・10日前・40日前のアイテムを持つフィード
+func stateFeed(now time.Time) *gofeed.Feed {
+	feed := &gofeed.Feed{Title: "Blog", Link: "https://example.com/"}
+	for _, d := range []struct {
+		guid string
+		days int
+	}{{"new", 1}, {"mid", 10}, {"old", 40}} {
+		published := now.AddDate(0, 0, -d.days)
+		feed.Items = append(feed.Items, &gofeed.Item{GUID: d.guid, Title: "Post " + d.guid, Link: "https://example.com/" + d.guid,
+			Description: "summary", PublishedParsed: &published})
+	}
+	return feed
+}
+
+// itemStates アイテムの識別子ごとの状態（状態の行がなければゼロ値）
+func itemStates(t *testing.T, db *gorm.DB) map[string]ItemState {
+	t.Helper()
+	var items []RssItem
+	if err := db.Preload("State").Find(&items).Error; err != nil {
+		t.Fatal(err)
+	}
+	m := map[string]ItemState{}
+	for _, item := range items {
+		if item.State != nil {
+			m[item.ItemKey] = *item.State
+		} else {
+			m[item.ItemKey] = ItemState{}
+		}
+	}
+	return m
+}
+
+// itemIDByKey 識別子からアイテムのIDを求める
+func itemIDByKey(t *testing.T, db *gorm.DB, key string) uint {
+	t.Helper()
+	var item RssItem
+	if err := db.Where("item_key = ?", key).First(&item).Error; err != nil {
+		t.Fatal(err)
+	}
+	return item.ID
+}
+
+func TestSetItemState(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := upsertFeedByURL(db, stateFeed(time.Now()), "https://example.com/feed.xml", nil); err != nil {
+		t.Fatal(err)
+	}
+	items := db.Model(&RssItem{}).Select("id").Where("item_key IN ?", []string{"new", "mid"})
+
+	n, err := setItemState(db, items, "starred", true)
+	if err != nil || n != 2 {
+		t.Fatalf("star: %d, %v, want 2 changed", n, err)
+	}
+	// すでにその状態のアイテムは数えない
+	n, err = setItemState(db, db.Model(&RssItem{}).Select("id"), "starred", true)
+	if err != nil || n != 1 {
+		t.Fatalf("star all: %d, %v, want 1 changed", n, err)
+	}
+	n, err = setItemState(db, items, "starred", false)
+	if err != nil || n != 2 {
+		t.Fatalf("unstar: %d, %v, want 2 changed", n, err)
+	}
+	states := itemStates(t, db)
+	if states["new"].Starred || states["mid"].Starred || !states["old"].Starred {
+		t.Fatalf("states = %+v", states)
+	}
+}
+
+func TestMarkItems(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now()
+	const blogURL = "https://example.com/feed.xml"
+	if _, err := upsertFeedByURL(db, stateFeed(now), blogURL, nil); err != nil {
+		t.Fatal(err)
+	}
+	other := &gofeed.Feed{Title: "Other", Link: "https://other.example.com/", Items: []*gofeed.Item{{GUID: "other", Title: "Other post", Link: "https://other.example.com/1"}}}
+	if _, err := upsertFeedByURL(db, other, "https://other.example.com/feed.xml", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 条件もIDもなければ-allが必要
+	if err := markItems(db, []string{"read"}); err == nil {
+		t.Fatal("mark read without a filter or -all succeeded")
+	}
+
+	// フィードをまとめて既読にする
+	if err := markItems(db, []string{"-feed", blogURL, "read"}); err != nil {
+		t.Fatal(err)
+	}
+	states := itemStates(t, db)
+	if !states["new"].Read || !states["mid"].Read || !states["old"].Read || states["other"].Read {
+		t.Fatalf("after marking the feed read: %+v", states)
+	}
+
+	// 30日より古いものだけアーカイブする
+	if err := markItems(db, []string{"-days", "30", "archive"}); err != nil {
+		t.Fatal(err)
+	}
+	states = itemStates(t, db)
+	if !states["old"].Archived || states["mid"].Archived || states["new"].Archived || states["other"].Archived {
+		t.Fatalf("after archiving old items: %+v", states)
+	}
+
+	// IDを指定して戻す
+	if err := markItems(db, []string{"unread", "#" + fmt.Sprint(itemIDByKey(t, db, "mid"))}); err != nil {
+		t.Fatal(err)
+	}
+	if states = itemStates(t, db); states["mid"].Read || !states["new"].Read {
+		t.Fatalf("after marking one item unread: %+v", states)
+	}
+}
+
+func TestItemStateSurvivesRefresh(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now()
+	const blogURL = "https://example.com/feed.xml"
+	if _, err := upsertFeedByURL(db, stateFeed(now), blogURL, nil); err != nil {
+		t.Fatal(err)
+	}
+	ids := map[string]uint{}
+	for _, key := range []string{"new", "mid", "old"} {
+		ids[key] = itemIDByKey(t, db, key)
+	}
+	byKey := func(keys ...string) *gorm.DB {
+		return db.Model(&RssItem{}).Select("id").Where("item_key IN ?", keys)
+	}
+	for _, c := range []struct {
+		column string
+		keys   []string
+	}{{"read", []string{"new", "mid"}}, {"starred", []string{"mid"}}, {"archived", []string{"old"}}} {
+		if _, err := setItemState(db, byKey(c.keys...), c.column, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tagItem(db, []string{fmt.Sprint(ids["new"]), "later"}, false); err != nil {
+		t.Fatal(err)
+	}
+	want := itemStates(t, db)
+
+	// 同じフィードを取り込み直し、内容が変わったアイテムも更新する
+	feed := stateFeed(now)
+	feed.Items[1].Description = "edited summary"
+	counts, err := upsertFeedByURL(db, feed, blogURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts.Updated != 1 || counts.New != 0 {
+		t.Fatalf("refresh: %+v, want 1 updated and no new items", counts)
+	}
+
+	for key, id := range ids {
+		if got := itemIDByKey(t, db, key); got != id {
+			t.Errorf("%s: ID changed from %d to %d", key, id, got)
+		}
+	}
+	got := itemStates(t, db)
+	for key, w := range want {
+		g := got[key]
+		if g.Read != w.Read || g.Starred != w.Starred || g.Archived != w.Archived {
+			t.Errorf("%s: state %+v after refresh, want %+v", key, g, w)
+		}
+	}
+	var tags []ItemTag
+	if err := db.Find(&tags).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags[0].ItemID != ids["new"] || tags[0].Name != "later" {
+		t.Errorf("tags after refresh = %+v", tags)
+	}
+	// 絞り込みも状態どおりに働く
+	var unread []RssItem
+	if err := (ItemFilter{Unread: true}).apply(db, db.Model(&RssItem{}), true).Find(&unread).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(unread) != 0 {
+		t.Errorf("unread (excluding archived) = %d items, want 0", len(unread))
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Subscription 購読するフィードの設定
+type Subscription struct {
+	ID             uint          `gorm:"primaryKey"`
+	URL            string        `gorm:"unique"` // フィードのURL
+	Title          string        // 表示用のタイトル（空ならフィードのタイトルを使う）
+	Category       string        // カテゴリ（フォルダ）
+	Enabled        bool          `gorm:"default:true"` // falseなら取得しない
+	FetchInterval  time.Duration // 取得間隔（0ならfetchでは毎回取得し、serveではフィードから決める）
+	LastAttempt    time.Time     // 最後に取得を試した時間（失敗した場合も含む）
+	Failures       int           // 連続して取得に失敗した回数（成功すると0に戻す）
+	DisabledReason string        // 失敗が続いて自動で無効にした理由（手動で無効にした場合は空）
+	CreatedAt      time.Time
+}
+
+// rss.dbを初めて作ったときに登録する既定のフィードURL
+var defaultURLs = []string{
+	"https://rss.nytimes.com/services/xml/rss/nyt/World.xml",
+	"https://feeds.bbci.co.uk/news/world/rss.xml",
+	"https://www.npr.org/rss/rss.php?id=1001",
+	"http://rss.cnn.com/rss/cnn_topstories.rss",
+	"http://feeds.reuters.com/reuters/topNews",
+	"https://www.theguardian.com/world/rss",
+	"https://www.aljazeera.com/xml/rss/all.xml",
+	"https://hnrss.org/frontpage",
+	"http://feeds.feedburner.com/TechCrunch/",
+	"https://xkcd.com/atom.xml", // 特定のフィード
+}
+
+// seedSubscriptions 既定のフィードを登録する。購読のテーブルを作ったときに一度だけ呼ぶ
+func seedSubscriptions(db *gorm.DB) error {
+	for _, url := range defaultURLs {
+		if err := db.Create(&Subscription{URL: url, Enabled: true}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isSubscriptionDue 取得間隔を過ぎていて、フィードを取得すべきかどうか
+func isSubscriptionDue(db *gorm.DB, sub Subscription) (bool, error) {
+	if sub.FetchInterval <= 0 {
+		return true, nil
+	}
+	var feed RssFeed
+	err := db.Where("url = ?", sub.URL).First(&feed).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return time.Since(feed.LastFetched) >= sub.FetchInterval, nil
+}
+
+// findSubscription URLから購読を探す
+func findSubscription(db *gorm.DB, url string) (*Subscription, error) {
+	var sub Subscription
+	err := db.Where("url = ?", url).First(&sub).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("subscription not found: %s", url)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+// addSubscription 購読を追加する
+// URLがフィードでなければページからフィードを探し、複数あれば選んでもらう
+// 使い方: add [-title タイトル] [-category カテゴリ] [-interval 1h] [-pick N] [-no-discover] URL
+func addSubscription(db *gorm.DB, args []string) error {
+	fs := flag.NewFlagSet("add", flag.ContinueOnError)
+	title := fs.String("title", "", "title shown instead of the feed title")
+	category := fs.String("category", "", "category (folder)")
+	interval := fs.Duration("interval", 0, "fetch interval (e.g. 30m, 1h)")
+	pick := fs.Int("pick", 0, "subscribe to the Nth discovered feed instead of asking")
+	noDiscover := fs.Bool("no-discover", false, "add the URL as is without looking for feeds on the page")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: add [-title title] [-category category] [-interval duration] [-pick N] [-no-discover] URL")
+	}
+
+	// サイトのトップページのURLが渡されることも多いので、ページからフィードを探す
+	feedURL := fs.Arg(0)
+	if !*noDiscover {
+		u, err := chooseFeed(feedURL, *pick)
+		if err != nil {
+			return err
+		}
+		feedURL = u
+	}
+
+	sub := Subscription{
+		URL:           feedURL,
+		Title:         *title,
+		Category:      *category,
+		Enabled:       true,
+		FetchInterval: *interval,
+	}
+	if err := db.Create(&sub).Error; err != nil {
+		return err
+	}
+	fmt.Printf("Added %s\n", sub.URL)
+	return nil
+}
+
+// removeSubscription 購読を削除する。取得済みのフィードとアイテムは残す
+func removeSubscription(db *gorm.DB, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: remove URL")
+	}
+	sub, err := findSubscription(db, args[0])
+	if err != nil {
+		return err
+	}
+	if err := db.Delete(sub).Error; err != nil {
+		return err
+	}
+	fmt.Printf("Removed %s\n", sub.URL)
+	return nil
+}
+
+// setSubscriptionEnabled 購読の有効・無効を切り替える
+func setSubscriptionEnabled(db *gorm.DB, args []string, enabled bool) error {
+	if len(args) != 1 {
+		return errors.New("usage: enable|disable URL")
+	}
+	sub, err := findSubscription(db, args[0])
+	if err != nil {
+		return err
+	}
+	updates := map[string]interface{}{"enabled": enabled, "disabled_reason": ""}
+	if enabled {
+		// 自動で無効にされた購読を有効に戻すときは、失敗の回数もやり直す
+		updates["failures"] = 0
+	}
+	if err := db.Model(sub).Updates(updates).Error; err != nil {
+		return err
+	}
+	state := "Disabled"
+	if enabled {
+		state = "Enabled"
+	}
+	fmt.Printf("%s %s\n", state, sub.URL)
+	return nil
+}
+
+// listSubscriptions 購読の一覧をカテゴリ順に表示する
+func listSubscriptions(db *gorm.DB) error {
+	var subs []Subscription
+	if err := db.Order("category, url").Find(&subs).Error; err != nil {
+		return err
+	}
+
+	for _, sub := range subs {
+		// 取得済みのフィードがあればタイトルと最終取得日時を表示する
+		var feed RssFeed
+		db.Where("url = ?", sub.URL).Limit(1).Find(&feed)
+
+		title := sub.Title
+		if title == "" {
+			title = feed.Title
+		}
+		mark := "x"
+		if sub.Enabled {
+			mark = " "
+		}
+		lastFetched := "-"
+		if !feed.LastFetched.IsZero() {
+			lastFetched = feed.LastFetched.Format("2006-01-02 15:04")
+		}
+		interval := "-"
+		if sub.FetchInterval > 0 {
+			interval = sub.FetchInterval.String()
+		}
+		fmt.Printf("[%s] %-12s %-40s %s (interval %s, last %s)\n", mark, sub.Category, title, sub.URL, interval, lastFetched)
+		if sub.DisabledReason != "" {
+			fmt.Printf("    disabled: %s\n", sub.DisabledReason)
+		}
+	}
+	return nil
+}
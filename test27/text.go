@@ -0,0 +1,177 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/text/width"
+)
+
+// 改行を入れるブロック要素
+var blockElements = map[string]bool{
+	"p": true, "div": true, "br": true, "hr": true, "li": true, "ul": true, "ol": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"table": true, "tr": true, "blockquote": true, "pre": true, "dt": true, "dd": true,
+	"section": true, "article": true, "header": true, "footer": true, "figure": true, "figcaption": true,
+}
+
+// 本文として表示しない要素
+var skipElements = map[string]bool{
+	"head": true, "script": true, "style": true, "noscript": true, "template": true, "iframe": true, "svg": true,
+}
+
+var spaces = regexp.MustCompile(`\s+`)
+
+// htmlToText HTMLを段落ごとに改行したプレーンテキストにする
+func htmlToText(s string) string {
+	doc, err := html.Parse(strings.NewReader(s))
+	if err != nil {
+		return s
+	}
+
+	var b strings.Builder
+	newline := func() {
+		if b.Len() > 0 && !strings.HasSuffix(b.String(), "\n") {
+			b.WriteString("\n")
+		}
+	}
+	var walk func(n *html.Node, pre bool)
+	walk = func(n *html.Node, pre bool) {
+		switch n.Type {
+		case html.TextNode:
+			if pre {
+				b.WriteString(n.Data)
+			} else {
+				b.WriteString(spaces.ReplaceAllString(n.Data, " "))
+			}
+			return
+		case html.ElementNode:
+			if skipElements[n.Data] {
+				return
+			}
+			if n.Data == "img" {
+				for _, a := range n.Attr {
+					if a.Key == "alt" && a.Val != "" {
+						b.WriteString("[" + a.Val + "]")
+					}
+				}
+				return
+			}
+			pre = pre || n.Data == "pre"
+			if blockElements[n.Data] {
+				newline()
+				if n.Data == "p" || isHeading(n.Data) {
+					// 段落や見出しの前は1行空ける
+					b.WriteString("\n")
+				}
+			}
+			if n.Data == "li" {
+				b.WriteString("- ")
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c, pre)
+		}
+		if n.Type == html.ElementNode && blockElements[n.Data] {
+			newline()
+		}
+	}
+	walk(doc, false)
+
+	// 行末の空白を取り、空行は1行にまとめる
+	var lines []string
+	blank := true
+	for _, line := range strings.Split(b.String(), "\n") {
+		line = strings.TrimRightFunc(line, unicode.IsSpace)
+		if strings.TrimSpace(line) == "" {
+			if !blank {
+				lines = append(lines, "")
+			}
+			blank = true
+			continue
+		}
+		lines = append(lines, strings.TrimPrefix(line, " "))
+		blank = false
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// isHeading h1〜h6の要素かどうか
+func isHeading(tag string) bool {
+	return len(tag) == 2 && tag[0] == 'h' && tag[1] >= '1' && tag[1] <= '6'
+}
+
+// runeWidth 端末で表示したときの文字の幅（全角は2）
+func runeWidth(r rune) int {
+	switch width.LookupRune(r).Kind() {
+	case width.EastAsianWide, width.EastAsianFullwidth:
+		return 2
+	}
+	return 1
+}
+
+// displayWidth 文字列を端末で表示したときの幅
+func displayWidth(s string) int {
+	w := 0
+	for _, r := range s {
+		w += runeWidth(r)
+	}
+	return w
+}
+
+// fitWidth 文字列を表示幅wに切り詰め、足りなければ空白で埋める。制御文字は空白にする
+func fitWidth(s string, w int) string {
+	var b strings.Builder
+	used := 0
+	for _, r := range s {
+		if unicode.IsControl(r) {
+			r = ' '
+		}
+		rw := runeWidth(r)
+		if used+rw > w {
+			break
+		}
+		b.WriteRune(r)
+		used += rw
+	}
+	if w > used {
+		b.WriteString(strings.Repeat(" ", w-used))
+	}
+	return b.String()
+}
+
+// wrapText テキストを表示幅wで折り返した行の一覧にする。空白があればそこで折り返す
+func wrapText(text string, w int) []string {
+	if w < 2 {
+		w = 2
+	}
+	var lines []string
+	for _, s := range strings.Split(text, "\n") {
+		for displayWidth(s) > w {
+			cut, used, lastSpace := 0, 0, -1
+			for i, r := range s {
+				rw := runeWidth(r)
+				if used+rw > w {
+					break
+				}
+				used += rw
+				cut = i + utf8.RuneLen(r)
+				if r == ' ' {
+					lastSpace = i
+				}
+			}
+			if lastSpace > 0 {
+				lines = append(lines, s[:lastSpace])
+				s = s[lastSpace+1:]
+			} else {
+				lines = append(lines, s[:cut])
+				s = s[cut:]
+			}
+		}
+		lines = append(lines, s)
+	}
+	return lines
+}